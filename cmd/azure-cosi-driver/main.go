@@ -15,18 +15,29 @@ package main
 
 import (
 	"flag"
+	"os"
 	"project/azure-cosi-driver/pkg/driver"
 	identityserver "project/azure-cosi-driver/pkg/server/identity"
 	provisionerserver "project/azure-cosi-driver/pkg/server/provisioner"
+	"strings"
+	"time"
 
 	"k8s.io/klog"
 )
 
 var (
+	// version is set by the release tools at build time
+	version = "unknown"
+
 	endpoint                   = flag.String("endpoint", driver.DefaultEndpoint, "endpoint for the GRPC server")
 	kubeconfig                 = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
 	cloudConfigSecretName      = flag.String("cloud-config-secret-name", "azure-cloud-provider", "cloud config secret name")
 	cloudConfigSecretNamespace = flag.String("cloud-config-secret-namespace", "kube-system", "cloud config secret namespace")
+	credentialRefreshLeadTime  = flag.Duration("credential-refresh-lead-time", time.Hour, "how long before expiry time limited credentials are rotated")
+	maxCredentialLifetime      = flag.Duration("max-credential-lifetime", 0, "maximum lifetime of time limited credentials a grant may request, 0 for no limit")
+	allowedPublicAccessLevels  = flag.String("allowed-public-access-levels", "none", "comma separated container public access levels (none, blob, container) bucket classes may request")
+	credentialSecretNamespace  = flag.String("credential-secret-namespace", os.Getenv("POD_NAMESPACE"), "namespace of the secrets holding the grant records of the driver, defaults to the POD_NAMESPACE env var")
+	deleteEmptyStorageAccounts = flag.Bool("delete-empty-storage-accounts", false, "delete storage accounts created by the driver, and their private endpoints, when their last bucket is deleted")
 )
 
 func init() {
@@ -37,7 +48,17 @@ func main() {
 	flag.Parse()
 	defer klog.Flush()
 
-	provServer, err := provisionerserver.NewProvisionerServer(*kubeconfig, *cloudConfigSecretName, *cloudConfigSecretNamespace)
+	provServer, err := provisionerserver.NewProvisionerServer(
+		*kubeconfig,
+		*cloudConfigSecretName,
+		*cloudConfigSecretNamespace,
+		driver.DriverName,
+		version,
+		*credentialSecretNamespace,
+		*credentialRefreshLeadTime,
+		*maxCredentialLifetime,
+		strings.Split(*allowedPublicAccessLevels, ","),
+		*deleteEmptyStorageAccounts)
 	if err != nil {
 		klog.Exitf("Error creating ProvisionerServer: %v", err)
 	}
@@ -0,0 +1,319 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accesspolicy parses the access policy of a bucket access request.
+//
+// The access policy is either one of the presets
+//
+//	read       read and list blobs
+//	readwrite  read, list, add, create, write and delete blobs (the default when empty)
+//	admin      readwrite plus blob tags, granted as Storage Blob Data Owner with role assignments
+//
+// or a JSON document in the style of an S3 IAM statement
+//
+//	{
+//	  "Effect": "Allow",
+//	  "Action": ["blob:Read", "blob:List"],
+//	  "Prefix": "logs/",
+//	  "Expiry": "72h"
+//	}
+//
+// Effect is optional and only Allow is supported. Action is a single action or a list of
+// blob:Read, blob:Add, blob:Create, blob:Write, blob:Delete, blob:List, blob:Tag, blob:Admin
+// or blob:*, the S3 actions s3:GetObject, s3:PutObject, s3:DeleteObject, s3:ListBucket and s3:*
+// are accepted as aliases. Prefix optionally restricts the grant to a directory of the bucket and
+// Expiry is an optional Go duration overriding the default lifetime of the credentials.
+package accesspolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	PresetRead      = "read"
+	PresetReadWrite = "readwrite"
+	PresetAdmin     = "admin"
+
+	EffectAllow = "allow"
+
+	StorageBlobDataReaderRole        = "Storage Blob Data Reader"
+	StorageBlobDataReaderRoleId      = "2a2b9908-6ea1-4ae2-8e65-a410df84e7d1"
+	StorageBlobDataContributorRole   = "Storage Blob Data Contributor"
+	StorageBlobDataContributorRoleId = "ba92f5b4-2d11-453d-a403-e96b0029c9fe"
+	StorageBlobDataOwnerRole         = "Storage Blob Data Owner"
+	StorageBlobDataOwnerRoleId       = "b7e6dc6d-f1e8-4753-8033-0f276bb0955b"
+)
+
+// Permissions are the operations allowed on the blobs of a bucket
+type Permissions struct {
+	Read, Add, Create, Write, Delete, List, Tag, Admin bool
+}
+
+// Policy is a parsed and validated access policy
+type Policy struct {
+	Permissions Permissions
+	// Prefix restricts the grant to the blobs below this path, empty for the whole bucket
+	Prefix string
+	// Expiry is the requested lifetime of the credentials, zero for the driver default
+	Expiry time.Duration
+}
+
+type statement struct {
+	Effect string
+	Action actionList
+	Prefix string
+	Expiry string
+}
+
+// actionList accepts both a single action and a list of actions
+type actionList []string
+
+func (a *actionList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = []string{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("Action must be a string or a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// Parse parses and validates an access policy preset or JSON document
+func Parse(accessPolicy string) (*Policy, error) {
+	accessPolicy = strings.TrimSpace(accessPolicy)
+	switch strings.ToLower(accessPolicy) {
+	case PresetRead:
+		return &Policy{Permissions: Permissions{Read: true, List: true}}, nil
+	case "", PresetReadWrite:
+		return &Policy{Permissions: readWritePermissions()}, nil
+	case PresetAdmin:
+		permissions := readWritePermissions()
+		permissions.Tag = true
+		permissions.Admin = true
+		return &Policy{Permissions: permissions}, nil
+	}
+
+	if !strings.HasPrefix(accessPolicy, "{") {
+		return nil, fmt.Errorf("Access policy '%s' is neither a preset (%s, %s, %s) nor a JSON document", accessPolicy, PresetRead, PresetReadWrite, PresetAdmin)
+	}
+
+	var stmt statement
+	decoder := json.NewDecoder(strings.NewReader(accessPolicy))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&stmt); err != nil {
+		return nil, fmt.Errorf("Access policy is not a valid JSON document : %v", err)
+	}
+
+	if stmt.Effect != "" && !strings.EqualFold(stmt.Effect, EffectAllow) {
+		return nil, fmt.Errorf("Access policy effect '%s' is not supported, only Allow statements can be granted", stmt.Effect)
+	}
+
+	if len(stmt.Action) == 0 {
+		return nil, fmt.Errorf("Access policy must list at least one action")
+	}
+
+	policy := &Policy{
+		Prefix: strings.Trim(stmt.Prefix, "/"),
+	}
+	for _, action := range stmt.Action {
+		if err := policy.Permissions.add(action); err != nil {
+			return nil, err
+		}
+	}
+
+	if stmt.Expiry != "" {
+		expiry, err := time.ParseDuration(stmt.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("Access policy expiry '%s' is not a valid duration : %v", stmt.Expiry, err)
+		}
+		if expiry <= 0 {
+			return nil, fmt.Errorf("Access policy expiry '%s' must be positive", stmt.Expiry)
+		}
+		policy.Expiry = expiry
+	}
+
+	return policy, nil
+}
+
+func readWritePermissions() Permissions {
+	return Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true}
+}
+
+func (p *Permissions) add(action string) error {
+	switch strings.ToLower(action) {
+	case "blob:read", "s3:getobject":
+		p.Read = true
+	case "blob:add":
+		p.Add = true
+	case "blob:create":
+		p.Create = true
+	case "blob:write", "s3:putobject":
+		p.Write = true
+		p.Create = true
+	case "blob:delete", "s3:deleteobject":
+		p.Delete = true
+	case "blob:list", "s3:listbucket":
+		p.List = true
+	case "blob:tag":
+		p.Tag = true
+	case "blob:admin":
+		*p = readWritePermissions()
+		p.Tag = true
+		p.Admin = true
+	case "blob:*", "s3:*":
+		admin := p.Admin
+		*p = readWritePermissions()
+		p.Tag = true
+		p.Admin = admin
+	default:
+		return fmt.Errorf("Access policy action '%s' is not supported", action)
+	}
+	return nil
+}
+
+// SASPermissions returns the container SAS permission letters of the policy, a SAS can not
+// manage access control so admin grants the same letters as blob:*
+func (p *Policy) SASPermissions() (string, error) {
+	if p.Prefix != "" {
+		return "", fmt.Errorf("Access policy prefix '%s' can not be expressed with a container SAS, which always covers the whole bucket", p.Prefix)
+	}
+	return p.permissionLetters(), nil
+}
+
+// StoredAccessPolicyPermissions returns the permission letters of a container stored access policy,
+// which unlike a SAS can not carry the tag permission
+func (p *Policy) StoredAccessPolicyPermissions() (string, error) {
+	if p.Permissions.Tag {
+		return "", fmt.Errorf("Access policy tag permission can not be expressed with a stored access policy, use a user delegation grant instead")
+	}
+
+	return p.SASPermissions()
+}
+
+// Unrestricted checks that the policy allows everything, for credentials such as account keys that
+// can not be narrowed down at all
+func (p *Policy) Unrestricted() error {
+	if p.Prefix != "" || p.Expiry != 0 || !p.Permissions.Tag || p.Permissions != (Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true, Tag: true, Admin: p.Permissions.Admin}) {
+		return fmt.Errorf("Account keys grant unrestricted access to the whole storage account, the access policy must be %s or blob:* without prefix or expiry", PresetAdmin)
+	}
+	return nil
+}
+
+// LocalUserPermissions returns the permission letters of an SFTP local user, which are scoped to the
+// whole container and never expire
+func (p *Policy) LocalUserPermissions() (string, error) {
+	if p.Prefix != "" {
+		return "", fmt.Errorf("Access policy prefix '%s' can not be expressed with a local user, which is scoped to the whole bucket", p.Prefix)
+	}
+	if p.Expiry != 0 {
+		return "", fmt.Errorf("Access policy expiry can not be expressed with a local user, which is valid until revoked")
+	}
+	if p.Permissions.Tag {
+		return "", fmt.Errorf("Access policy tag permission can not be expressed with a local user")
+	}
+
+	var b strings.Builder
+	if p.Permissions.Read {
+		b.WriteRune('r')
+	}
+	if p.Permissions.Write || p.Permissions.Add {
+		b.WriteRune('w')
+	}
+	if p.Permissions.Delete {
+		b.WriteRune('d')
+	}
+	if p.Permissions.List {
+		b.WriteRune('l')
+	}
+	if p.Permissions.Create {
+		b.WriteRune('c')
+	}
+	return b.String(), nil
+}
+
+// ACLPermissions returns the rwx permissions of a POSIX ACL entry for the policy. Reading and listing need
+// read and execute, every kind of change needs write and execute.
+func (p *Policy) ACLPermissions() (string, error) {
+	if p.Expiry != 0 {
+		return "", fmt.Errorf("Access policy expiry can not be expressed with an ACL, which is valid until revoked")
+	}
+	if p.Permissions.Tag {
+		return "", fmt.Errorf("Access policy tag permission can not be expressed with an ACL")
+	}
+
+	read, write := "-", "-"
+	if p.Permissions.Read || p.Permissions.List {
+		read = "r"
+	}
+	if p.Permissions.Add || p.Permissions.Create || p.Permissions.Write || p.Permissions.Delete {
+		write = "w"
+	}
+	return read + write + "x", nil
+}
+
+// RoleDefinition returns the name and id of the built in Storage Blob Data role that matches the policy.
+// Roles can not be narrowed, so the policy must match one of the roles exactly.
+func (p *Policy) RoleDefinition() (string, string, error) {
+	if p.Prefix != "" {
+		return "", "", fmt.Errorf("Access policy prefix '%s' can not be expressed with a container role assignment, use an ACL grant on an HNS enabled bucket", p.Prefix)
+	}
+	if p.Expiry != 0 {
+		return "", "", fmt.Errorf("Access policy expiry can not be expressed with a role assignment, which is valid until revoked")
+	}
+
+	readWrite := readWritePermissions()
+	switch {
+	case p.Permissions == Permissions{Read: true, List: true}:
+		return StorageBlobDataReaderRole, StorageBlobDataReaderRoleId, nil
+	case p.Permissions == readWrite, p.Permissions == Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true, Tag: true}:
+		return StorageBlobDataContributorRole, StorageBlobDataContributorRoleId, nil
+	case p.Permissions.Admin:
+		return StorageBlobDataOwnerRole, StorageBlobDataOwnerRoleId, nil
+	}
+
+	return "", "", fmt.Errorf("Access policy permissions '%s' do not match a Storage Blob Data role, use read (Reader), readwrite (Contributor) or admin (Owner)", p.permissionLetters())
+}
+
+func (p *Policy) permissionLetters() string {
+	var b strings.Builder
+	if p.Permissions.Read {
+		b.WriteRune('r')
+	}
+	if p.Permissions.Add {
+		b.WriteRune('a')
+	}
+	if p.Permissions.Create {
+		b.WriteRune('c')
+	}
+	if p.Permissions.Write {
+		b.WriteRune('w')
+	}
+	if p.Permissions.Delete {
+		b.WriteRune('d')
+	}
+	if p.Permissions.List {
+		b.WriteRune('l')
+	}
+	if p.Permissions.Tag {
+		b.WriteRune('t')
+	}
+	return b.String()
+}
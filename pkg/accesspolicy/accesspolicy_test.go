@@ -0,0 +1,257 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesspolicy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	readWrite := Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true}
+	all := Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true, Tag: true}
+	admin := Permissions{Read: true, Add: true, Create: true, Write: true, Delete: true, List: true, Tag: true, Admin: true}
+
+	tests := []struct {
+		desc         string
+		accessPolicy string
+		expected     *Policy
+		expectErr    bool
+	}{
+		{
+			desc:         "empty policy defaults to readwrite",
+			accessPolicy: "",
+			expected:     &Policy{Permissions: readWrite},
+		},
+		{
+			desc:         "read preset",
+			accessPolicy: "read",
+			expected:     &Policy{Permissions: Permissions{Read: true, List: true}},
+		},
+		{
+			desc:         "presets are case insensitive and trimmed",
+			accessPolicy: " ReadWrite ",
+			expected:     &Policy{Permissions: readWrite},
+		},
+		{
+			desc:         "admin preset",
+			accessPolicy: "admin",
+			expected:     &Policy{Permissions: admin},
+		},
+		{
+			desc:         "unknown preset",
+			accessPolicy: "write",
+			expectErr:    true,
+		},
+		{
+			desc:         "single action",
+			accessPolicy: `{"Action": "blob:Read"}`,
+			expected:     &Policy{Permissions: Permissions{Read: true}},
+		},
+		{
+			desc:         "action list with prefix and expiry",
+			accessPolicy: `{"Effect": "Allow", "Action": ["blob:Read", "blob:List"], "Prefix": "/logs/", "Expiry": "72h"}`,
+			expected:     &Policy{Permissions: Permissions{Read: true, List: true}, Prefix: "logs", Expiry: 72 * time.Hour},
+		},
+		{
+			desc:         "s3 aliases",
+			accessPolicy: `{"Action": ["s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:ListBucket"]}`,
+			expected:     &Policy{Permissions: Permissions{Read: true, Create: true, Write: true, Delete: true, List: true}},
+		},
+		{
+			desc:         "wildcard grants everything but admin",
+			accessPolicy: `{"Action": "blob:*"}`,
+			expected:     &Policy{Permissions: all},
+		},
+		{
+			desc:         "wildcard keeps admin",
+			accessPolicy: `{"Action": ["blob:Admin", "s3:*"]}`,
+			expected:     &Policy{Permissions: admin},
+		},
+		{
+			desc:         "deny effect",
+			accessPolicy: `{"Effect": "Deny", "Action": "blob:Read"}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "no actions",
+			accessPolicy: `{"Action": []}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "unknown action",
+			accessPolicy: `{"Action": "blob:Execute"}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "unknown field",
+			accessPolicy: `{"Action": "blob:Read", "Resource": "*"}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "action of the wrong type",
+			accessPolicy: `{"Action": 1}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "invalid expiry",
+			accessPolicy: `{"Action": "blob:Read", "Expiry": "3 days"}`,
+			expectErr:    true,
+		},
+		{
+			desc:         "negative expiry",
+			accessPolicy: `{"Action": "blob:Read", "Expiry": "-1h"}`,
+			expectErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		policy, err := Parse(test.accessPolicy)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got policy %+v", test.desc, policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(policy, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, policy)
+		}
+	}
+}
+
+func TestPermissionMappings(t *testing.T) {
+	tests := []struct {
+		desc                  string
+		accessPolicy          string
+		sas                   string
+		storedAccessPolicy    string
+		localUser             string
+		acl                   string
+		role                  string
+		sasErr, storedErr     bool
+		localUserErr, aclErr  bool
+		roleErr, unrestricted bool
+	}{
+		{
+			desc:               "read",
+			accessPolicy:       "read",
+			sas:                "rl",
+			storedAccessPolicy: "rl",
+			localUser:          "rl",
+			acl:                "r-x",
+			role:               StorageBlobDataReaderRoleId,
+		},
+		{
+			desc:               "readwrite",
+			accessPolicy:       "readwrite",
+			sas:                "racwdl",
+			storedAccessPolicy: "racwdl",
+			localUser:          "rwdlc",
+			acl:                "rwx",
+			role:               StorageBlobDataContributorRoleId,
+		},
+		{
+			desc:         "admin",
+			accessPolicy: "admin",
+			sas:          "racwdlt",
+			storedErr:    true,
+			localUserErr: true,
+			aclErr:       true,
+			role:         StorageBlobDataOwnerRoleId,
+			unrestricted: true,
+		},
+		{
+			desc:         "wildcard",
+			accessPolicy: `{"Action": "blob:*"}`,
+			sas:          "racwdlt",
+			storedErr:    true,
+			localUserErr: true,
+			aclErr:       true,
+			role:         StorageBlobDataContributorRoleId,
+			unrestricted: true,
+		},
+		{
+			desc:               "write only",
+			accessPolicy:       `{"Action": "blob:Write"}`,
+			sas:                "cw",
+			storedAccessPolicy: "cw",
+			localUser:          "wc",
+			acl:                "-wx",
+			roleErr:            true,
+		},
+		{
+			desc:         "prefix",
+			accessPolicy: `{"Action": "blob:Read", "Prefix": "logs"}`,
+			sasErr:       true,
+			storedErr:    true,
+			localUserErr: true,
+			acl:          "r-x",
+			roleErr:      true,
+		},
+		{
+			desc:               "expiry",
+			accessPolicy:       `{"Action": ["blob:Read", "blob:List"], "Expiry": "1h"}`,
+			sas:                "rl",
+			storedAccessPolicy: "rl",
+			localUserErr:       true,
+			aclErr:             true,
+			roleErr:            true,
+		},
+	}
+
+	for _, test := range tests {
+		policy, err := Parse(test.accessPolicy)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+
+		sas, err := policy.SASPermissions()
+		checkMapping(t, test.desc, "SAS", sas, test.sas, err, test.sasErr)
+		stored, err := policy.StoredAccessPolicyPermissions()
+		checkMapping(t, test.desc, "stored access policy", stored, test.storedAccessPolicy, err, test.storedErr)
+		localUser, err := policy.LocalUserPermissions()
+		checkMapping(t, test.desc, "local user", localUser, test.localUser, err, test.localUserErr)
+		acl, err := policy.ACLPermissions()
+		checkMapping(t, test.desc, "ACL", acl, test.acl, err, test.aclErr)
+		_, roleId, err := policy.RoleDefinition()
+		checkMapping(t, test.desc, "role", roleId, test.role, err, test.roleErr)
+
+		if err := policy.Unrestricted(); (err == nil) != test.unrestricted {
+			t.Errorf("%s: expected unrestricted %v, got error %v", test.desc, test.unrestricted, err)
+		}
+	}
+}
+
+func checkMapping(t *testing.T, desc, mapping, actual, expected string, err error, expectErr bool) {
+	t.Helper()
+	if expectErr {
+		if err == nil {
+			t.Errorf("%s: expected an error for the %s permissions, got '%s'", desc, mapping, actual)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: unexpected error for the %s permissions %v", desc, mapping, err)
+		return
+	}
+	if actual != expected {
+		t.Errorf("%s: expected %s permissions '%s', got '%s'", desc, mapping, expected, actual)
+	}
+}
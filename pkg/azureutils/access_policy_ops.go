@@ -0,0 +1,131 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/util/retry"
+)
+
+// setContainerStoredAccessPolicy adds or updates the stored access policy with the given id on the container.
+// Azure allows at most MaxStoredAccessPolicies identifiers per container, so a new id is rejected once the
+// container is full instead of evicting a policy that another grant relies on.
+func setContainerStoredAccessPolicy(
+	ctx context.Context,
+	containerURL azblob.ContainerURL,
+	id string,
+	permissions string,
+	startTime time.Time,
+	expiryTime time.Time) error {
+	// Grants of the same container race on its ACL, the loser reads it again and merges its policy into the new one
+	return retry.OnError(retry.DefaultRetry, isAccessPolicyModified, func() error {
+		identifiers, err := containerURL.GetAccessPolicy(ctx, azblob.LeaseAccessConditions{})
+		if err != nil {
+			return fmt.Errorf("Error getting access policy for container %s : %v", containerURL.String(), err)
+		}
+
+		accessPolicy := azblob.AccessPolicy{
+			Start:      &startTime,
+			Expiry:     &expiryTime,
+			Permission: &permissions,
+		}
+
+		items := identifiers.Items
+		found := false
+		for i := range items {
+			if items[i].ID == id {
+				items[i].AccessPolicy = accessPolicy
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			if len(items) >= MaxStoredAccessPolicies {
+				return status.Error(codes.ResourceExhausted, fmt.Sprintf("Container %s already has the maximum of %d stored access policies, revoke an existing grant before granting a new one", containerURL.String(), MaxStoredAccessPolicies))
+			}
+			items = append(items, azblob.SignedIdentifier{
+				ID:           id,
+				AccessPolicy: accessPolicy,
+			})
+		}
+
+		return putContainerSignedIdentifiers(ctx, containerURL, identifiers, items)
+	})
+}
+
+// removeContainerStoredAccessPolicy removes the stored access policy with the given id from the container,
+// which immediately invalidates every SAS signed against it. Missing ids and containers are ignored.
+func removeContainerStoredAccessPolicy(
+	ctx context.Context,
+	containerURL azblob.ContainerURL,
+	id string) error {
+	return retry.OnError(retry.DefaultRetry, isAccessPolicyModified, func() error {
+		identifiers, err := containerURL.GetAccessPolicy(ctx, azblob.LeaseAccessConditions{})
+		if err != nil {
+			// Without shared key access the account can not have a usable stored access policy SAS
+			if serr, ok := err.(azblob.StorageError); ok &&
+				(serr.ServiceCode() == azblob.ServiceCodeContainerNotFound || serr.ServiceCode() == serviceCodeKeyBasedAuthenticationNotPermitted) {
+				return nil
+			}
+			return fmt.Errorf("Error getting access policy for container %s : %v", containerURL.String(), err)
+		}
+
+		items := make([]azblob.SignedIdentifier, 0, len(identifiers.Items))
+		for _, item := range identifiers.Items {
+			if item.ID != id {
+				items = append(items, item)
+			}
+		}
+
+		if len(items) == len(identifiers.Items) {
+			return nil
+		}
+
+		return putContainerSignedIdentifiers(ctx, containerURL, identifiers, items)
+	})
+}
+
+// putContainerSignedIdentifiers writes the identifiers back while keeping the public access level of the
+// container, and fails if the ACL was modified since it was read, see isAccessPolicyModified
+func putContainerSignedIdentifiers(
+	ctx context.Context,
+	containerURL azblob.ContainerURL,
+	current *azblob.SignedIdentifiers,
+	items []azblob.SignedIdentifier) error {
+	_, err := containerURL.SetAccessPolicy(ctx, current.BlobPublicAccess(), items, azblob.ContainerAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+			IfUnmodifiedSince: current.LastModified(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting access policy for container %s : %w", containerURL.String(), err)
+	}
+
+	return nil
+}
+
+// isAccessPolicyModified checks whether setting the ACL failed because another grant changed it after it was read
+func isAccessPolicyModified(err error) bool {
+	var serr azblob.StorageError
+	return errors.As(err, &serr) && serr.Response() != nil && serr.Response().StatusCode == http.StatusPreconditionFailed
+}
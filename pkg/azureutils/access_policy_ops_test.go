@@ -0,0 +1,206 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/util/retry"
+)
+
+// fakeContainerACL serves the ACL of a single container, honouring If-Unmodified-Since on updates like Azure does
+type fakeContainerACL struct {
+	lock         sync.Mutex
+	items        []azblob.SignedIdentifier
+	lastModified time.Time
+	puts         int
+	// beforePut runs ahead of every update, to change the ACL the way a concurrent grant would
+	beforePut func(f *fakeContainerACL)
+}
+
+func (f *fakeContainerACL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		body, _ := xml.Marshal(azblob.SignedIdentifiers{Items: f.items})
+		w.Header().Set("Last-Modified", f.lastModified.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	case http.MethodPut:
+		f.puts++
+		if f.beforePut != nil {
+			f.beforePut(f)
+		}
+		since, err := time.Parse(http.TimeFormat, r.Header.Get("If-Unmodified-Since"))
+		if err != nil || f.lastModified.After(since) {
+			w.Header().Set("x-ms-error-code", "ConditionNotMet")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><Error><Code>ConditionNotMet</Code><Message>The condition specified using HTTP conditional header(s) is not met.</Message></Error>`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		identifiers := azblob.SignedIdentifiers{}
+		if err := xml.Unmarshal(body, &identifiers); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.items = identifiers.Items
+		f.lastModified = f.lastModified.Add(time.Second)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (f *fakeContainerACL) ids() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ids := []string{}
+	for _, item := range f.items {
+		ids = append(ids, item.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newTestContainerURL(t *testing.T, acl *fakeContainerACL) azblob.ContainerURL {
+	server := httptest.NewServer(acl)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL + "/bucket")
+	pipeline := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}})
+	return azblob.NewContainerURL(*u, pipeline)
+}
+
+func newTestSignedIdentifier(id, permissions string) azblob.SignedIdentifier {
+	start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	expiry := start.Add(DefaultGrantValidity)
+	return azblob.SignedIdentifier{ID: id, AccessPolicy: azblob.AccessPolicy{Start: &start, Expiry: &expiry, Permission: &permissions}}
+}
+
+func TestSetContainerStoredAccessPolicy(t *testing.T) {
+	start := time.Date(2021, 9, 2, 0, 0, 0, 0, time.UTC)
+	lastModified := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("policy is added next to the others", func(t *testing.T) {
+		acl := &fakeContainerACL{items: []azblob.SignedIdentifier{newTestSignedIdentifier("other", "r")}, lastModified: lastModified}
+		if err := setContainerStoredAccessPolicy(context.TODO(), newTestContainerURL(t, acl), "grant", "rl", start, start.Add(time.Hour)); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if ids := acl.ids(); !reflect.DeepEqual(ids, []string{"grant", "other"}) {
+			t.Errorf("expected policies grant and other, got %v", ids)
+		}
+	})
+
+	t.Run("policy of the grant is updated in place", func(t *testing.T) {
+		acl := &fakeContainerACL{items: []azblob.SignedIdentifier{newTestSignedIdentifier("grant", "r")}, lastModified: lastModified}
+		if err := setContainerStoredAccessPolicy(context.TODO(), newTestContainerURL(t, acl), "grant", "rwl", start, start.Add(time.Hour)); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(acl.items) != 1 || *acl.items[0].AccessPolicy.Permission != "rwl" {
+			t.Errorf("expected the policy of the grant to be updated to rwl, got %+v", acl.items)
+		}
+	})
+
+	t.Run("full container", func(t *testing.T) {
+		acl := &fakeContainerACL{lastModified: lastModified}
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			acl.items = append(acl.items, newTestSignedIdentifier(id, "r"))
+		}
+		err := setContainerStoredAccessPolicy(context.TODO(), newTestContainerURL(t, acl), "grant", "r", start, start.Add(time.Hour))
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("expected %v, got %v", codes.ResourceExhausted, err)
+		}
+		if acl.puts != 0 {
+			t.Errorf("expected no policy to be evicted, got %d updates", acl.puts)
+		}
+	})
+
+	t.Run("concurrent grant", func(t *testing.T) {
+		acl := &fakeContainerACL{lastModified: lastModified}
+		// another grant of the container sets its policy between the read and the write of this one
+		acl.beforePut = func(f *fakeContainerACL) {
+			f.items = append(f.items, newTestSignedIdentifier("concurrent", "r"))
+			f.lastModified = f.lastModified.Add(time.Second)
+			f.beforePut = nil
+		}
+		if err := setContainerStoredAccessPolicy(context.TODO(), newTestContainerURL(t, acl), "grant", "r", start, start.Add(time.Hour)); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if ids := acl.ids(); !reflect.DeepEqual(ids, []string{"concurrent", "grant"}) {
+			t.Errorf("expected both policies to be kept, got %v", ids)
+		}
+		if acl.puts != 2 {
+			t.Errorf("expected the update to be retried once, got %d updates", acl.puts)
+		}
+	})
+
+	t.Run("ACL that keeps changing", func(t *testing.T) {
+		acl := &fakeContainerACL{lastModified: lastModified}
+		acl.beforePut = func(f *fakeContainerACL) {
+			f.lastModified = f.lastModified.Add(time.Second)
+		}
+		err := setContainerStoredAccessPolicy(context.TODO(), newTestContainerURL(t, acl), "grant", "r", start, start.Add(time.Hour))
+		if !isAccessPolicyModified(err) {
+			t.Errorf("expected the precondition failure once the retries are exhausted, got %v", err)
+		}
+		if acl.puts != retry.DefaultRetry.Steps {
+			t.Errorf("expected %d updates, got %d", retry.DefaultRetry.Steps, acl.puts)
+		}
+	})
+}
+
+func TestRemoveContainerStoredAccessPolicy(t *testing.T) {
+	lastModified := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	acl := &fakeContainerACL{
+		items:        []azblob.SignedIdentifier{newTestSignedIdentifier("grant", "r"), newTestSignedIdentifier("other", "r")},
+		lastModified: lastModified,
+	}
+	acl.beforePut = func(f *fakeContainerACL) {
+		f.items = append(f.items, newTestSignedIdentifier("concurrent", "r"))
+		f.lastModified = f.lastModified.Add(time.Second)
+		f.beforePut = nil
+	}
+	containerURL := newTestContainerURL(t, acl)
+
+	if err := removeContainerStoredAccessPolicy(context.TODO(), containerURL, "grant"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ids := acl.ids(); !reflect.DeepEqual(ids, []string{"concurrent", "other"}) {
+		t.Errorf("expected only the policy of the grant to be removed, got %v", ids)
+	}
+
+	// removing it again does not touch the ACL
+	puts := acl.puts
+	if err := removeContainerStoredAccessPolicy(context.TODO(), containerURL, "grant"); err != nil {
+		t.Fatalf("unexpected error removing again %v", err)
+	}
+	if acl.puts != puts {
+		t.Errorf("expected no update for a missing policy")
+	}
+}
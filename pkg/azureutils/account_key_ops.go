@@ -0,0 +1,207 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+// GrantReissuer re-issues the credentials of existing grants, used to move the remaining
+// grantees off an account key before it is regenerated
+type GrantReissuer interface {
+	Reissue(ctx context.Context, bucketId, accountId string) error
+	ReissueAll(ctx context.Context, match func(bucketId, accountId string) bool) error
+}
+
+type accountKeyGrant struct {
+	bucketId string
+	keyName  string
+}
+
+// AccountKeyRegistry records which account key every account key grant was handed out,
+// and which key new grants of a storage account receive
+type AccountKeyRegistry struct {
+	lock sync.Mutex
+	// grants maps storage account to account id to grant
+	grants map[string]map[string]*accountKeyGrant
+	// activeKeys maps storage account to the key handed to new grants
+	activeKeys map[string]string
+}
+
+func NewAccountKeyRegistry() *AccountKeyRegistry {
+	return &AccountKeyRegistry{
+		grants:     make(map[string]map[string]*accountKeyGrant),
+		activeKeys: make(map[string]string),
+	}
+}
+
+// assign returns the key of the grant, handing out the active key of the storage account to new grants
+func (r *AccountKeyRegistry) assign(storageAccount, bucketId, accountId string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	grants, ok := r.grants[storageAccount]
+	if !ok {
+		grants = make(map[string]*accountKeyGrant)
+		r.grants[storageAccount] = grants
+	}
+	if grant, ok := grants[accountId]; ok {
+		return grant.keyName
+	}
+
+	keyName := r.activeKey(storageAccount)
+	grants[accountId] = &accountKeyGrant{
+		bucketId: bucketId,
+		keyName:  keyName,
+	}
+	return keyName
+}
+
+// activeKey defaults to key2, since the driver itself signs service SAS with key1
+func (r *AccountKeyRegistry) activeKey(storageAccount string) string {
+	if keyName, ok := r.activeKeys[storageAccount]; ok {
+		return keyName
+	}
+	return AccountKey2
+}
+
+// release forgets the grant and moves every other grantee holding the same key onto the surviving key.
+// It returns the compromised key to regenerate and the grants that now need new credentials, or an
+// empty key name when the account id had no account key grant.
+func (r *AccountKeyRegistry) release(storageAccount, accountId string) (string, []accountKeyGrantRef) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	grants := r.grants[storageAccount]
+	grant, ok := grants[accountId]
+	if !ok {
+		return "", nil
+	}
+	delete(grants, accountId)
+
+	compromised := grant.keyName
+	surviving := otherAccountKey(compromised)
+	moved := []accountKeyGrantRef{}
+	for id, other := range grants {
+		if other.keyName == compromised {
+			other.keyName = surviving
+			moved = append(moved, accountKeyGrantRef{bucketId: other.bucketId, accountId: id})
+		}
+	}
+	r.activeKeys[storageAccount] = surviving
+
+	return compromised, moved
+}
+
+// Restore records the grant again, used when the key of a released grant could not be regenerated
+// so that revoking it can be retried, and to reload persisted grants when the driver starts
+func (r *AccountKeyRegistry) Restore(bucketId, accountId, keyName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	storageAccount := getStorageAccountNameFromContainerUrl(bucketId)
+
+	if _, ok := r.grants[storageAccount]; !ok {
+		r.grants[storageAccount] = make(map[string]*accountKeyGrant)
+	}
+	r.grants[storageAccount][accountId] = &accountKeyGrant{
+		bucketId: bucketId,
+		keyName:  keyName,
+	}
+}
+
+// RebuildActiveKeys sets the key handed to new grants of every storage account from the restored grants, once the
+// persisted grants were reloaded. Releasing a key moves the other grantees onto the surviving key, so the grants of an
+// account normally hold the same key; when a failed regeneration left them split, the key most of them hold wins.
+func (r *AccountKeyRegistry) RebuildActiveKeys() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for storageAccount, grants := range r.grants {
+		holders := map[string]int{}
+		for _, grant := range grants {
+			holders[grant.keyName]++
+		}
+		if holders[AccountKey1] > holders[AccountKey2] {
+			r.activeKeys[storageAccount] = AccountKey1
+		} else if holders[AccountKey2] > 0 {
+			r.activeKeys[storageAccount] = AccountKey2
+		}
+	}
+}
+
+// KeyName returns the key currently held by the grant, empty when it is not an account key grant
+func (r *AccountKeyRegistry) KeyName(bucketId, accountId string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if grant, ok := r.grants[getStorageAccountNameFromContainerUrl(bucketId)][accountId]; ok {
+		return grant.keyName
+	}
+	return ""
+}
+
+type accountKeyGrantRef struct {
+	bucketId  string
+	accountId string
+}
+
+func otherAccountKey(keyName string) string {
+	if keyName == AccountKey1 {
+		return AccountKey2
+	}
+	return AccountKey1
+}
+
+// getAccountKey returns the value of the named key of the storage account
+func (c *StorageManagementClient) getAccountKey(ctx context.Context, storageAccount, keyName string) (string, error) {
+	result, err := c.accounts.ListKeys(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return "", fmt.Errorf("Error listing keys of storage account %s : %v", storageAccount, err)
+	}
+
+	return findAccountKey(result, storageAccount, keyName)
+}
+
+// regenerateAccountKey regenerates the named key, invalidating every credential derived from it
+func (c *StorageManagementClient) regenerateAccountKey(ctx context.Context, storageAccount, keyName string) error {
+	klog.Infof("Regenerating %s of storage account %s", keyName, storageAccount)
+	_, err := c.accounts.RegenerateKey(ctx, c.resourceGroup, storageAccount, storage.AccountRegenerateKeyParameters{
+		KeyName: to.StringPtr(keyName),
+	})
+	if err != nil {
+		return fmt.Errorf("Error regenerating %s of storage account %s : %v", keyName, storageAccount, err)
+	}
+
+	return nil
+}
+
+func findAccountKey(result storage.AccountListKeysResult, storageAccount, keyName string) (string, error) {
+	if result.Keys != nil {
+		for _, key := range *result.Keys {
+			if key.KeyName != nil && strings.EqualFold(*key.KeyName, keyName) && key.Value != nil {
+				return *key.Value, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Storage account %s has no key named %s", storageAccount, keyName)
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAccountKeyRegistryRelease(t *testing.T) {
+	bucketId := "https://account.blob.core.windows.net/bucket"
+
+	tests := []struct {
+		desc string
+		// grants are assigned in order, before released is revoked
+		grants      []string
+		released    string
+		compromised string
+		moved       []string
+		keys        map[string]string
+		activeKey   string
+	}{
+		{
+			desc:     "unknown grant",
+			grants:   []string{"a"},
+			released: "b",
+			keys:     map[string]string{"a": AccountKey2},
+			// nothing was released, so new grants still get the default key
+			activeKey: AccountKey2,
+		},
+		{
+			desc:        "only grant",
+			grants:      []string{"a"},
+			released:    "a",
+			compromised: AccountKey2,
+			moved:       []string{},
+			keys:        map[string]string{"a": ""},
+			activeKey:   AccountKey1,
+		},
+		{
+			desc:        "grantees of the same key move to the other key",
+			grants:      []string{"a", "b", "c"},
+			released:    "b",
+			compromised: AccountKey2,
+			moved:       []string{"a", "c"},
+			keys:        map[string]string{"a": AccountKey1, "b": "", "c": AccountKey1},
+			activeKey:   AccountKey1,
+		},
+	}
+
+	for _, test := range tests {
+		registry := NewAccountKeyRegistry()
+		for _, accountId := range test.grants {
+			registry.assign("account", bucketId, accountId)
+		}
+
+		compromised, refs := registry.release("account", test.released)
+		if compromised != test.compromised {
+			t.Errorf("%s: expected compromised key '%s', got '%s'", test.desc, test.compromised, compromised)
+		}
+		var moved []string
+		if refs != nil {
+			moved = []string{}
+			for _, ref := range refs {
+				if ref.bucketId != bucketId {
+					t.Errorf("%s: expected moved grant of bucket %s, got %s", test.desc, bucketId, ref.bucketId)
+				}
+				moved = append(moved, ref.accountId)
+			}
+			sort.Strings(moved)
+		}
+		if !reflect.DeepEqual(moved, test.moved) {
+			t.Errorf("%s: expected moved grants %v, got %v", test.desc, test.moved, moved)
+		}
+
+		for accountId, keyName := range test.keys {
+			if actual := registry.KeyName(bucketId, accountId); actual != keyName {
+				t.Errorf("%s: expected grant %s to hold key '%s', got '%s'", test.desc, accountId, keyName, actual)
+			}
+		}
+		if actual := registry.assign("account", bucketId, "new"); actual != test.activeKey {
+			t.Errorf("%s: expected new grants to get key '%s', got '%s'", test.desc, test.activeKey, actual)
+		}
+	}
+}
+
+func TestAccountKeyRegistryRestore(t *testing.T) {
+	bucketId := "https://account.blob.core.windows.net/bucket"
+	registry := NewAccountKeyRegistry()
+
+	registry.Restore(bucketId, "a", AccountKey1)
+	if keyName := registry.assign("account", bucketId, "a"); keyName != AccountKey1 {
+		t.Errorf("expected restored grant to keep key %s, got %s", AccountKey1, keyName)
+	}
+
+	compromised, moved := registry.release("account", "a")
+	if compromised != AccountKey1 || len(moved) != 0 {
+		t.Errorf("expected released key %s without moved grants, got %s and %v", AccountKey1, compromised, moved)
+	}
+
+	// a failed regeneration restores the grant, so that the revoke can be retried
+	registry.Restore(bucketId, "a", compromised)
+	if keyName := registry.KeyName(bucketId, "a"); keyName != AccountKey1 {
+		t.Errorf("expected grant to hold key %s again, got '%s'", AccountKey1, keyName)
+	}
+}
+
+func TestAccountKeyRegistryRebuildActiveKeys(t *testing.T) {
+	bucketId := "https://account.blob.core.windows.net/bucket"
+	otherBucketId := "https://other.blob.core.windows.net/bucket"
+
+	t.Run("grants moved onto key1 before the restart", func(t *testing.T) {
+		registry := NewAccountKeyRegistry()
+		registry.Restore(bucketId, "a", AccountKey1)
+		registry.Restore(bucketId, "b", AccountKey1)
+		registry.RebuildActiveKeys()
+
+		if keyName := registry.assign("account", bucketId, "new"); keyName != AccountKey1 {
+			t.Errorf("expected new grants to get the key of the restored grants %s, got %s", AccountKey1, keyName)
+		}
+		// storage accounts without restored grants keep the default
+		if keyName := registry.assign("other", otherBucketId, "new"); keyName != AccountKey2 {
+			t.Errorf("expected new grants of another account to get %s, got %s", AccountKey2, keyName)
+		}
+	})
+
+	t.Run("grants split by a failed regeneration", func(t *testing.T) {
+		registry := NewAccountKeyRegistry()
+		registry.Restore(bucketId, "revoked", AccountKey2)
+		registry.Restore(bucketId, "a", AccountKey1)
+		registry.Restore(bucketId, "b", AccountKey1)
+		registry.RebuildActiveKeys()
+
+		if keyName := registry.assign("account", bucketId, "new"); keyName != AccountKey1 {
+			t.Errorf("expected new grants to get the key most grants hold %s, got %s", AccountKey1, keyName)
+		}
+	})
+
+	t.Run("revoking after the restart", func(t *testing.T) {
+		registry := NewAccountKeyRegistry()
+		registry.Restore(bucketId, "a", AccountKey1)
+		registry.Restore(bucketId, "b", AccountKey1)
+		registry.RebuildActiveKeys()
+		registry.assign("account", bucketId, "new")
+
+		// the grant issued after the restart shares the key, so it moves with the other grantee
+		compromised, moved := registry.release("account", "a")
+		if compromised != AccountKey1 || len(moved) != 2 {
+			t.Errorf("expected %s to be released with 2 moved grants, got %s and %v", AccountKey1, compromised, moved)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// DataLakeClient manages POSIX ACLs of directories through the dfs endpoint of HNS enabled storage accounts.
+// The driver's identity needs Storage Blob Data Owner on the storage account to change ACLs.
+type DataLakeClient struct {
+	client autorest.Client
+}
+
+type setAccessControlRecursiveResult struct {
+	DirectoriesSuccessful int `json:"directoriesSuccessful"`
+	FilesSuccessful       int `json:"filesSuccessful"`
+	FailureCount          int `json:"failureCount"`
+	FailedEntries         []struct {
+		Name         string `json:"name"`
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"failedEntries"`
+}
+
+func NewDataLakeClient(cloud *azure.Cloud) (*DataLakeClient, error) {
+	token, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, cloud.Environment.ResourceIdentifiers.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting AAD token for the data lake client : %v", err)
+	}
+
+	client := autorest.NewClientWithUserAgent("azure-cosi-driver")
+	client.Authorizer = autorest.NewBearerAuthorizer(token)
+
+	return &DataLakeClient{
+		client: client,
+	}, nil
+}
+
+// grantDirectoryACL creates the directory if needed and adds access and default ACL entries for the principal to
+// the directory and everything below it, so that new children inherit them. The parent directories get an execute
+// only entry, which lets the principal traverse them without listing or reading them.
+func (c *DataLakeClient) grantDirectoryACL(
+	ctx context.Context,
+	storageAccount string,
+	containerName string,
+	directory string,
+	principalId string,
+	permissions string) error {
+	if err := c.createDirectory(ctx, storageAccount, containerName, directory); err != nil {
+		return err
+	}
+
+	parents := []string{""}
+	segments := strings.Split(directory, "/")
+	for i := 1; i < len(segments); i++ {
+		parents = append(parents, strings.Join(segments[:i], "/"))
+	}
+	for _, parent := range parents {
+		if err := c.addTraverseACL(ctx, storageAccount, containerName, parent, principalId); err != nil {
+			return err
+		}
+	}
+
+	acl := fmt.Sprintf("user:%s:%s,default:user:%s:%s", principalId, permissions, principalId, permissions)
+	return c.setAccessControlRecursive(ctx, storageAccount, containerName, directory, "modify", acl)
+}
+
+// revokeDirectoryACL strips the ACL entries of the principal from the directory and everything below it.
+// The execute only entries of the parent directories are kept, since other grants of the principal may
+// rely on traversing them.
+func (c *DataLakeClient) revokeDirectoryACL(
+	ctx context.Context,
+	storageAccount string,
+	containerName string,
+	directory string,
+	principalId string) error {
+	resp, err := c.send(ctx, http.MethodHead, storageAccount, containerName, directory,
+		map[string]interface{}{"action": "getAccessControl", "upn": "false"},
+		nil, nil, http.StatusOK)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			klog.Infof("Directory %s of container %s no longer exists", directory, containerName)
+			return nil
+		}
+		return fmt.Errorf("Error getting ACL of directory %s in container %s : %v", directory, containerName, err)
+	}
+
+	acl := fmt.Sprintf("user:%s,default:user:%s", principalId, principalId)
+	return c.setAccessControlRecursive(ctx, storageAccount, containerName, directory, "remove", acl)
+}
+
+func (c *DataLakeClient) createDirectory(ctx context.Context, storageAccount, containerName, directory string) error {
+	resp, err := c.send(ctx, http.MethodPut, storageAccount, containerName, directory,
+		map[string]interface{}{"resource": "directory"},
+		map[string]interface{}{"If-None-Match": "*"},
+		nil, http.StatusCreated)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("Error creating directory %s in container %s : %v", directory, containerName, err)
+	}
+
+	return nil
+}
+
+// addTraverseACL adds an execute only entry for the principal to the directory, keeping its other entries.
+// Entries the principal already has are left as they are.
+func (c *DataLakeClient) addTraverseACL(ctx context.Context, storageAccount, containerName, directory, principalId string) error {
+	resp, err := c.send(ctx, http.MethodHead, storageAccount, containerName, directory,
+		map[string]interface{}{"action": "getAccessControl", "upn": "false"},
+		nil, nil, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("Error getting ACL of directory '%s' in container %s : %v", directory, containerName, err)
+	}
+
+	entries := strings.Split(resp.Header.Get("x-ms-acl"), ",")
+	prefix := fmt.Sprintf("user:%s:", principalId)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, prefix) {
+			return nil
+		}
+	}
+	entries = append(entries, prefix+"--x")
+
+	_, err = c.send(ctx, http.MethodPatch, storageAccount, containerName, directory,
+		map[string]interface{}{"action": "setAccessControl"},
+		map[string]interface{}{"x-ms-acl": strings.Join(entries, ",")},
+		nil, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("Error setting ACL of directory '%s' in container %s : %v", directory, containerName, err)
+	}
+
+	return nil
+}
+
+// setAccessControlRecursive modifies or removes ACL entries of the directory and all of its children,
+// following the continuation until the whole tree is updated
+func (c *DataLakeClient) setAccessControlRecursive(ctx context.Context, storageAccount, containerName, directory, mode, acl string) error {
+	continuation := ""
+	for {
+		query := map[string]interface{}{"action": "setAccessControlRecursive", "mode": mode}
+		if continuation != "" {
+			query["continuation"] = continuation
+		}
+
+		result := setAccessControlRecursiveResult{}
+		resp, err := c.send(ctx, http.MethodPatch, storageAccount, containerName, directory, query,
+			map[string]interface{}{"x-ms-acl": acl}, &result, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("Error updating ACL of directory %s in container %s : %v", directory, containerName, err)
+		}
+		if result.FailureCount > 0 {
+			failed := []string{}
+			for _, entry := range result.FailedEntries {
+				failed = append(failed, fmt.Sprintf("%s (%s)", entry.Name, entry.ErrorMessage))
+			}
+			return fmt.Errorf("Error updating ACL of %d paths below directory %s in container %s : %s", result.FailureCount, directory, containerName, strings.Join(failed, ", "))
+		}
+
+		continuation = resp.Header.Get("x-ms-continuation")
+		if continuation == "" {
+			return nil
+		}
+	}
+}
+
+// send sends a request for a path of the container to the dfs endpoint and returns the response,
+// so that callers can tell missing and existing paths apart
+func (c *DataLakeClient) send(
+	ctx context.Context,
+	method string,
+	storageAccount string,
+	containerName string,
+	directory string,
+	query map[string]interface{},
+	headers map[string]interface{},
+	result interface{},
+	okStatusCodes ...int) (*http.Response, error) {
+	path := "/" + url.PathEscape(containerName) + "/"
+	if directory != "" {
+		segments := strings.Split(directory, "/")
+		for i := range segments {
+			segments[i] = url.PathEscape(segments[i])
+		}
+		path += strings.Join(segments, "/")
+	}
+
+	decorators := []autorest.PrepareDecorator{
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(fmt.Sprintf("https://%s.dfs.core.windows.net", storageAccount)),
+		autorest.WithPath(path),
+		autorest.WithQueryParameters(query),
+		autorest.WithHeader("x-ms-version", dataLakeAPIVersion),
+	}
+	if headers != nil {
+		decorators = append(decorators, autorest.WithHeaders(headers))
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := autorest.SendWithSender(c.client, req, autorest.DoRetryForStatusCodes(c.client.RetryAttempts, c.client.RetryDuration, autorest.StatusCodesForRetry...))
+	if err != nil {
+		return resp, err
+	}
+
+	responders := []autorest.RespondDecorator{autorest.WithErrorUnlessStatusCode(okStatusCodes...)}
+	if result != nil {
+		responders = append(responders, autorest.ByUnmarshallingJSON(result))
+	}
+	responders = append(responders, autorest.ByClosing())
+
+	return resp, autorest.Respond(resp, responders...)
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// dfsResponse is the answer of the fake dfs endpoint to a request
+type dfsResponse struct {
+	code    int
+	headers map[string]string
+	body    string
+}
+
+// newTestDataLakeClient returns a client whose requests are answered by the handler instead of the dfs endpoint of
+// the storage account. Requests are identified by their method, path and action, e.g. "PATCH /bucket/dir setAccessControl",
+// and every request is recorded along with its ACL header.
+func newTestDataLakeClient(t *testing.T, handler func(call string) dfsResponse) (*DataLakeClient, *[]string) {
+	calls := []string{}
+	client := autorest.NewClientWithUserAgent("test")
+	client.RetryAttempts = 1
+	client.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host != "account.dfs.core.windows.net" {
+			t.Errorf("unexpected host %s", r.URL.Host)
+		}
+		call := strings.TrimSpace(r.Method + " " + strings.TrimSuffix(r.URL.Path, "/") + " " + r.URL.Query().Get("action") + r.URL.Query().Get("resource"))
+		calls = append(calls, strings.TrimSpace(call+" "+r.Header.Get("x-ms-acl")))
+
+		response := handler(call)
+		resp := &http.Response{
+			StatusCode: response.code,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(response.body)),
+			Request:    r,
+		}
+		for key, value := range response.headers {
+			resp.Header.Set(key, value)
+		}
+		return resp, nil
+	})
+	return &DataLakeClient{client: client}, &calls
+}
+
+func TestGrantDirectoryACL(t *testing.T) {
+	user := "user:" + testPrincipalId
+	client, calls := newTestDataLakeClient(t, func(call string) dfsResponse {
+		switch call {
+		case "PUT /bucket/logs/2021 directory":
+			// created by an earlier grant
+			return dfsResponse{code: http.StatusConflict}
+		case "HEAD /bucket getAccessControl":
+			return dfsResponse{code: http.StatusOK, headers: map[string]string{"x-ms-acl": "user::rwx,group::r-x,other::---"}}
+		case "HEAD /bucket/logs getAccessControl":
+			// the principal already traverses it for another grant
+			return dfsResponse{code: http.StatusOK, headers: map[string]string{"x-ms-acl": "user::rwx," + user + ":r-x"}}
+		case "PATCH /bucket setAccessControl":
+			return dfsResponse{code: http.StatusOK}
+		case "PATCH /bucket/logs/2021 setAccessControlRecursive":
+			return dfsResponse{code: http.StatusOK, body: `{"directoriesSuccessful":1,"filesSuccessful":2,"failureCount":0}`}
+		}
+		t.Errorf("unexpected call %s", call)
+		return dfsResponse{code: http.StatusBadRequest}
+	})
+
+	if err := client.grantDirectoryACL(context.TODO(), "account", "bucket", "logs/2021", testPrincipalId, "r-x"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{
+		"PUT /bucket/logs/2021 directory",
+		"HEAD /bucket getAccessControl",
+		"PATCH /bucket setAccessControl user::rwx,group::r-x,other::---," + user + ":--x",
+		"HEAD /bucket/logs getAccessControl",
+		"PATCH /bucket/logs/2021 setAccessControlRecursive " + user + ":r-x,default:" + user + ":r-x",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestRevokeDirectoryACL(t *testing.T) {
+	user := "user:" + testPrincipalId
+
+	t.Run("directory with many children", func(t *testing.T) {
+		batches := 0
+		client, calls := newTestDataLakeClient(t, func(call string) dfsResponse {
+			switch call {
+			case "HEAD /bucket/logs getAccessControl":
+				return dfsResponse{code: http.StatusOK}
+			case "PATCH /bucket/logs setAccessControlRecursive":
+				// the service updates large trees in batches, handing back a continuation until the last one
+				batches++
+				if batches == 1 {
+					return dfsResponse{code: http.StatusOK, headers: map[string]string{"x-ms-continuation": "next"}, body: `{"failureCount":0}`}
+				}
+				return dfsResponse{code: http.StatusOK, body: `{"failureCount":0}`}
+			}
+			t.Errorf("unexpected call %s", call)
+			return dfsResponse{code: http.StatusBadRequest}
+		})
+
+		if err := client.revokeDirectoryACL(context.TODO(), "account", "bucket", "logs", testPrincipalId); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		removal := "PATCH /bucket/logs setAccessControlRecursive " + user + ",default:" + user
+		expected := []string{"HEAD /bucket/logs getAccessControl", removal, removal}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Errorf("expected calls %v, got %v", expected, *calls)
+		}
+	})
+
+	t.Run("directory gone", func(t *testing.T) {
+		client, calls := newTestDataLakeClient(t, func(call string) dfsResponse {
+			return dfsResponse{code: http.StatusNotFound}
+		})
+
+		if err := client.revokeDirectoryACL(context.TODO(), "account", "bucket", "logs", testPrincipalId); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(*calls) != 1 {
+			t.Errorf("expected only the ACL lookup, got %v", *calls)
+		}
+	})
+
+	t.Run("paths failing to update", func(t *testing.T) {
+		client, _ := newTestDataLakeClient(t, func(call string) dfsResponse {
+			if call == "HEAD /bucket/logs getAccessControl" {
+				return dfsResponse{code: http.StatusOK}
+			}
+			return dfsResponse{code: http.StatusOK, body: `{"failureCount":1,"failedEntries":[{"name":"logs/app.log","errorMessage":"This request is not authorized"}]}`}
+		})
+
+		err := client.revokeDirectoryACL(context.TODO(), "account", "bucket", "logs", testPrincipalId)
+		if err == nil || !strings.Contains(err.Error(), "logs/app.log") {
+			t.Errorf("expected an error naming the failed path, got %v", err)
+		}
+	})
+}
@@ -20,10 +20,13 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/Azure/go-autorest/autorest"
+	"k8s.io/client-go/dynamic"
 	clientSet "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
@@ -70,6 +73,16 @@ func GetKubeClient(kubeconfig string) (*clientSet.Clientset, error) {
 	return clientSet.NewForConfig(config)
 }
 
+// GetDynamicClient returns a client for resources without a typed client, such as the COSI objects
+func GetDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := getKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
 // GetAzureCloudProvider get Azure Cloud Provider
 func GetAzureCloudProvider(
 	kubeClient clientSet.Interface,
@@ -124,3 +137,14 @@ func GetAzureCloudProvider(
 	}
 	return az, nil
 }
+
+// getARMAuthorizer returns an authorizer for Azure Resource Manager using the credentials of the cloud config,
+// for the ARM clients the cloud provider does not expose
+func getARMAuthorizer(cloud *azure.Cloud) (autorest.Authorizer, error) {
+	token, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, "")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting ARM token : %v", err)
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
@@ -0,0 +1,734 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"project/azure-cosi-driver/pkg/accesspolicy"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// AccessClients holds the clients used to grant and revoke access to buckets
+type AccessClients struct {
+	Cloud             *azure.Cloud
+	KeyCache          *UserDelegationKeyCache
+	Authorization     *AuthorizationClient
+	StorageManagement *StorageManagementClient
+	AccountKeys       *AccountKeyRegistry
+	DataLake          *DataLakeClient
+	Reissuer          GrantReissuer
+	// MaxGrantLifetime caps the lifetime of time limited credentials, zero for no limit
+	MaxGrantLifetime time.Duration
+}
+
+// BucketAccessGrant is the result of granting access to a bucket
+type BucketAccessGrant struct {
+	AccountId      string
+	Credentials    string
+	CredentialType string
+	// AccountKeyName is the storage account key handed out by account key grants
+	AccountKeyName string
+	// ExpiresOn is when the credentials stop working, zero for grants that are valid until revoked
+	ExpiresOn time.Time
+}
+
+// GrantBucketAccess grants access to the bucket and returns the account id
+// of the grant along with the serialized credentials
+func GrantBucketAccess(
+	ctx context.Context,
+	bucketId string,
+	accountName string,
+	accessPolicy string,
+	parameters map[string]string,
+	clients *AccessClients) (*BucketAccessGrant, error) {
+	if !storageAccountRE.MatchString(bucketId) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid bucket id %s", bucketId))
+	}
+
+	options, err := parseParametersForBucketAccess(parameters, accountName)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error parsing parameters : %v", err))
+	}
+
+	policy, err := accesspolicy.Parse(accessPolicy)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	storageAccountName := getStorageAccountNameFromContainerUrl(bucketId)
+	containerName := getContainerNameFromContainerUrl(bucketId)
+	accountId := getAccountId(bucketId, accountName)
+
+	validity, err := getGrantValidity(policy, options, clients.MaxGrantLifetime)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	credentials := newBucketAccessCredentials(storageAccountName, containerName, bucketId)
+	now := time.Now().UTC()
+	startsOn := now.Add(options.startTimeOffset)
+	expiresOn := now.Add(validity)
+	if !startsOn.Before(expiresOn) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s %v must start the credentials before they expire after %v", StartTimeOffsetField, options.startTimeOffset, validity))
+	}
+
+	// Looked up before anything is granted, so that a failure leaves nothing behind
+	credentials.PrivateEndpointIP, credentials.PrivateEndpointFQDN, err = clients.StorageManagement.getPrivateEndpointAddress(ctx, storageAccountName)
+	if err != nil {
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+
+	keyName := ""
+	switch options.credentialType {
+	case CredentialTypeUserDelegation:
+		credentials.SASToken, err = grantUserDelegationSAS(ctx, storageAccountName, containerName, policy, options, startsOn, expiresOn, clients.Cloud, clients.KeyCache)
+	case CredentialTypeRoleAssignment:
+		err = grantRoleAssignment(ctx, storageAccountName, containerName, accountId, accountName, policy, credentials, clients)
+		expiresOn = time.Time{}
+	case CredentialTypeAccountKey:
+		credentials.AccountKey, keyName, err = grantAccountKey(ctx, bucketId, storageAccountName, accountId, policy, clients)
+		expiresOn = time.Time{}
+	case CredentialTypeACL:
+		err = grantACL(ctx, storageAccountName, containerName, accountName, policy, credentials, clients)
+		expiresOn = time.Time{}
+	case CredentialTypeSFTP:
+		err = grantLocalUser(ctx, storageAccountName, containerName, accountId, policy, options, credentials, clients)
+		expiresOn = time.Time{}
+	default:
+		credentials.SASToken, err = grantStoredAccessPolicySAS(ctx, storageAccountName, containerName, accountId, policy, options, startsOn, expiresOn, clients.Cloud)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	formatted, err := formatCredentials(credentials, options.credentialFormat)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Error formatting credentials : %v", err))
+	}
+
+	return &BucketAccessGrant{
+		AccountId:      accountId,
+		Credentials:    formatted,
+		CredentialType: options.credentialType,
+		AccountKeyName: keyName,
+		ExpiresOn:      expiresOn,
+	}, nil
+}
+
+// grantStoredAccessPolicySAS signs a service SAS with the account key. The SAS is bound to a stored
+// access policy keyed by the account id, so that revoking the grant removes the policy and
+// invalidates the SAS before it expires. The start and expiry live in the policy, while the network
+// restrictions are part of the SAS itself.
+func grantStoredAccessPolicySAS(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	accountId string,
+	policy *accesspolicy.Policy,
+	options *bucketAccessOptions,
+	startTime time.Time,
+	expiryTime time.Time,
+	cloud *azure.Cloud) (string, error) {
+	permissions, err := policy.StoredAccessPolicyPermissions()
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	accessKey, err := cloud.GetStorageAccesskey(storageAccountName, cloud.ResourceGroup)
+	if err != nil {
+		return "", status.Error(codes.Unknown, fmt.Sprintf("Error getting access key for storage account %s : %v", storageAccountName, err))
+	}
+
+	containerURL, err := createContainerUrl(storageAccountName, accessKey, containerName)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	err = setContainerStoredAccessPolicy(ctx, containerURL, accountId, permissions, startTime, expiryTime)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return "", err
+		}
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	sasToken, err := createContainerSASToken(storageAccountName, accessKey, azblob.BlobSASSignatureValues{
+		Protocol:      options.protocol,
+		IPRange:       options.ipRange,
+		ContainerName: containerName,
+		Identifier:    accountId,
+	})
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("Error creating SAS token for container %s : %v", containerName, err))
+	}
+
+	return sasToken, nil
+}
+
+// grantUserDelegationSAS signs the SAS with a user delegation key obtained with the driver's AAD identity,
+// for storage accounts where shared key access is disabled. User delegation SAS can not reference a stored
+// access policy, so it stays valid until it expires.
+func grantUserDelegationSAS(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	policy *accesspolicy.Policy,
+	options *bucketAccessOptions,
+	startTime time.Time,
+	expiryTime time.Time,
+	cloud *azure.Cloud,
+	keyCache *UserDelegationKeyCache) (string, error) {
+	permissions, err := policy.SASPermissions()
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	validity := time.Until(expiryTime).Round(time.Minute)
+	if validity > UserDelegationKeyValidity-UserDelegationKeyRefreshMargin {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Access policy expiry %v exceeds the %v a user delegation SAS can be valid for", validity, UserDelegationKeyValidity-UserDelegationKeyRefreshMargin))
+	}
+
+	credential, err := keyCache.GetCredential(ctx, storageAccountName, expiryTime, cloud)
+	if err != nil {
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	sasQueryParams, err := azblob.BlobSASSignatureValues{
+		Protocol:      options.protocol,
+		IPRange:       options.ipRange,
+		StartTime:     startTime,
+		ExpiryTime:    expiryTime,
+		ContainerName: containerName,
+		Permissions:   permissions,
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("Error creating user delegation SAS token for container %s : %v", containerName, err))
+	}
+
+	return sasQueryParams.Encode(), nil
+}
+
+// grantRoleAssignment assigns a Storage Blob Data role on the container to the AAD principal named by the
+// account name. The credentials only describe the identity, the workload authenticates as itself.
+func grantRoleAssignment(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	accountId string,
+	principal string,
+	policy *accesspolicy.Policy,
+	credentials *BucketAccessCredentials,
+	clients *AccessClients) error {
+	if clients.Authorization == nil {
+		return status.Error(codes.FailedPrecondition, "Authorization client is not configured, role assignment grants are unavailable")
+	}
+
+	role, roleDefinitionID, err := policy.RoleDefinition()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	principalId, clientId, err := clients.Authorization.resolvePrincipal(ctx, principal)
+	if err != nil {
+		return principalError(err)
+	}
+	scope := getContainerResourceId(clients.Cloud.SubscriptionID, clients.Cloud.ResourceGroup, storageAccountName, containerName)
+	err = clients.Authorization.createContainerRoleAssignment(ctx, scope, accountId, principalId, roleDefinitionID)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	credentials.PrincipalID = principalId
+	credentials.ClientID = clientId
+	credentials.TenantID = clients.Cloud.TenantID
+	credentials.Role = role
+	return nil
+}
+
+// grantAccountKey hands out one of the storage account keys and records which one, so that revoking the
+// grant can regenerate that key. It returns the key and its name.
+func grantAccountKey(
+	ctx context.Context,
+	bucketId string,
+	storageAccountName string,
+	accountId string,
+	policy *accesspolicy.Policy,
+	clients *AccessClients) (string, string, error) {
+	if err := policy.Unrestricted(); err != nil {
+		return "", "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	keyName := clients.AccountKeys.assign(storageAccountName, bucketId, accountId)
+	accountKey, err := clients.StorageManagement.getAccountKey(ctx, storageAccountName, keyName)
+	if err != nil {
+		return "", "", status.Error(codes.Unknown, err.Error())
+	}
+
+	return accountKey, keyName, nil
+}
+
+// grantACL gives the AAD principal named by the account name access to the directory of the access policy prefix
+// through ACL entries, which unlike role assignments can be narrowed below the container. The credentials only
+// describe the identity and the directory, the workload authenticates as itself.
+func grantACL(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	principal string,
+	policy *accesspolicy.Policy,
+	credentials *BucketAccessCredentials,
+	clients *AccessClients) error {
+	if clients.Authorization == nil || clients.DataLake == nil {
+		return status.Error(codes.FailedPrecondition, "Authorization or data lake client is not configured, ACL grants are unavailable")
+	}
+
+	if policy.Prefix == "" {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s grants require an access policy prefix, use %s to grant the whole bucket", CredentialTypeACL, CredentialTypeRoleAssignment))
+	}
+
+	permissions, err := policy.ACLPermissions()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	hnsEnabled, err := clients.StorageManagement.isHNSEnabled(ctx, storageAccountName)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	if !hnsEnabled {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s does not have a hierarchical namespace, which ACL grants require", storageAccountName))
+	}
+
+	principalId, clientId, err := clients.Authorization.resolvePrincipal(ctx, principal)
+	if err != nil {
+		return principalError(err)
+	}
+	err = clients.DataLake.grantDirectoryACL(ctx, storageAccountName, containerName, policy.Prefix, principalId, permissions)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	credentials.PrincipalID = principalId
+	credentials.ClientID = clientId
+	credentials.TenantID = clients.Cloud.TenantID
+	credentials.Directory = policy.Prefix
+	return nil
+}
+
+// principalError maps a failed principal lookup to a status error, NotFound when the principal does not exist
+func principalError(err error) error {
+	if errors.Is(err, errPrincipalNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// revokeACL strips the ACL entries of the grant's principal below the directory it was granted
+func revokeACL(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	issued *IssuedGrant,
+	clients *AccessClients) error {
+	if clients.Authorization == nil || clients.DataLake == nil {
+		return status.Error(codes.FailedPrecondition, "Authorization or data lake client is not configured, ACL grants can not be revoked")
+	}
+
+	policy, err := accesspolicy.Parse(issued.AccessPolicy)
+	if err != nil || policy.Prefix == "" {
+		return status.Error(codes.Internal, fmt.Sprintf("Recorded access policy of the %s grant has no valid prefix : %v", CredentialTypeACL, err))
+	}
+
+	principalId, _, err := clients.Authorization.resolvePrincipal(ctx, issued.AccountName)
+	if err != nil {
+		if errors.Is(err, errPrincipalNotFound) {
+			// ACL entries of a deleted principal no longer grant anyone access
+			klog.Warningf("Not revoking ACL entries of the %s grant : %v", CredentialTypeACL, err)
+			return nil
+		}
+		return status.Error(codes.Unknown, err.Error())
+	}
+	err = clients.DataLake.revokeDirectoryACL(ctx, storageAccountName, containerName, policy.Prefix, principalId)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	return nil
+}
+
+// grantLocalUser enables SFTP on the storage account and creates a local user jailed to the container
+func grantLocalUser(
+	ctx context.Context,
+	storageAccountName string,
+	containerName string,
+	accountId string,
+	policy *accesspolicy.Policy,
+	options *bucketAccessOptions,
+	credentials *BucketAccessCredentials,
+	clients *AccessClients) error {
+	permissions, err := policy.LocalUserPermissions()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	hnsEnabled, err := clients.StorageManagement.isHNSEnabled(ctx, storageAccountName)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	if !hnsEnabled {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s does not have a hierarchical namespace, which SFTP requires", storageAccountName))
+	}
+
+	if err := clients.StorageManagement.enableSftp(ctx, storageAccountName); err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	username := getLocalUserName(accountId)
+	password, err := clients.StorageManagement.createLocalUser(ctx, storageAccountName, username, containerName, permissions, options.sftpAuthorizedKey)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	credentials.SFTPHost = fmt.Sprintf("%s.blob.core.windows.net", storageAccountName)
+	credentials.SFTPUsername = fmt.Sprintf("%s.%s", storageAccountName, username)
+	credentials.SSHPassword = password
+	return nil
+}
+
+// revokeLocalUser deletes the local user of an SFTP grant
+func revokeLocalUser(
+	ctx context.Context,
+	storageAccountName string,
+	accountId string,
+	clients *AccessClients) error {
+	if !accountIdRE.MatchString(accountId) {
+		return nil
+	}
+
+	if err := clients.StorageManagement.deleteLocalUser(ctx, storageAccountName, getLocalUserName(accountId)); err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	return nil
+}
+
+// revokeAccountKey rolls the account key of the grant. The other grantees holding the same key are moved
+// onto the surviving key first, then the compromised key is regenerated.
+func revokeAccountKey(
+	ctx context.Context,
+	bucketId string,
+	storageAccountName string,
+	accountId string,
+	clients *AccessClients) error {
+	compromised, moved := clients.AccountKeys.release(storageAccountName, accountId)
+	if compromised == "" {
+		return nil
+	}
+
+	for _, grant := range moved {
+		if clients.Reissuer == nil {
+			break
+		}
+		if err := clients.Reissuer.Reissue(ctx, grant.bucketId, grant.accountId); err != nil {
+			klog.Warningf("Error moving account id %s to the surviving key of storage account %s : %v", grant.accountId, storageAccountName, err)
+		}
+	}
+
+	if err := clients.StorageManagement.regenerateAccountKey(ctx, storageAccountName, compromised); err != nil {
+		clients.AccountKeys.Restore(bucketId, accountId, compromised)
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	// Service SAS of the driver are signed with key1, so they have to be signed again once it changed
+	if compromised == AccountKey1 && clients.Reissuer != nil {
+		err := clients.Reissuer.ReissueAll(ctx, func(otherBucketId, otherAccountId string) bool {
+			return otherAccountId != accountId && getStorageAccountNameFromContainerUrl(otherBucketId) == storageAccountName
+		})
+		if err != nil {
+			klog.Warningf("Error re-signing the SAS grants of storage account %s : %v", storageAccountName, err)
+		}
+	}
+
+	return nil
+}
+
+// getGrantValidity returns the lifetime of time limited credentials. The access policy may override the default,
+// the maxLifetime parameter caps both, and requesting more than the driver wide maximum is rejected.
+func getGrantValidity(policy *accesspolicy.Policy, options *bucketAccessOptions, maxGrantLifetime time.Duration) (time.Duration, error) {
+	validity := policy.Expiry
+	if options.maxLifetime != 0 && (validity == 0 || validity > options.maxLifetime) {
+		validity = options.maxLifetime
+	}
+
+	if validity == 0 {
+		validity = DefaultGrantValidity
+		if maxGrantLifetime != 0 && validity > maxGrantLifetime {
+			validity = maxGrantLifetime
+		}
+	}
+
+	if maxGrantLifetime != 0 && validity > maxGrantLifetime {
+		return 0, fmt.Errorf("Requested credential lifetime %v exceeds the maximum of %v allowed by the driver", validity, maxGrantLifetime)
+	}
+
+	return validity, nil
+}
+
+// RevokeBucketAccess rolls the account key, removes the stored access policy, the role assignment and the local user
+// backing the grant, which invalidates its key, SAS, role or SFTP login. Revoking a grant that no longer exists, or one
+// that only holds a user delegation SAS, is not an error. The credential type recorded for the grant, if any, limits
+// which of these are looked up, ACL grants can only be revoked with their record.
+func RevokeBucketAccess(
+	ctx context.Context,
+	bucketId string,
+	accountId string,
+	issued *IssuedGrant,
+	clients *AccessClients) error {
+	if !storageAccountRE.MatchString(bucketId) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid bucket id %s", bucketId))
+	}
+
+	cloud := clients.Cloud
+	storageAccountName := getStorageAccountNameFromContainerUrl(bucketId)
+	containerName := getContainerNameFromContainerUrl(bucketId)
+
+	if err := revokeAccountKey(ctx, bucketId, storageAccountName, accountId, clients); err != nil {
+		return err
+	}
+
+	credentialType := ""
+	if issued != nil {
+		credentialType = issued.CredentialType
+	}
+
+	switch credentialType {
+	case CredentialTypeACL:
+		return revokeACL(ctx, storageAccountName, containerName, issued, clients)
+	case CredentialTypeRoleAssignment:
+		if clients.Authorization == nil {
+			return status.Error(codes.FailedPrecondition, "Authorization client is not configured, role assignment grants can not be revoked")
+		}
+	case CredentialTypeSFTP:
+		return revokeLocalUser(ctx, storageAccountName, accountId, clients)
+	case "":
+		// Grants without a record may be SFTP grants, but most accounts do not support local users at all
+		if err := revokeLocalUser(ctx, storageAccountName, accountId, clients); err != nil {
+			klog.Warningf("Unable to remove a local user of account id %s : %v", accountId, err)
+		}
+	}
+
+	if clients.Authorization != nil {
+		scope := getContainerResourceId(cloud.SubscriptionID, cloud.ResourceGroup, storageAccountName, containerName)
+		if err := clients.Authorization.deleteContainerRoleAssignment(ctx, scope, accountId); err != nil {
+			return status.Error(codes.Unknown, err.Error())
+		}
+	}
+
+	accessKey, err := cloud.GetStorageAccesskey(storageAccountName, cloud.ResourceGroup)
+	if err != nil {
+		return status.Error(codes.Unknown, fmt.Sprintf("Error getting access key for storage account %s : %v", storageAccountName, err))
+	}
+
+	containerURL, err := createContainerUrl(storageAccountName, accessKey, containerName)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	err = removeContainerStoredAccessPolicy(ctx, containerURL, accountId)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	return nil
+}
+
+// IssuedGrant is what was recorded about a grant when it was issued
+type IssuedGrant struct {
+	CredentialType string
+	AccountName    string
+	AccessPolicy   string
+}
+
+type bucketAccessOptions struct {
+	credentialType   string
+	credentialFormat string
+	ipRange          azblob.IPRange
+	protocol         azblob.SASProtocol
+	startTimeOffset  time.Duration
+	maxLifetime      time.Duration
+	// sftpAuthorizedKey is the SSH public key of SFTP grants, which get a password when it is empty
+	sftpAuthorizedKey string
+}
+
+func parseParametersForBucketAccess(parameters map[string]string, accountName string) (*bucketAccessOptions, error) {
+	options := &bucketAccessOptions{
+		credentialType:   CredentialTypeStoredAccessPolicy,
+		credentialFormat: CredentialFormatJSON,
+		protocol:         azblob.SASProtocolHTTPS,
+	}
+	sasOnlyFields := []string{}
+
+	// Grants for AAD principals default to role assignments
+	if isAADPrincipal(accountName) {
+		options.credentialType = CredentialTypeRoleAssignment
+	}
+
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case CredentialTypeField:
+			switch strings.ToLower(val) {
+			case CredentialTypeStoredAccessPolicy, CredentialTypeUserDelegation, CredentialTypeRoleAssignment, CredentialTypeAccountKey, CredentialTypeSFTP, CredentialTypeACL:
+				options.credentialType = strings.ToLower(val)
+			default:
+				return nil, fmt.Errorf("Invalid %s '%s', supported values are %s, %s, %s, %s, %s and %s", CredentialTypeField, val,
+					CredentialTypeStoredAccessPolicy, CredentialTypeUserDelegation, CredentialTypeRoleAssignment, CredentialTypeAccountKey, CredentialTypeSFTP, CredentialTypeACL)
+			}
+		case CredentialFormatField:
+			switch strings.ToLower(val) {
+			case CredentialFormatJSON, CredentialFormatSASToken, CredentialFormatSASURL, CredentialFormatConnectionString:
+				options.credentialFormat = strings.ToLower(val)
+			case CredentialFormatJSONV1:
+				// json stays the v1 document, later versions get format names of their own
+				options.credentialFormat = CredentialFormatJSON
+			default:
+				return nil, fmt.Errorf("Invalid %s '%s', supported values are %s, %s, %s, %s and %s", CredentialFormatField, val,
+					CredentialFormatJSON, CredentialFormatJSONV1, CredentialFormatSASToken, CredentialFormatSASURL, CredentialFormatConnectionString)
+			}
+		case AllowedIPRangeField:
+			ipRange, err := parseIPRange(val)
+			if err != nil {
+				return nil, err
+			}
+			options.ipRange = ipRange
+			sasOnlyFields = append(sasOnlyFields, AllowedIPRangeField)
+		case ProtocolField:
+			switch strings.ToLower(strings.ReplaceAll(val, " ", "")) {
+			case SASProtocolHTTPS:
+				options.protocol = azblob.SASProtocolHTTPS
+			case SASProtocolHTTPSandHTTP, "http,https":
+				options.protocol = azblob.SASProtocolHTTPSandHTTP
+			default:
+				return nil, fmt.Errorf("Invalid %s '%s', supported values are %s and %s", ProtocolField, val, SASProtocolHTTPS, SASProtocolHTTPSandHTTP)
+			}
+			sasOnlyFields = append(sasOnlyFields, ProtocolField)
+		case StartTimeOffsetField:
+			offset, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s '%s' : %v", StartTimeOffsetField, val, err)
+			}
+			options.startTimeOffset = offset
+			sasOnlyFields = append(sasOnlyFields, StartTimeOffsetField)
+		case MaxLifetimeField:
+			maxLifetime, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s '%s' : %v", MaxLifetimeField, val, err)
+			}
+			if maxLifetime <= 0 {
+				return nil, fmt.Errorf("Invalid %s '%s', the lifetime must be positive", MaxLifetimeField, val)
+			}
+			options.maxLifetime = maxLifetime
+			sasOnlyFields = append(sasOnlyFields, MaxLifetimeField)
+		case SFTPAuthorizedKeyField:
+			options.sftpAuthorizedKey = strings.TrimSpace(val)
+		}
+	}
+
+	if options.sftpAuthorizedKey != "" && options.credentialType != CredentialTypeSFTP {
+		return nil, fmt.Errorf("%s is only supported by %s grants", SFTPAuthorizedKeyField, CredentialTypeSFTP)
+	}
+
+	issuesSAS := options.credentialType == CredentialTypeStoredAccessPolicy || options.credentialType == CredentialTypeUserDelegation
+	if !issuesSAS && len(sasOnlyFields) > 0 {
+		return nil, fmt.Errorf("%s grants do not issue a SAS and do not support %s", options.credentialType, strings.Join(sasOnlyFields, ", "))
+	}
+
+	isIdentityGrant := options.credentialType == CredentialTypeRoleAssignment || options.credentialType == CredentialTypeACL
+	if isIdentityGrant && !isAADPrincipal(accountName) {
+		return nil, fmt.Errorf("Account name '%s' must be the object id or client id of an AAD principal for %s grants", accountName, options.credentialType)
+	}
+
+	if (isIdentityGrant || options.credentialType == CredentialTypeSFTP) && options.credentialFormat != CredentialFormatJSON {
+		return nil, fmt.Errorf("%s grants do not issue a SAS and can only be returned in the %s %s", options.credentialType, CredentialFormatJSON, CredentialFormatField)
+	}
+
+	if options.credentialType == CredentialTypeAccountKey &&
+		options.credentialFormat != CredentialFormatJSON && options.credentialFormat != CredentialFormatConnectionString {
+		return nil, fmt.Errorf("%s grants do not issue a SAS and can only be returned in the %s or %s %s", CredentialTypeAccountKey, CredentialFormatJSON, CredentialFormatConnectionString, CredentialFormatField)
+	}
+
+	return options, nil
+}
+
+// getAccountId derives a stable account id from the bucket id and the requested account name,
+// so that repeated grant requests for the same account return the same id
+func getAccountId(bucketId, accountName string) string {
+	hash := sha256.Sum256([]byte(bucketId + "/" + accountName))
+	return hex.EncodeToString(hash[:16])
+}
+
+// parseIPRange parses a single IPv4 address or an inclusive range such as 10.0.0.0-10.0.255.255,
+// a SAS can only be restricted to one range
+func parseIPRange(val string) (azblob.IPRange, error) {
+	bounds := strings.Split(strings.TrimSpace(val), "-")
+	if len(bounds) > 2 {
+		return azblob.IPRange{}, fmt.Errorf("Invalid %s '%s', the format should be like '10.0.0.1' or '10.0.0.0-10.0.255.255'", AllowedIPRangeField, val)
+	}
+
+	ips := []net.IP{}
+	for _, bound := range bounds {
+		ip := net.ParseIP(strings.TrimSpace(bound))
+		if ip == nil || ip.To4() == nil {
+			return azblob.IPRange{}, fmt.Errorf("Invalid %s '%s', '%s' is not an IPv4 address", AllowedIPRangeField, val, bound)
+		}
+		ips = append(ips, ip.To4())
+	}
+
+	ipRange := azblob.IPRange{Start: ips[0]}
+	if len(ips) == 2 {
+		if bytes.Compare(ips[0], ips[1]) > 0 {
+			return azblob.IPRange{}, fmt.Errorf("Invalid %s '%s', the range must start with the lower address", AllowedIPRangeField, val)
+		}
+		ipRange.End = ips[1]
+	}
+
+	return ipRange, nil
+}
+
+func createContainerSASToken(
+	storageAccount string,
+	accessKey string,
+	sasValues azblob.BlobSASSignatureValues) (string, error) {
+	credential, err := azblob.NewSharedKeyCredential(storageAccount, accessKey)
+	if err != nil {
+		return "", fmt.Errorf("Invalid credentials with error : %v", err)
+	}
+
+	sasQueryParams, err := sasValues.NewSASQueryParameters(credential)
+	if err != nil {
+		return "", err
+	}
+
+	return sasQueryParams.Encode(), nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"encoding/base64"
+	"net"
+	"net/url"
+	"project/azure-cosi-driver/pkg/accesspolicy"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestGetGrantValidity(t *testing.T) {
+	tests := []struct {
+		desc             string
+		expiry           time.Duration
+		maxLifetime      time.Duration
+		maxGrantLifetime time.Duration
+		expected         time.Duration
+		expectErr        bool
+	}{
+		{
+			desc:     "driver default",
+			expected: DefaultGrantValidity,
+		},
+		{
+			desc:     "access policy expiry",
+			expiry:   72 * time.Hour,
+			expected: 72 * time.Hour,
+		},
+		{
+			desc:        "maxLifetime caps the access policy expiry",
+			expiry:      72 * time.Hour,
+			maxLifetime: 8 * time.Hour,
+			expected:    8 * time.Hour,
+		},
+		{
+			desc:        "maxLifetime replaces the driver default",
+			maxLifetime: 48 * time.Hour,
+			expected:    48 * time.Hour,
+		},
+		{
+			desc:        "shorter access policy expiry is kept",
+			expiry:      time.Hour,
+			maxLifetime: 8 * time.Hour,
+			expected:    time.Hour,
+		},
+		{
+			desc:             "driver maximum caps the driver default",
+			maxGrantLifetime: 2 * time.Hour,
+			expected:         2 * time.Hour,
+		},
+		{
+			desc:             "access policy expiry above the driver maximum",
+			expiry:           72 * time.Hour,
+			maxGrantLifetime: 48 * time.Hour,
+			expectErr:        true,
+		},
+		{
+			desc:             "maxLifetime above the driver maximum",
+			maxLifetime:      72 * time.Hour,
+			maxGrantLifetime: 48 * time.Hour,
+			expectErr:        true,
+		},
+	}
+
+	for _, test := range tests {
+		policy := &accesspolicy.Policy{Expiry: test.expiry}
+		options := &bucketAccessOptions{maxLifetime: test.maxLifetime}
+		validity, err := getGrantValidity(policy, options, test.maxGrantLifetime)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got validity %v", test.desc, validity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if validity != test.expected {
+			t.Errorf("%s: expected validity %v, got %v", test.desc, test.expected, validity)
+		}
+	}
+}
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		desc      string
+		val       string
+		start     string
+		end       string
+		expectErr bool
+	}{
+		{
+			desc:  "single address",
+			val:   "10.0.0.1",
+			start: "10.0.0.1",
+		},
+		{
+			desc:  "range",
+			val:   "10.0.0.0-10.0.255.255",
+			start: "10.0.0.0",
+			end:   "10.0.255.255",
+		},
+		{
+			desc:  "range with spaces",
+			val:   " 10.0.0.0 - 10.0.0.255 ",
+			start: "10.0.0.0",
+			end:   "10.0.0.255",
+		},
+		{
+			desc:      "reversed range",
+			val:       "10.0.255.255-10.0.0.0",
+			expectErr: true,
+		},
+		{
+			desc:      "IPv6 address",
+			val:       "2001:db8::1",
+			expectErr: true,
+		},
+		{
+			desc:      "CIDR",
+			val:       "10.0.0.0/16",
+			expectErr: true,
+		},
+		{
+			desc:      "three bounds",
+			val:       "10.0.0.1-10.0.0.2-10.0.0.3",
+			expectErr: true,
+		},
+		{
+			desc:      "empty",
+			val:       "",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		ipRange, err := parseIPRange(test.val)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got range %s", test.desc, ipRange.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !ipRange.Start.Equal(net.ParseIP(test.start)) {
+			t.Errorf("%s: expected start %s, got %v", test.desc, test.start, ipRange.Start)
+		}
+		if (test.end == "" && ipRange.End != nil) || (test.end != "" && !ipRange.End.Equal(net.ParseIP(test.end))) {
+			t.Errorf("%s: expected end %s, got %v", test.desc, test.end, ipRange.End)
+		}
+	}
+}
+
+func TestParseParametersForBucketAccess(t *testing.T) {
+	principal := "00000000-0000-0000-0000-000000000001"
+
+	tests := []struct {
+		desc             string
+		parameters       map[string]string
+		accountName      string
+		credentialType   string
+		credentialFormat string
+		protocol         azblob.SASProtocol
+		expectErr        bool
+	}{
+		{
+			desc:             "defaults",
+			parameters:       map[string]string{},
+			accountName:      "app",
+			credentialType:   CredentialTypeStoredAccessPolicy,
+			credentialFormat: CredentialFormatJSON,
+			protocol:         azblob.SASProtocolHTTPS,
+		},
+		{
+			desc:             "AAD principals default to role assignments",
+			parameters:       map[string]string{},
+			accountName:      principal,
+			credentialType:   CredentialTypeRoleAssignment,
+			credentialFormat: CredentialFormatJSON,
+			protocol:         azblob.SASProtocolHTTPS,
+		},
+		{
+			desc:             "keys are case insensitive",
+			parameters:       map[string]string{"credentialType": "UserDelegation", "credentialFormat": "SASURL", "protocol": "http, https"},
+			accountName:      "app",
+			credentialType:   CredentialTypeUserDelegation,
+			credentialFormat: CredentialFormatSASURL,
+			protocol:         azblob.SASProtocolHTTPSandHTTP,
+		},
+		{
+			desc:             "json/v1 is the json document",
+			parameters:       map[string]string{"credentialFormat": "json/v1"},
+			accountName:      "app",
+			credentialType:   CredentialTypeStoredAccessPolicy,
+			credentialFormat: CredentialFormatJSON,
+			protocol:         azblob.SASProtocolHTTPS,
+		},
+		{
+			desc:             "account keys as connection string",
+			parameters:       map[string]string{"credentialType": "accountkey", "credentialFormat": "connectionstring"},
+			accountName:      "app",
+			credentialType:   CredentialTypeAccountKey,
+			credentialFormat: CredentialFormatConnectionString,
+			protocol:         azblob.SASProtocolHTTPS,
+		},
+		{
+			desc:        "unknown credential type",
+			parameters:  map[string]string{"credentialType": "password"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "unknown credential format",
+			parameters:  map[string]string{"credentialFormat": "json/v2"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "unknown protocol",
+			parameters:  map[string]string{"protocol": "http"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "non positive maxLifetime",
+			parameters:  map[string]string{"maxLifetime": "0s"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "SAS restrictions on grants without a SAS",
+			parameters:  map[string]string{"credentialType": "accountkey", "allowedIPRange": "10.0.0.1"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "role assignments need an AAD principal",
+			parameters:  map[string]string{"credentialType": "roleassignment"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "role assignments only return json",
+			parameters:  map[string]string{"credentialFormat": "sastoken"},
+			accountName: principal,
+			expectErr:   true,
+		},
+		{
+			desc:        "account keys can not be returned as SAS",
+			parameters:  map[string]string{"credentialType": "accountkey", "credentialFormat": "sasurl"},
+			accountName: "app",
+			expectErr:   true,
+		},
+		{
+			desc:        "SSH keys are only for SFTP grants",
+			parameters:  map[string]string{"sftpAuthorizedKey": "ssh-rsa AAAA"},
+			accountName: "app",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseParametersForBucketAccess(test.parameters, test.accountName)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got options %+v", test.desc, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if options.credentialType != test.credentialType || options.credentialFormat != test.credentialFormat || options.protocol != test.protocol {
+			t.Errorf("%s: expected type %s, format %s and protocol %s, got %s, %s and %s", test.desc,
+				test.credentialType, test.credentialFormat, test.protocol, options.credentialType, options.credentialFormat, options.protocol)
+		}
+	}
+}
+
+func TestGetAccountId(t *testing.T) {
+	bucketId := "https://account.blob.core.windows.net/bucket"
+	accountId := getAccountId(bucketId, "app")
+
+	if len(accountId) != 32 {
+		t.Errorf("expected a 32 character account id, got %s", accountId)
+	}
+	if again := getAccountId(bucketId, "app"); again != accountId {
+		t.Errorf("expected repeated grants to get account id %s, got %s", accountId, again)
+	}
+	if other := getAccountId(bucketId, "other"); other == accountId {
+		t.Errorf("expected another account to get another account id than %s", accountId)
+	}
+	if other := getAccountId("https://account.blob.core.windows.net/other", "app"); other == accountId {
+		t.Errorf("expected the account on another bucket to get another account id than %s", accountId)
+	}
+}
+
+func TestCreateContainerSASToken(t *testing.T) {
+	// any base64 value is a valid key to sign with
+	accessKey := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	ipRange, _ := parseIPRange("10.0.0.0-10.0.255.255")
+
+	token, err := createContainerSASToken("account", accessKey, azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		IPRange:       ipRange,
+		ContainerName: "bucket",
+		Identifier:    testAccountId,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	query, err := url.ParseQuery(token)
+	if err != nil {
+		t.Fatalf("expected a query string, got %s: %v", token, err)
+	}
+	expected := map[string]string{"sr": "c", "si": testAccountId, "spr": "https", "sip": "10.0.0.0-10.0.255.255"}
+	for key, value := range expected {
+		if actual := query.Get(key); actual != value {
+			t.Errorf("expected %s=%s in the token, got '%s'", key, value, actual)
+		}
+	}
+	// the permissions and lifetime come from the stored access policy, so that revoking it invalidates the SAS
+	for _, key := range []string{"sp", "st", "se"} {
+		if query.Get(key) != "" {
+			t.Errorf("expected no %s in a SAS bound to a stored access policy, got %s", key, query.Get(key))
+		}
+	}
+	if query.Get("sig") == "" {
+		t.Errorf("expected a signed token, got %s", token)
+	}
+
+	if _, err := createContainerSASToken("account", "not base64!", azblob.BlobSASSignatureValues{ContainerName: "bucket"}); err == nil {
+		t.Errorf("expected an error for an invalid access key")
+	}
+}
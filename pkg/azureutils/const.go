@@ -16,6 +16,7 @@ package azureutils
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 const (
@@ -33,6 +34,181 @@ const (
 	HNSEnabledField            = "hnsenabled"
 	EnableNFSV3Field           = "enablenfsv3"
 	EnableLargeFileSharesField = "enablelargefileshares"
+	CredentialTypeField        = "credentialtype"
+	CredentialFormatField      = "credentialformat"
+	AllowedIPRangeField        = "allowediprange"
+	ProtocolField              = "protocol"
+	StartTimeOffsetField       = "starttimeoffset"
+	MaxLifetimeField           = "maxlifetime"
+	SFTPAuthorizedKeyField     = "sftpauthorizedkey"
+	PublicAccessField          = "publicaccess"
+
+	ImmutabilityPeriodDaysField                 = "immutabilityperioddays"
+	ImmutabilityAllowProtectedAppendWritesField = "immutabilityallowprotectedappendwrites"
+	ImmutabilityPolicyLockedField               = "immutabilitypolicylocked"
+	LegalHoldTagsField                          = "legalholdtags"
+	// MaxImmutabilityPeriodDays is the longest retention Azure allows for a time based immutability policy
+	MaxImmutabilityPeriodDays = 146000
+	// MaxLegalHoldTags is the number of tags Azure allows on a legal hold
+	MaxLegalHoldTags = 10
+
+	ContainerSoftDeleteDaysField = "containersoftdeletedays"
+	BlobSoftDeleteDaysField      = "blobsoftdeletedays"
+	BlobVersioningField          = "blobversioning"
+	ChangeFeedField              = "changefeed"
+	ChangeFeedRetentionDaysField = "changefeedretentiondays"
+	PointInTimeRestoreDaysField  = "pointintimerestoredays"
+	// MaxSoftDeleteDays is the longest soft delete retention Azure allows
+	MaxSoftDeleteDays = 365
+	// MaxChangeFeedRetentionDays is the longest change feed retention Azure allows
+	MaxChangeFeedRetentionDays = 146000
+
+	IsolationModeField = "isolationmode"
+	// IsolationModeShared places buckets in a named or pooled storage account shared with other buckets
+	IsolationModeShared = "shared"
+	// IsolationModeDedicated gives every bucket its own storage account
+	IsolationModeDedicated = "dedicated"
+	// DedicatedBucketTagKey holds the bucket name on the storage accounts dedicated to a bucket
+	DedicatedBucketTagKey = "cosi-bucket"
+
+	StorageAccountPoolField      = "storageaccountpool"
+	MaxContainersPerAccountField = "maxcontainersperaccount"
+	// DefaultStorageAccountPool is the pool of buckets whose class names no storage account
+	DefaultStorageAccountPool = "default"
+	// DefaultMaxContainersPerAccount caps the containers the driver places in a pooled storage account
+	DefaultMaxContainersPerAccount = 100
+	// PoolTagKey holds the pool name on pooled storage accounts
+	PoolTagKey = "cosi-pool"
+	// PoolSettingsTagKey holds a hash of the settings a pooled storage account is converged to on every create,
+	// so that only classes asking for the same settings share the account
+	PoolSettingsTagKey = "cosi-pool-settings"
+
+	PrivateEndpointVNetResourceGroupField = "privateendpointvnetresourcegroup"
+	PrivateEndpointVNetNameField          = "privateendpointvnetname"
+	PrivateEndpointSubnetNameField        = "privateendpointsubnetname"
+	PrivateDNSZoneResourceGroupField      = "privatednszoneresourcegroup"
+	PrivateEndpointNameTemplateField      = "privateendpointnametemplate"
+	// AccountNamePlaceholder is replaced with the storage account name in the private endpoint name template
+	AccountNamePlaceholder = "{accountName}"
+	// DefaultPrivateEndpointNameTemplate names the private endpoints of storage accounts
+	DefaultPrivateEndpointNameTemplate = AccountNamePlaceholder + "-blob-pvtendpoint"
+
+	IPRulesField                     = "iprules"
+	NetworkDefaultActionField        = "networkdefaultaction"
+	NetworkBypassField               = "networkbypass"
+	MinimumTLSVersionField           = "minimumtlsversion"
+	AllowSharedKeyAccessField        = "allowsharedkeyaccess"
+	AllowBlobPublicAccessField       = "allowblobpublicaccess"
+	AllowCrossTenantReplicationField = "allowcrosstenantreplication"
+
+	KeyVaultURIField          = "keyvaulturi"
+	KeyVaultKeyNameField      = "keyvaultkeyname"
+	KeyVaultKeyVersionField   = "keyvaultkeyversion"
+	UserAssignedIdentityField = "userassignedidentity"
+
+	EncryptionScopeField       = "encryptionscope"
+	EncryptionScopeKeyURIField = "encryptionscopekeyuri"
+
+	TierToCoolAfterDaysField    = "tiertocoolafterdays"
+	TierToArchiveAfterDaysField = "tiertoarchiveafterdays"
+	DeleteAfterDaysField        = "deleteafterdays"
+	LifecyclePrefixField        = "lifecycleprefix"
+	LifecycleBlobIndexTagsField = "lifecycleblobindextags"
+	// MaxLifecycleDays is the largest number of days since modification a lifecycle action accepts
+	MaxLifecycleDays = 99999
+	// MaxBlobIndexTagFilters is the number of blob index tag conditions Azure allows in a lifecycle rule filter
+	MaxBlobIndexTagFilters = 10
+
+	// ContainerMetadataPrefix marks the parameters that are set as container metadata, with the prefix removed
+	ContainerMetadataPrefix = "metadata."
+
+	// Metadata stamped by the driver on every container it creates
+	MetadataBucketName    = "cosi_bucket_name"
+	MetadataCreatedOn     = "cosi_created_on"
+	MetadataDriverVersion = "cosi_driver_version"
+	driverMetadataPrefix  = "cosi_"
+
+	EncryptionScopeMicrosoftManaged = "microsoftmanaged"
+	EncryptionScopeKeyVault         = "keyvault"
+
+	PublicAccessNone      = "none"
+	PublicAccessBlob      = "blob"
+	PublicAccessContainer = "container"
+
+	CredentialTypeStoredAccessPolicy = "storedaccesspolicy"
+	CredentialTypeUserDelegation     = "userdelegation"
+	CredentialTypeRoleAssignment     = "roleassignment"
+	CredentialTypeAccountKey         = "accountkey"
+	CredentialTypeSFTP               = "sftp"
+	CredentialTypeACL                = "acl"
+
+	AccountKey1 = "key1"
+	AccountKey2 = "key2"
+
+	SASProtocolHTTPS        = "https"
+	SASProtocolHTTPSandHTTP = "https,http"
+
+	CredentialFormatJSON             = "json"
+	CredentialFormatJSONV1           = "json/v1"
+	CredentialFormatSASToken         = "sastoken"
+	CredentialFormatSASURL           = "sasurl"
+	CredentialFormatConnectionString = "connectionstring"
+
+	// CredentialsSchemaVersion is the version of the JSON credentials document, bumped on incompatible changes
+	CredentialsSchemaVersion = "v1"
+
+	// DefaultGrantValidity is the lifetime of the SAS issued for a bucket access grant
+	DefaultGrantValidity = 24 * time.Hour
+	// MaxStoredAccessPolicies is the number of signed identifiers Azure allows on a single container
+	MaxStoredAccessPolicies = 5
+	// UserDelegationKeyValidity is the lifetime requested for user delegation keys, 7 days is the maximum allowed
+	UserDelegationKeyValidity = 7 * 24 * time.Hour
+	// UserDelegationKeyRefreshMargin is how long a cached user delegation key must outlive the SAS signed with it
+	UserDelegationKeyRefreshMargin = time.Hour
+
+	// localUsersAPIVersion is the storage ARM api version that supports SFTP and local users
+	localUsersAPIVersion = "2021-08-01"
+	// OwnerTagKey and OwnerTagValue mark the Azure resources created by the driver, which it may delete again
+	OwnerTagKey   = "cosi-owner"
+	OwnerTagValue = "azure-cosi-driver"
+	// PrivateEndpointTagKey holds the resource id of the blob private endpoint the driver created for a storage account
+	PrivateEndpointTagKey = "cosi-private-endpoint"
+	// RetainedAccountTagKey marks the storage accounts the driver kept only for their soft deleted containers, with
+	// the time they were kept, so that RetainedAccountSweepInterval sweeps delete them once the retention lapsed
+	RetainedAccountTagKey = "cosi-retained-since"
+	// RetainedAccountSweepInterval is how often the storage accounts kept for their soft deleted containers are checked
+	RetainedAccountSweepInterval = time.Hour
+
+	// poolAccountNamePrefix starts the names of the storage accounts the driver creates for pools
+	poolAccountNamePrefix = "cosipool"
+
+	// dedicatedAccountNamePrefix starts the names of the storage accounts dedicated to a bucket
+	dedicatedAccountNamePrefix = "cosi"
+	// maxDedicatedAccountNameAttempts is how many names of the naming scheme are tried for a dedicated account
+	maxDedicatedAccountNameAttempts = 5
+
+	// blobPrivateDNSZoneName is the private DNS zone resolving the blob endpoints of storage accounts to private endpoints
+	blobPrivateDNSZoneName = "privatelink.blob.core.windows.net"
+	// blobGroupID is the private link sub-resource of the blob endpoint
+	blobGroupID = "blob"
+
+	// accountSecurityAPIVersion is the storage ARM api version that supports allowCrossTenantReplication
+	accountSecurityAPIVersion = "2021-08-01"
+	// dataLakeAPIVersion is the dfs endpoint version that supports recursive ACL updates
+	dataLakeAPIVersion = "2020-02-10"
+	// localUserPrefix starts the names of the local users created for SFTP grants
+	localUserPrefix = "cosi"
+	// lifecycleRulePrefix starts the names of the lifecycle rules created for buckets
+	lifecycleRulePrefix = "cosi"
+	// encryptionScopePrefix starts the names of the encryption scopes created for buckets
+	encryptionScopePrefix = "cosi"
+
+	// serviceCodeContainerProtectedFromDeletion is returned when a policy or hold prevents deleting a container
+	serviceCodeContainerProtectedFromDeletion = "ContainerProtectedFromDeletion"
+	// serviceCodePublicAccessNotPermitted is returned when public access is disabled on the account
+	serviceCodePublicAccessNotPermitted = "PublicAccessNotPermitted"
+	// serviceCodeKeyBasedAuthenticationNotPermitted is returned when shared key access is disabled on the account
+	serviceCodeKeyBasedAuthenticationNotPermitted = "KeyBasedAuthenticationNotPermitted"
 )
 
 // ConvertTagsToMap convert the tags from string to map
@@ -18,10 +18,13 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
@@ -31,54 +34,272 @@ const (
 
 var (
 	storageAccountRE = regexp.MustCompile(`https://(.+).blob.core.windows.net/([^/]*)/?(.*)`)
+	// metadataKeyRE matches the C# identifiers Azure accepts as metadata names
+	metadataKeyRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 )
 
+// BucketClients holds the clients and driver settings used to create and delete buckets
+type BucketClients struct {
+	Cloud             *azure.Cloud
+	StorageManagement *StorageManagementClient
+	// AllowedPublicAccessLevels are the container public access levels bucket classes may request
+	AllowedPublicAccessLevels []string
+	// DriverVersion is stamped on the containers the driver creates
+	DriverVersion string
+	// DeleteEmptyStorageAccounts deletes the storage accounts created by the driver once their last bucket is deleted
+	DeleteEmptyStorageAccounts bool
+}
+
 func CreateBucket(
 	ctx context.Context,
 	storageAccount string,
 	containerName string,
 	parameters map[string]string,
-	cloud *azure.Cloud) (string, error) {
+	clients *BucketClients) (string, error) {
+	cloud := clients.Cloud
 
-	options, err := parseParametersForStorageAccount(parameters, cloud)
+	options, security, err := parseParametersForStorageAccount(parameters, cloud)
 	if err != nil {
 		return "", status.Error(codes.Unknown, fmt.Sprintf("Error parsing parameters : %v", err))
 	}
 
+	publicAccess, err := parsePublicAccess(parameters, clients.AllowedPublicAccessLevels)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	metadata, err := getContainerMetadata(parameters, containerName, clients.DriverVersion)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	immutability, err := parseImmutabilityOptions(parameters)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	dataProtection, err := parseDataProtectionOptions(parameters)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	lifecycle, err := parseLifecycleOptions(parameters)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	customerManagedKey, err := parseCustomerManagedKeyOptions(parameters)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	encryptionScope, err := parseEncryptionScopeOptions(parameters)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	privateEndpoint, err := parsePrivateEndpointOptions(parameters, cloud)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	privateEndpoint.applyNetworkDefaults(security)
+
+	dedicated, err := parseIsolationMode(parameters, storageAccount)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var pool *storagePoolOptions
+	if !dedicated {
+		pool, err = parseStoragePoolOptions(parameters, storageAccount)
+		if err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
 	options.Name = storageAccount
 	options.ResourceGroup = cloud.ResourceGroup
 	options.CreateAccount = true
 
+	var release func()
+	if dedicated {
+		// EnsureStorageAccount only creates accounts with generated names, so the dedicated account is created first
+		options.Name, err = clients.StorageManagement.ensureDedicatedAccount(ctx, containerName, options, cloud.Location)
+		if err != nil {
+			return "", status.Error(codes.Unknown, err.Error())
+		}
+	} else if pool != nil {
+		pool.settings = getPoolSettingsHash(security, customerManagedKey)
+		release, err = placePooledBucket(ctx, clients, options, pool, containerName)
+		if err != nil {
+			return "", err
+		}
+	}
+	if release == nil {
+		if release, err = clients.StorageManagement.reserveContainer(options.Name, containerName); err != nil {
+			return "", err
+		}
+	}
+	defer release()
+
 	// Check and create StorageAccount here
-	accountName, accessKey, err := cloud.EnsureStorageAccount(options, "")
+	accountName, accessKey, err := cloud.EnsureStorageAccount(options, poolAccountNamePrefix)
 	if err != nil {
 		return "", status.Error(codes.Unknown, fmt.Sprintf("Error creating storage account with name %s : %v", storageAccount, err))
 	}
 
+	// Reused accounts may have been created with other settings, so the security settings are verified on every create
+	if err := clients.StorageManagement.applyAccountSecurity(ctx, accountName, security); err != nil {
+		return "", err
+	}
+
+	if err := clients.StorageManagement.ensurePrivateEndpoint(ctx, accountName, privateEndpoint); err != nil {
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	// EnsureStorageAccount can not set the encryption of new accounts, so the key is applied right after
+	if err := clients.StorageManagement.applyCustomerManagedKey(ctx, accountName, customerManagedKey); err != nil {
+		return "", err
+	}
+
+	// The account may already hold buckets of other classes, so its blob service properties are converged on every create
+	if err := clients.StorageManagement.applyDataProtection(ctx, accountName, dataProtection); err != nil {
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	if publicAccess != azblob.PublicAccessNone {
+		allowed, err := clients.StorageManagement.isBlobPublicAccessAllowed(ctx, accountName)
+		if err != nil {
+			return "", status.Error(codes.Unknown, err.Error())
+		}
+		if !allowed {
+			return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s has allowBlobPublicAccess=false, containers can not be created with public access level %s", accountName, publicAccess))
+		}
+	}
+
 	// Once storage account is created, we create the azure container inside the storage account
-	return createAzureContainer(ctx, accountName, accessKey, containerName, parameters)
+	scopeName := ""
+	if encryptionScope != nil {
+		scopeName = getEncryptionScopeName(containerName)
+		if err := clients.StorageManagement.ensureEncryptionScope(ctx, accountName, scopeName, encryptionScope); err != nil {
+			return "", err
+		}
+	}
+
+	useARM, err := clients.StorageManagement.useARMForContainers(ctx, accountName)
+	if err != nil {
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	var containerUrl string
+	if scopeName != "" || useARM {
+		containerUrl, err = clients.StorageManagement.createContainerWithARM(ctx, accountName, containerName, metadata, publicAccess, scopeName)
+	} else {
+		containerUrl, err = createAzureContainer(ctx, accountName, accessKey, containerName, metadata, publicAccess)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := clients.StorageManagement.applyContainerImmutability(ctx, accountName, containerName, immutability); err != nil {
+		return "", err
+	}
+
+	if err := clients.StorageManagement.applyLifecycleRule(ctx, accountName, containerName, lifecycle); err != nil {
+		return "", status.Error(codes.Unknown, err.Error())
+	}
+
+	return containerUrl, nil
+}
+
+// EnsureBucketDeletable fails with FailedPrecondition while an immutability policy or legal hold
+// prevents deleting the container of the bucket
+func EnsureBucketDeletable(
+	ctx context.Context,
+	bucketId string,
+	clients *BucketClients) error {
+	if !storageAccountRE.MatchString(bucketId) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid bucket id %s", bucketId))
+	}
+	storageAccountName := getStorageAccountNameFromContainerUrl(bucketId)
+	containerName := getContainerNameFromContainerUrl(bucketId)
+
+	blocker, err := clients.StorageManagement.getContainerDeletionBlocker(ctx, storageAccountName, containerName)
+	if err != nil {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	if blocker != "" {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Container %s in storage account %s can not be deleted, %s", containerName, storageAccountName, blocker))
+	}
+
+	return nil
 }
 
 func DeleteBucket(
 	ctx context.Context,
 	bucketId string,
-	cloud *azure.Cloud) error {
+	clients *BucketClients) error {
+	if !storageAccountRE.MatchString(bucketId) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid bucket id %s", bucketId))
+	}
+	cloud := clients.Cloud
 	// Get storage account name from bucketId
 	storageAccountName := getStorageAccountNameFromContainerUrl(bucketId)
-	// Get access keys for the storage account
-	accessKey, err := cloud.GetStorageAccesskey(storageAccountName, cloud.ResourceGroup)
+	containerName := getContainerNameFromContainerUrl(bucketId)
+
+	// Every step below tolerates what an earlier, partly failed delete already removed, so that a retry finishes
+	// the cleanup. An account that is gone took the container and everything in it along.
+	exists, err := clients.StorageManagement.storageAccountExists(ctx, storageAccountName)
 	if err != nil {
 		return err
 	}
+	if !exists {
+		klog.Infof("Storage account %s of bucket %s does not exist anymore", storageAccountName, bucketId)
+		return nil
+	}
 
-	containerName := getContainerNameFromContainerUrl(bucketId)
-	err = deleteAzureContainer(ctx, storageAccountName, accessKey, containerName)
+	if err := clients.StorageManagement.removeContainerLifecycleRule(ctx, storageAccountName, containerName); err != nil {
+		return err
+	}
+
+	useARM, err := clients.StorageManagement.useARMForContainers(ctx, storageAccountName)
 	if err != nil {
-		return fmt.Errorf("Error deleting container %s in storage account %s : %v", containerName, storageAccountName, err)
+		return err
+	}
+
+	if !useARM {
+		// Get access keys for the storage account
+		accessKey, err := cloud.GetStorageAccesskey(storageAccountName, cloud.ResourceGroup)
+		if err != nil {
+			return err
+		}
+
+		err = deleteAzureContainer(ctx, storageAccountName, accessKey, containerName)
+		if err != nil {
+			if serr, ok := err.(azblob.StorageError); ok {
+				switch serr.ServiceCode() {
+				case azblob.ServiceCodeContainerNotFound:
+					klog.Infof("Container %s does not exist in storage account %s", containerName, storageAccountName)
+				case serviceCodeContainerProtectedFromDeletion:
+					return status.Error(codes.FailedPrecondition, fmt.Sprintf("Container %s in storage account %s is protected from deletion by an immutability policy or legal hold", containerName, storageAccountName))
+				default:
+					return fmt.Errorf("Error deleting container %s in storage account %s : %v", containerName, storageAccountName, err)
+				}
+			} else {
+				return fmt.Errorf("Error deleting container %s in storage account %s : %v", containerName, storageAccountName, err)
+			}
+		}
+	} else if err := clients.StorageManagement.deleteContainerWithARM(ctx, storageAccountName, containerName); err != nil {
+		return err
+	}
+
+	// The scope name derives from the container name, so it is found again after the container is gone
+	if err := clients.StorageManagement.disableEncryptionScope(ctx, storageAccountName, getEncryptionScopeName(containerName)); err != nil {
+		return err
 	}
 
 	// Now, we check and delete the storage account if its empty
-	return nil
+	return clients.StorageManagement.cleanUpEmptyStorageAccount(ctx, storageAccountName, containerName, clients.DeleteEmptyStorageAccounts)
 }
 
 func getStorageAccountNameFromContainerUrl(containerUrl string) string {
@@ -116,16 +337,11 @@ func createContainerUrl(
 		return azblob.ContainerURL{}, fmt.Errorf("Invalid credentials with error : %v", err)
 	}
 
-	// Create a default request pipeline using credential
-	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-
-	urlString, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", storageAccount))
+	serviceURL, err := createServiceUrl(storageAccount, credential)
 	if err != nil {
 		return azblob.ContainerURL{}, err
 	}
 
-	serviceURL := azblob.NewServiceURL(*urlString, pipeline)
-
 	// Create containerURL that wraps the service url and pipeline to make requests
 	containerURL := serviceURL.NewContainerURL(containerName)
 
@@ -133,8 +349,27 @@ func createContainerUrl(
 
 }
 
+func createServiceUrl(
+	storageAccount string,
+	credential azblob.Credential) (azblob.ServiceURL, error) {
+	// Create a default request pipeline using credential
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	urlString, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", storageAccount))
+	if err != nil {
+		return azblob.ServiceURL{}, err
+	}
+
+	return azblob.NewServiceURL(*urlString, pipeline), nil
+}
+
+// parseContainerUrl splits the container url into storage account, container and blob name, all empty when it is
+// no blob url. Callers taking bucket ids from requests check them against storageAccountRE first.
 func parseContainerUrl(containerUrl string) (string, string, string) {
 	matches := storageAccountRE.FindStringSubmatch(containerUrl)
+	if matches == nil {
+		return "", "", ""
+	}
 	storageAccount := matches[1]
 	containerName := matches[2]
 	blobName := matches[3]
@@ -146,7 +381,8 @@ func createAzureContainer(
 	storageAccount string,
 	accessKey string,
 	containerName string,
-	parameters map[string]string) (string, error) {
+	metadata map[string]string,
+	publicAccess azblob.PublicAccessType) (string, error) {
 	if len(storageAccount) == 0 || len(accessKey) == 0 {
 		return "", fmt.Errorf("Invalid storage account or access key")
 	}
@@ -157,15 +393,76 @@ func createAzureContainer(
 	}
 
 	// Lets create a container with the containerURL
-	_, err = containerURL.Create(ctx, parameters, azblob.PublicAccessNone)
+	_, err = containerURL.Create(ctx, metadata, publicAccess)
 	if err != nil {
 		if serr, ok := err.(azblob.StorageError); ok {
 			if serr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists {
 				return containerURL.String(), nil
 			}
+			if serr.ServiceCode() == serviceCodePublicAccessNotPermitted {
+				return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Public access is not permitted on storage account %s, containers can not be created with public access level %s", storageAccount, publicAccess))
+			}
 		}
 		return "", fmt.Errorf("Error creating container from containterURL : %s, Error : %v", containerURL.String(), err)
 	}
 
 	return containerURL.String(), nil
 }
+
+// parsePublicAccess returns the validated public access level of the container, none unless the bucket class
+// requests a level that the driver allows
+func parsePublicAccess(parameters map[string]string, allowedLevels []string) (azblob.PublicAccessType, error) {
+	level := PublicAccessNone
+	for key, val := range parameters {
+		if strings.EqualFold(key, PublicAccessField) {
+			level = strings.ToLower(strings.TrimSpace(val))
+		}
+	}
+
+	var publicAccess azblob.PublicAccessType
+	switch level {
+	case PublicAccessNone:
+		return azblob.PublicAccessNone, nil
+	case PublicAccessBlob:
+		publicAccess = azblob.PublicAccessBlob
+	case PublicAccessContainer:
+		publicAccess = azblob.PublicAccessContainer
+	default:
+		return azblob.PublicAccessNone, fmt.Errorf("Invalid %s '%s', supported values are %s, %s and %s", PublicAccessField, level, PublicAccessNone, PublicAccessBlob, PublicAccessContainer)
+	}
+
+	for _, allowed := range allowedLevels {
+		if strings.EqualFold(strings.TrimSpace(allowed), level) {
+			return publicAccess, nil
+		}
+	}
+
+	return azblob.PublicAccessNone, fmt.Errorf("%s '%s' is not allowed by the driver, allowed levels are %s", PublicAccessField, level, strings.Join(allowedLevels, ", "))
+}
+
+// getContainerMetadata returns the metadata of a new container. Only parameters with the metadata. prefix
+// become container metadata, since every other parameter configures the storage account and must not be
+// readable by users of the container. The driver stamps the bucket name, creation time and its version.
+func getContainerMetadata(parameters map[string]string, bucketName, driverVersion string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for key, val := range parameters {
+		if len(key) <= len(ContainerMetadataPrefix) || !strings.EqualFold(key[:len(ContainerMetadataPrefix)], ContainerMetadataPrefix) {
+			continue
+		}
+
+		name := key[len(ContainerMetadataPrefix):]
+		if !metadataKeyRE.MatchString(name) {
+			return nil, fmt.Errorf("Metadata parameter '%s' is invalid, names must start with a letter or underscore and contain only letters, digits and underscores", key)
+		}
+		if strings.HasPrefix(strings.ToLower(name), driverMetadataPrefix) {
+			return nil, fmt.Errorf("Metadata parameter '%s' is invalid, names starting with %s are reserved for the driver", key, driverMetadataPrefix)
+		}
+		metadata[name] = val
+	}
+
+	metadata[MetadataBucketName] = bucketName
+	metadata[MetadataCreatedOn] = time.Now().UTC().Format(time.RFC3339)
+	metadata[MetadataDriverVersion] = driverVersion
+
+	return metadata, nil
+}
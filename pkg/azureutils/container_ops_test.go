@@ -0,0 +1,156 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseContainerUrl(t *testing.T) {
+	tests := []struct {
+		url       string
+		account   string
+		container string
+		blob      string
+	}{
+		{url: "https://account.blob.core.windows.net/bucket", account: "account", container: "bucket"},
+		{url: "https://account.blob.core.windows.net/bucket/dir/blob", account: "account", container: "bucket", blob: "dir/blob"},
+		{url: "bucket"},
+		{url: ""},
+	}
+
+	for _, test := range tests {
+		account, container, blob := parseContainerUrl(test.url)
+		if account != test.account || container != test.container || blob != test.blob {
+			t.Errorf("%s: expected '%s', '%s' and '%s', got '%s', '%s' and '%s'", test.url, test.account, test.container, test.blob, account, container, blob)
+		}
+	}
+}
+
+func TestDeleteInvalidBucketId(t *testing.T) {
+	client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+		t.Errorf("unexpected call %s", call)
+		return http.StatusBadRequest, nil
+	})
+	clients := &BucketClients{StorageManagement: client}
+
+	if err := EnsureBucketDeletable(context.TODO(), "bucket", clients); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v from EnsureBucketDeletable, got %v", codes.InvalidArgument, err)
+	}
+	if err := DeleteBucket(context.TODO(), "bucket", clients); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v from DeleteBucket, got %v", codes.InvalidArgument, err)
+	}
+	if calls := arm.getCalls(); len(calls) != 0 {
+		t.Errorf("expected no calls for an invalid bucket id, got %v", calls)
+	}
+}
+
+func TestParsePublicAccess(t *testing.T) {
+	allowed := []string{"none", " Blob "}
+
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   azblob.PublicAccessType
+		expectErr  bool
+	}{
+		{
+			desc:       "private by default",
+			parameters: map[string]string{},
+			expected:   azblob.PublicAccessNone,
+		},
+		{
+			desc:       "allowed level in any case",
+			parameters: map[string]string{"PublicAccess": "BLOB"},
+			expected:   azblob.PublicAccessBlob,
+		},
+		{
+			desc:       "level the driver does not allow",
+			parameters: map[string]string{"publicAccess": "container"},
+			expectErr:  true,
+		},
+		{
+			desc:       "unknown level",
+			parameters: map[string]string{"publicAccess": "public"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		publicAccess, err := parsePublicAccess(test.parameters, allowed)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.desc, test.expectErr, err)
+		}
+		if publicAccess != test.expected {
+			t.Errorf("%s: expected public access '%s', got '%s'", test.desc, test.expected, publicAccess)
+		}
+	}
+
+	// none is always allowed, even when the driver allows no level at all
+	if publicAccess, err := parsePublicAccess(map[string]string{"publicAccess": "none"}, nil); err != nil || publicAccess != azblob.PublicAccessNone {
+		t.Errorf("expected private containers without allowed levels, got '%s' and error %v", publicAccess, err)
+	}
+}
+
+func TestGetContainerMetadata(t *testing.T) {
+	t.Run("only metadata parameters", func(t *testing.T) {
+		parameters := map[string]string{
+			"metadata.team":       "payments",
+			"Metadata.CostCenter": "1234",
+			"skuName":             "Standard_LRS",
+			"storageAccount":      "account",
+			"metadata.":           "empty name",
+		}
+		metadata, err := getContainerMetadata(parameters, "bucket", "v1.0.0")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		createdOn := metadata[MetadataCreatedOn]
+		if _, err := time.Parse(time.RFC3339, createdOn); err != nil {
+			t.Errorf("expected the creation time in %s, got '%s'", MetadataCreatedOn, createdOn)
+		}
+		delete(metadata, MetadataCreatedOn)
+		expected := map[string]string{
+			"team":                "payments",
+			"CostCenter":          "1234",
+			MetadataBucketName:    "bucket",
+			MetadataDriverVersion: "v1.0.0",
+		}
+		if !reflect.DeepEqual(metadata, expected) {
+			t.Errorf("expected metadata %v, got %v", expected, metadata)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		if _, err := getContainerMetadata(map[string]string{"metadata.cost-center": "1234"}, "bucket", "v1.0.0"); err == nil {
+			t.Errorf("expected an error for a name with a dash")
+		}
+	})
+
+	t.Run("name reserved for the driver", func(t *testing.T) {
+		// the stamped bucket name can not be overridden by the bucket class
+		if _, err := getContainerMetadata(map[string]string{"metadata.COSI_bucket_name": "other"}, "bucket", "v1.0.0"); err == nil {
+			t.Errorf("expected an error for a name reserved for the driver")
+		}
+	})
+}
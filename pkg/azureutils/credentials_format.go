@@ -0,0 +1,93 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// BucketAccessCredentials is the v1 JSON credentials document returned to the workload for a granted bucket.
+// SAS based grants carry a token, account key grants carry the key, role assignment grants carry
+// the identity the access was granted to, ACL grants also carry the directory and SFTP grants carry the local user to log in as.
+// Fields are only ever added to a version, renaming or removing a field requires a new version.
+type BucketAccessCredentials struct {
+	Version       string `json:"version"`
+	AccountName   string `json:"accountName"`
+	ContainerName string `json:"containerName"`
+	ContainerURL  string `json:"containerUrl"`
+	BlobEndpoint  string `json:"blobEndpoint"`
+	DfsEndpoint   string `json:"dfsEndpoint"`
+	SASToken      string `json:"sasToken,omitempty"`
+	AccountKey    string `json:"accountKey,omitempty"`
+	PrincipalID   string `json:"principalId,omitempty"`
+	ClientID      string `json:"clientId,omitempty"`
+	TenantID      string `json:"tenantId,omitempty"`
+	Role          string `json:"role,omitempty"`
+	Directory     string `json:"directory,omitempty"`
+	SFTPHost      string `json:"sftpHost,omitempty"`
+	SFTPUsername  string `json:"sftpUsername,omitempty"`
+	SSHPassword   string `json:"sshPassword,omitempty"`
+	// PrivateEndpointIP and PrivateEndpointFQDN address the blob private endpoint of the storage account, if it has one
+	PrivateEndpointIP   string `json:"privateEndpointIp,omitempty"`
+	PrivateEndpointFQDN string `json:"privateEndpointFqdn,omitempty"`
+}
+
+func newBucketAccessCredentials(storageAccount, containerName, containerUrl string) *BucketAccessCredentials {
+	return &BucketAccessCredentials{
+		Version:       CredentialsSchemaVersion,
+		AccountName:   storageAccount,
+		ContainerName: containerName,
+		ContainerURL:  containerUrl,
+		BlobEndpoint:  fmt.Sprintf("https://%s.blob.core.windows.net/", storageAccount),
+		DfsEndpoint:   fmt.Sprintf("https://%s.dfs.core.windows.net/", storageAccount),
+	}
+}
+
+// formatCredentials renders the credentials in the requested format:
+//
+//	json              the BucketAccessCredentials document
+//	sastoken          the SAS query string, e.g. sv=...&sig=...
+//	sasurl            the container URL with the SAS appended, e.g. https://<account>.blob.core.windows.net/<container>?sv=...
+//	connectionstring  an AZURE_STORAGE_CONNECTION_STRING, BlobEndpoint=https://<account>.blob.core.windows.net/;SharedAccessSignature=sv=...
+//	                  or DefaultEndpointsProtocol=https;AccountName=<account>;AccountKey=... for account key grants
+func formatCredentials(credentials *BucketAccessCredentials, format string) (string, error) {
+	switch format {
+	case CredentialFormatJSON:
+		data, err := json.Marshal(credentials)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	if credentials.AccountKey != "" && format == CredentialFormatConnectionString {
+		return fmt.Sprintf("DefaultEndpointsProtocol=https;AccountName=%s;AccountKey=%s;EndpointSuffix=core.windows.net", credentials.AccountName, credentials.AccountKey), nil
+	}
+
+	if credentials.SASToken == "" {
+		return "", fmt.Errorf("Credential format %s requires a SAS token", format)
+	}
+
+	switch format {
+	case CredentialFormatSASToken:
+		return credentials.SASToken, nil
+	case CredentialFormatSASURL:
+		return fmt.Sprintf("%s?%s", credentials.ContainerURL, credentials.SASToken), nil
+	case CredentialFormatConnectionString:
+		return fmt.Sprintf("BlobEndpoint=%s;SharedAccessSignature=%s", credentials.BlobEndpoint, credentials.SASToken), nil
+	}
+
+	return "", fmt.Errorf("Unknown credential format %s", format)
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"testing"
+)
+
+func TestFormatCredentials(t *testing.T) {
+	containerUrl := "https://account.blob.core.windows.net/bucket"
+	sasCredentials := newBucketAccessCredentials("account", "bucket", containerUrl)
+	sasCredentials.SASToken = "sv=2020-04-08&sig=abc"
+	keyCredentials := newBucketAccessCredentials("account", "bucket", containerUrl)
+	keyCredentials.AccountKey = "key=="
+	identityCredentials := newBucketAccessCredentials("account", "bucket", containerUrl)
+	identityCredentials.PrincipalID = "00000000-0000-0000-0000-000000000001"
+
+	tests := []struct {
+		desc        string
+		credentials *BucketAccessCredentials
+		format      string
+		expected    string
+		expectErr   bool
+	}{
+		{
+			desc:        "json",
+			credentials: sasCredentials,
+			format:      CredentialFormatJSON,
+			expected: `{"version":"v1","accountName":"account","containerName":"bucket","containerUrl":"https://account.blob.core.windows.net/bucket",` +
+				`"blobEndpoint":"https://account.blob.core.windows.net/","dfsEndpoint":"https://account.dfs.core.windows.net/","sasToken":"sv=2020-04-08\u0026sig=abc"}`,
+		},
+		{
+			desc:        "sastoken",
+			credentials: sasCredentials,
+			format:      CredentialFormatSASToken,
+			expected:    "sv=2020-04-08&sig=abc",
+		},
+		{
+			desc:        "sasurl",
+			credentials: sasCredentials,
+			format:      CredentialFormatSASURL,
+			expected:    "https://account.blob.core.windows.net/bucket?sv=2020-04-08&sig=abc",
+		},
+		{
+			desc:        "connectionstring with SAS",
+			credentials: sasCredentials,
+			format:      CredentialFormatConnectionString,
+			expected:    "BlobEndpoint=https://account.blob.core.windows.net/;SharedAccessSignature=sv=2020-04-08&sig=abc",
+		},
+		{
+			desc:        "connectionstring with account key",
+			credentials: keyCredentials,
+			format:      CredentialFormatConnectionString,
+			expected:    "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=key==;EndpointSuffix=core.windows.net",
+		},
+		{
+			desc:        "sasurl without SAS",
+			credentials: keyCredentials,
+			format:      CredentialFormatSASURL,
+			expectErr:   true,
+		},
+		{
+			desc:        "sastoken without SAS",
+			credentials: identityCredentials,
+			format:      CredentialFormatSASToken,
+			expectErr:   true,
+		},
+		{
+			desc:        "unknown format",
+			credentials: sasCredentials,
+			format:      "yaml",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		formatted, err := formatCredentials(test.credentials, test.format)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got '%s'", test.desc, formatted)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if formatted != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.desc, test.expected, formatted)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+// dataProtectionOptions are the blob service properties requested by a bucket class, zero values leave
+// the setting of the storage account as it is
+type dataProtectionOptions struct {
+	containerSoftDeleteDays int32
+	blobSoftDeleteDays      int32
+	versioning              bool
+	changeFeed              bool
+	changeFeedRetentionDays int32
+	restoreDays             int32
+}
+
+func (o *dataProtectionOptions) isEmpty() bool {
+	return *o == dataProtectionOptions{}
+}
+
+func parseDataProtectionOptions(parameters map[string]string) (*dataProtectionOptions, error) {
+	options := &dataProtectionOptions{}
+	for key, val := range parameters {
+		var err error
+		switch strings.ToLower(key) {
+		case ContainerSoftDeleteDaysField:
+			options.containerSoftDeleteDays, err = parseDays(key, val, MaxSoftDeleteDays)
+		case BlobSoftDeleteDaysField:
+			options.blobSoftDeleteDays, err = parseDays(key, val, MaxSoftDeleteDays)
+		case BlobVersioningField:
+			options.versioning = strings.EqualFold(val, TrueValue)
+		case ChangeFeedField:
+			options.changeFeed = strings.EqualFold(val, TrueValue)
+		case ChangeFeedRetentionDaysField:
+			options.changeFeedRetentionDays, err = parseDays(key, val, MaxChangeFeedRetentionDays)
+			options.changeFeed = true
+		case PointInTimeRestoreDaysField:
+			options.restoreDays, err = parseDays(key, val, MaxSoftDeleteDays-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Point in time restore is built on versioning, the change feed and blob soft delete
+	if options.restoreDays != 0 {
+		if options.blobSoftDeleteDays <= options.restoreDays {
+			return nil, fmt.Errorf("%s must be greater than %s", BlobSoftDeleteDaysField, PointInTimeRestoreDaysField)
+		}
+		options.versioning = true
+		options.changeFeed = true
+	}
+
+	return options, nil
+}
+
+func parseDays(key, val string, max int32) (int32, error) {
+	days, err := strconv.ParseInt(val, 10, 32)
+	if err != nil || days < 1 || days > int64(max) {
+		return 0, fmt.Errorf("Invalid %s '%s', the value must be between 1 and %d days", key, val, max)
+	}
+	return int32(days), nil
+}
+
+// applyDataProtection converges the blob service properties of the storage account with the options. Since the
+// account may be shared by buckets of several classes, settings are only ever enabled or lengthened, never
+// disabled or shortened, so that every bucket gets at least the protection its class asked for.
+func (c *StorageManagementClient) applyDataProtection(ctx context.Context, storageAccount string, options *dataProtectionOptions) error {
+	if options.isEmpty() {
+		return nil
+	}
+
+	c.blobServicesLock.Lock()
+	defer c.blobServicesLock.Unlock()
+
+	current, err := c.blobServices.GetServiceProperties(ctx, c.resourceGroup, storageAccount)
+	if err != nil {
+		return fmt.Errorf("Error getting blob service properties of storage account %s : %v", storageAccount, err)
+	}
+	properties := current.BlobServicePropertiesProperties
+	if properties == nil {
+		properties = &storage.BlobServicePropertiesProperties{}
+	}
+
+	desired := &storage.BlobServicePropertiesProperties{
+		ContainerDeleteRetentionPolicy: mergeRetentionPolicy(properties.ContainerDeleteRetentionPolicy, options.containerSoftDeleteDays),
+		DeleteRetentionPolicy:          mergeRetentionPolicy(properties.DeleteRetentionPolicy, options.blobSoftDeleteDays),
+		IsVersioningEnabled:            to.BoolPtr(to.Bool(properties.IsVersioningEnabled) || options.versioning),
+		ChangeFeed:                     mergeChangeFeed(properties.ChangeFeed, options),
+		RestorePolicy:                  mergeRestorePolicy(properties.RestorePolicy, options.restoreDays),
+	}
+
+	if to.Bool(desired.RestorePolicy.Enabled) {
+		softDeleteDays := int32(0)
+		if to.Bool(desired.DeleteRetentionPolicy.Enabled) {
+			softDeleteDays = to.Int32(desired.DeleteRetentionPolicy.Days)
+		}
+		if softDeleteDays <= to.Int32(desired.RestorePolicy.Days) {
+			return fmt.Errorf("Point in time restore of %d days on storage account %s requires %s greater than the restore window, but blob soft delete retention is %d days",
+				to.Int32(desired.RestorePolicy.Days), storageAccount, BlobSoftDeleteDaysField, softDeleteDays)
+		}
+	}
+
+	if dataProtectionEqual(properties, desired) {
+		return nil
+	}
+
+	klog.Infof("Updating data protection of storage account %s", storageAccount)
+	_, err = c.blobServices.SetServiceProperties(ctx, c.resourceGroup, storageAccount, storage.BlobServiceProperties{
+		BlobServicePropertiesProperties: desired,
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting blob service properties of storage account %s : %v", storageAccount, err)
+	}
+
+	return nil
+}
+
+func mergeRetentionPolicy(current *storage.DeleteRetentionPolicy, days int32) *storage.DeleteRetentionPolicy {
+	if current != nil && to.Bool(current.Enabled) && to.Int32(current.Days) >= days {
+		return &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: current.Days}
+	}
+	if days == 0 {
+		return &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(false)}
+	}
+	return &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(days)}
+}
+
+func mergeChangeFeed(current *storage.ChangeFeed, options *dataProtectionOptions) *storage.ChangeFeed {
+	if current == nil || !to.Bool(current.Enabled) {
+		if !options.changeFeed {
+			return &storage.ChangeFeed{Enabled: to.BoolPtr(false)}
+		}
+		changeFeed := &storage.ChangeFeed{Enabled: to.BoolPtr(true)}
+		if options.changeFeedRetentionDays != 0 {
+			changeFeed.RetentionInDays = to.Int32Ptr(options.changeFeedRetentionDays)
+		}
+		return changeFeed
+	}
+
+	// A change feed without retention keeps its records forever, which is already the longest retention
+	changeFeed := &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: current.RetentionInDays}
+	if current.RetentionInDays != nil && to.Int32(current.RetentionInDays) < options.changeFeedRetentionDays {
+		changeFeed.RetentionInDays = to.Int32Ptr(options.changeFeedRetentionDays)
+	}
+	return changeFeed
+}
+
+func mergeRestorePolicy(current *storage.RestorePolicyProperties, days int32) *storage.RestorePolicyProperties {
+	if current != nil && to.Bool(current.Enabled) && to.Int32(current.Days) >= days {
+		return &storage.RestorePolicyProperties{Enabled: to.BoolPtr(true), Days: current.Days}
+	}
+	if days == 0 {
+		return &storage.RestorePolicyProperties{Enabled: to.BoolPtr(false)}
+	}
+	return &storage.RestorePolicyProperties{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(days)}
+}
+
+func dataProtectionEqual(current, desired *storage.BlobServicePropertiesProperties) bool {
+	retentionEqual := func(a, b *storage.DeleteRetentionPolicy) bool {
+		if a == nil || !to.Bool(a.Enabled) {
+			return !to.Bool(b.Enabled)
+		}
+		return to.Bool(b.Enabled) && to.Int32(a.Days) == to.Int32(b.Days)
+	}
+	changeFeedEqual := current.ChangeFeed != nil && to.Bool(current.ChangeFeed.Enabled) == to.Bool(desired.ChangeFeed.Enabled) &&
+		to.Int32(current.ChangeFeed.RetentionInDays) == to.Int32(desired.ChangeFeed.RetentionInDays) ||
+		current.ChangeFeed == nil && !to.Bool(desired.ChangeFeed.Enabled)
+	restoreEqual := current.RestorePolicy != nil && to.Bool(current.RestorePolicy.Enabled) == to.Bool(desired.RestorePolicy.Enabled) &&
+		to.Int32(current.RestorePolicy.Days) == to.Int32(desired.RestorePolicy.Days) ||
+		current.RestorePolicy == nil && !to.Bool(desired.RestorePolicy.Enabled)
+
+	return retentionEqual(current.ContainerDeleteRetentionPolicy, desired.ContainerDeleteRetentionPolicy) &&
+		retentionEqual(current.DeleteRetentionPolicy, desired.DeleteRetentionPolicy) &&
+		to.Bool(current.IsVersioningEnabled) == to.Bool(desired.IsVersioningEnabled) &&
+		changeFeedEqual && restoreEqual
+}
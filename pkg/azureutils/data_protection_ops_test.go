@@ -0,0 +1,229 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParseDataProtectionOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *dataProtectionOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "no data protection",
+			parameters: map[string]string{"skuName": "Standard_LRS"},
+			expected:   &dataProtectionOptions{},
+		},
+		{
+			desc:       "soft delete and versioning",
+			parameters: map[string]string{"containerSoftDeleteDays": "7", "blobSoftDeleteDays": "14", "blobVersioning": "True"},
+			expected:   &dataProtectionOptions{containerSoftDeleteDays: 7, blobSoftDeleteDays: 14, versioning: true},
+		},
+		{
+			desc:       "change feed retention enables the change feed",
+			parameters: map[string]string{"changeFeedRetentionDays": "30"},
+			expected:   &dataProtectionOptions{changeFeed: true, changeFeedRetentionDays: 30},
+		},
+		{
+			desc:       "point in time restore enables versioning and the change feed",
+			parameters: map[string]string{"pointInTimeRestoreDays": "6", "blobSoftDeleteDays": "7"},
+			expected:   &dataProtectionOptions{blobSoftDeleteDays: 7, versioning: true, changeFeed: true, restoreDays: 6},
+		},
+		{
+			desc:       "point in time restore without longer soft delete",
+			parameters: map[string]string{"pointInTimeRestoreDays": "7", "blobSoftDeleteDays": "7"},
+			expectErr:  true,
+		},
+		{
+			desc:       "soft delete above the maximum",
+			parameters: map[string]string{"blobSoftDeleteDays": "366"},
+			expectErr:  true,
+		},
+		{
+			desc:       "zero days",
+			parameters: map[string]string{"containerSoftDeleteDays": "0"},
+			expectErr:  true,
+		},
+		{
+			desc:       "days that are not a number",
+			parameters: map[string]string{"containerSoftDeleteDays": "a week"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseDataProtectionOptions(test.parameters)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got options %+v", test.desc, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestMergeRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		desc     string
+		current  *storage.DeleteRetentionPolicy
+		days     int32
+		expected *storage.DeleteRetentionPolicy
+	}{
+		{
+			desc:     "not requested and not set",
+			expected: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(false)},
+		},
+		{
+			desc:     "enabled",
+			current:  &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(false)},
+			days:     7,
+			expected: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)},
+		},
+		{
+			desc:     "lengthened",
+			current:  &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)},
+			days:     14,
+			expected: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(14)},
+		},
+		{
+			desc:     "never shortened",
+			current:  &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(30)},
+			days:     7,
+			expected: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(30)},
+		},
+		{
+			desc:     "never disabled",
+			current:  &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(30)},
+			expected: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(30)},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeRetentionPolicy(test.current, test.days)
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, merged)
+		}
+	}
+}
+
+func TestMergeChangeFeed(t *testing.T) {
+	tests := []struct {
+		desc     string
+		current  *storage.ChangeFeed
+		options  *dataProtectionOptions
+		expected *storage.ChangeFeed
+	}{
+		{
+			desc:     "not requested and not set",
+			options:  &dataProtectionOptions{},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(false)},
+		},
+		{
+			desc:     "enabled without retention",
+			options:  &dataProtectionOptions{changeFeed: true},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(true)},
+		},
+		{
+			desc:     "enabled with retention",
+			current:  &storage.ChangeFeed{Enabled: to.BoolPtr(false)},
+			options:  &dataProtectionOptions{changeFeed: true, changeFeedRetentionDays: 30},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: to.Int32Ptr(30)},
+		},
+		{
+			desc:     "retention lengthened",
+			current:  &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: to.Int32Ptr(7)},
+			options:  &dataProtectionOptions{changeFeed: true, changeFeedRetentionDays: 30},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: to.Int32Ptr(30)},
+		},
+		{
+			desc:     "unlimited retention kept",
+			current:  &storage.ChangeFeed{Enabled: to.BoolPtr(true)},
+			options:  &dataProtectionOptions{changeFeed: true, changeFeedRetentionDays: 30},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(true)},
+		},
+		{
+			desc:     "never disabled",
+			current:  &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: to.Int32Ptr(7)},
+			options:  &dataProtectionOptions{},
+			expected: &storage.ChangeFeed{Enabled: to.BoolPtr(true), RetentionInDays: to.Int32Ptr(7)},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeChangeFeed(test.current, test.options)
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, merged)
+		}
+	}
+}
+
+func TestDataProtectionEqual(t *testing.T) {
+	desired := &storage.BlobServicePropertiesProperties{
+		ContainerDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)},
+		DeleteRetentionPolicy:          &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(false)},
+		IsVersioningEnabled:            to.BoolPtr(false),
+		ChangeFeed:                     &storage.ChangeFeed{Enabled: to.BoolPtr(false)},
+		RestorePolicy:                  &storage.RestorePolicyProperties{Enabled: to.BoolPtr(false)},
+	}
+
+	tests := []struct {
+		desc     string
+		current  *storage.BlobServicePropertiesProperties
+		expected bool
+	}{
+		{
+			desc: "unset properties match disabled settings",
+			current: &storage.BlobServicePropertiesProperties{
+				ContainerDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)},
+			},
+			expected: true,
+		},
+		{
+			desc: "other retention",
+			current: &storage.BlobServicePropertiesProperties{
+				ContainerDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(3)},
+			},
+			expected: false,
+		},
+		{
+			desc: "versioning enabled",
+			current: &storage.BlobServicePropertiesProperties{
+				ContainerDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: to.BoolPtr(true), Days: to.Int32Ptr(7)},
+				IsVersioningEnabled:            to.BoolPtr(true),
+			},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		if equal := dataProtectionEqual(test.current, desired); equal != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.expected, equal)
+		}
+	}
+}
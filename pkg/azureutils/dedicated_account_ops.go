@@ -0,0 +1,183 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// parseIsolationMode checks whether every bucket of the class gets its own storage account. Dedicated accounts are
+// named by the driver, so the mode can not be combined with a named account or a pool.
+func parseIsolationMode(parameters map[string]string, storageAccount string) (bool, error) {
+	mode := IsolationModeShared
+	pooled := false
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case IsolationModeField:
+			mode = strings.ToLower(strings.TrimSpace(val))
+		case StorageAccountPoolField:
+			pooled = true
+		}
+	}
+
+	switch mode {
+	case IsolationModeShared:
+		return false, nil
+	case IsolationModeDedicated:
+		if pooled {
+			return false, fmt.Errorf("%s %s can not be combined with %s", IsolationModeField, IsolationModeDedicated, StorageAccountPoolField)
+		}
+		if storageAccount != "" {
+			return false, fmt.Errorf("%s %s can not be combined with storage account %s", IsolationModeField, IsolationModeDedicated, storageAccount)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid %s '%s', supported values are %s and %s", IsolationModeField, mode, IsolationModeShared, IsolationModeDedicated)
+	}
+}
+
+// ensureDedicatedAccount returns the storage account dedicated to the bucket, creating it if needed. Its name is the
+// first name of the bucket's naming scheme that is either free or already dedicated to the bucket, so that a retried
+// create finds the account again. Names taken by accounts of others are skipped.
+func (c *StorageManagementClient) ensureDedicatedAccount(
+	ctx context.Context,
+	bucketName string,
+	options *azure.AccountOptions,
+	defaultLocation string) (string, error) {
+	for attempt := 0; attempt < maxDedicatedAccountNameAttempts; attempt++ {
+		name := c.getDedicatedAccountName(bucketName, attempt)
+
+		account, err := c.accounts.GetProperties(ctx, c.resourceGroup, name, "")
+		if err == nil {
+			if account.Tags != nil && to.String(account.Tags[DedicatedBucketTagKey]) == bucketName {
+				klog.Infof("Storage account %s is dedicated to bucket %s", name, bucketName)
+				return name, nil
+			}
+			continue
+		}
+		if account.Response.Response == nil || account.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("Error getting properties of storage account %s : %v", name, err)
+		}
+
+		result, err := c.accounts.CheckNameAvailability(ctx, storage.AccountCheckNameAvailabilityParameters{
+			Name: to.StringPtr(name),
+			Type: to.StringPtr("Microsoft.Storage/storageAccounts"),
+		})
+		if err != nil {
+			return "", fmt.Errorf("Error checking availability of storage account name %s : %v", name, err)
+		}
+		if !to.Bool(result.NameAvailable) {
+			klog.Infof("Storage account name %s for bucket %s is not available : %s", name, bucketName, to.String(result.Message))
+			continue
+		}
+
+		if err := c.createDedicatedAccount(ctx, name, bucketName, options, defaultLocation); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+
+	return "", fmt.Errorf("No storage account name is available for bucket %s after %d attempts", bucketName, maxDedicatedAccountNameAttempts)
+}
+
+// createDedicatedAccount creates the storage account with the settings the cloud provider gives the accounts it
+// creates, since EnsureStorageAccount only creates accounts with generated names
+func (c *StorageManagementClient) createDedicatedAccount(
+	ctx context.Context,
+	name string,
+	bucketName string,
+	options *azure.AccountOptions,
+	defaultLocation string) error {
+	kind := consts.DefaultStorageAccountKind
+	if options.Kind != "" {
+		kind = storage.Kind(options.Kind)
+	}
+	location := options.Location
+	if location == "" {
+		location = defaultLocation
+	}
+
+	tags := map[string]string{}
+	for key, val := range options.Tags {
+		tags[key] = val
+	}
+	tags[DedicatedBucketTagKey] = bucketName
+	tags[OwnerTagKey] = OwnerTagValue
+
+	var networkRuleSet *storage.NetworkRuleSet
+	if len(options.VirtualNetworkResourceIDs) > 0 {
+		rules := []storage.VirtualNetworkRule{}
+		for i := range options.VirtualNetworkResourceIDs {
+			rules = append(rules, storage.VirtualNetworkRule{
+				VirtualNetworkResourceID: &options.VirtualNetworkResourceIDs[i],
+				Action:                   storage.ActionAllow,
+			})
+		}
+		networkRuleSet = &storage.NetworkRuleSet{VirtualNetworkRules: &rules, DefaultAction: storage.DefaultActionDeny}
+	}
+
+	parameters := storage.AccountCreateParameters{
+		Sku:      &storage.Sku{Name: storage.SkuName(options.Type)},
+		Kind:     kind,
+		Location: to.StringPtr(location),
+		Tags:     convertMapToMapPointer(tags),
+		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{
+			EnableHTTPSTrafficOnly: to.BoolPtr(options.EnableHTTPSTrafficOnly),
+			NetworkRuleSet:         networkRuleSet,
+			IsHnsEnabled:           options.IsHnsEnabled,
+			EnableNfsV3:            options.EnableNfsV3,
+			MinimumTLSVersion:      storage.MinimumTLSVersionTLS12,
+		},
+	}
+	if options.EnableLargeFileShare {
+		parameters.LargeFileSharesState = storage.LargeFileSharesStateEnabled
+	}
+
+	klog.Infof("Creating storage account %s dedicated to bucket %s in location %s", name, bucketName, location)
+	future, err := c.accounts.Create(ctx, c.resourceGroup, name, parameters)
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, c.accounts.Client)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating storage account %s for bucket %s : %v", name, bucketName, err)
+	}
+
+	return nil
+}
+
+// deleteDedicatedAccount deletes the storage account dedicated to the bucket of the container. Accounts that retain
+// the soft deleted container of the bucket, which could not be restored without the account, are kept until it is purged.
+func (c *StorageManagementClient) deleteDedicatedAccount(ctx context.Context, account *storage.Account, containerName string) error {
+	klog.Infof("Cleaning up storage account %s dedicated to bucket %s", to.String(account.Name), containerName)
+	return c.deleteStorageAccountOnceEmpty(ctx, account)
+}
+
+// getDedicatedAccountName derives a storage account name from the bucket name and the resource group, so that
+// clusters with buckets of the same name do not compete for it. Later attempts yield other names.
+func (c *StorageManagementClient) getDedicatedAccountName(bucketName string, attempt int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%d", c.subscriptionID, c.resourceGroup, bucketName, attempt)))
+	name := dedicatedAccountNamePrefix + hex.EncodeToString(hash[:])
+	return name[:consts.StorageAccountNameMaxLength]
+}
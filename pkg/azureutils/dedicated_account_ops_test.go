@@ -0,0 +1,162 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestParseIsolationMode(t *testing.T) {
+	t.Run("shared by default", func(t *testing.T) {
+		dedicated, err := parseIsolationMode(map[string]string{}, "account")
+		if err != nil || dedicated {
+			t.Errorf("expected shared mode, got dedicated %v and error %v", dedicated, err)
+		}
+	})
+
+	t.Run("dedicated regardless of case", func(t *testing.T) {
+		dedicated, err := parseIsolationMode(map[string]string{"isolationMode": " Dedicated "}, "")
+		if err != nil || !dedicated {
+			t.Errorf("expected dedicated mode, got dedicated %v and error %v", dedicated, err)
+		}
+	})
+
+	t.Run("dedicated with a named account", func(t *testing.T) {
+		if _, err := parseIsolationMode(map[string]string{"isolationMode": "dedicated"}, "account"); err == nil {
+			t.Errorf("expected an error for a dedicated class naming a storage account")
+		}
+	})
+
+	t.Run("dedicated with a pool", func(t *testing.T) {
+		_, err := parseIsolationMode(map[string]string{"isolationMode": "dedicated", "storageAccountPool": "true"}, "")
+		if err == nil || !strings.Contains(err.Error(), StorageAccountPoolField) {
+			t.Errorf("expected an error naming %s, got %v", StorageAccountPoolField, err)
+		}
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		if _, err := parseIsolationMode(map[string]string{"isolationMode": "isolated"}, ""); err == nil {
+			t.Errorf("expected an error for an unknown mode")
+		}
+	})
+}
+
+func TestGetDedicatedAccountName(t *testing.T) {
+	client := &StorageManagementClient{subscriptionID: testSubscriptionID, resourceGroup: testResourceGroup}
+	other := &StorageManagementClient{subscriptionID: testSubscriptionID, resourceGroup: "other-rg"}
+
+	name := client.getDedicatedAccountName("bucket", 0)
+	if len(name) != 24 || !strings.HasPrefix(name, dedicatedAccountNamePrefix) || strings.ToLower(name) != name {
+		t.Errorf("expected a valid storage account name, got %s", name)
+	}
+	if again := client.getDedicatedAccountName("bucket", 0); again != name {
+		t.Errorf("expected retries to yield %s, got %s", name, again)
+	}
+	for desc, otherName := range map[string]string{
+		"next attempt":        client.getDedicatedAccountName("bucket", 1),
+		"other bucket":        client.getDedicatedAccountName("other", 0),
+		"other resourceGroup": other.getDedicatedAccountName("bucket", 0),
+	} {
+		if otherName == name {
+			t.Errorf("expected the %s to yield another name than %s", desc, name)
+		}
+	}
+}
+
+func TestEnsureDedicatedAccount(t *testing.T) {
+	names := &StorageManagementClient{subscriptionID: testSubscriptionID, resourceGroup: testResourceGroup}
+	taken := "Microsoft.Storage/storageAccounts/" + names.getDedicatedAccountName("bucket", 0)
+	unavailable := "Microsoft.Storage/storageAccounts/" + names.getDedicatedAccountName("bucket", 1)
+	dedicated := names.getDedicatedAccountName("bucket", 2)
+	checkName := "POST /subscriptions/" + testSubscriptionID + "/providers/Microsoft.Storage/checkNameAvailability"
+
+	client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+		switch call {
+		case "GET " + taken:
+			// an account of someone else, or of another bucket
+			return http.StatusOK, map[string]interface{}{"tags": map[string]string{DedicatedBucketTagKey: "other"}}
+		case "GET " + unavailable:
+			return http.StatusNotFound, armError("ResourceNotFound", "The storage account was not found")
+		case checkName:
+			return http.StatusOK, map[string]interface{}{"nameAvailable": false, "message": "The name is taken in another subscription"}
+		case "GET Microsoft.Storage/storageAccounts/" + dedicated:
+			return http.StatusOK, map[string]interface{}{"tags": map[string]string{DedicatedBucketTagKey: "bucket"}}
+		}
+		t.Errorf("unexpected call %s", call)
+		return http.StatusBadRequest, nil
+	})
+
+	name, err := client.ensureDedicatedAccount(context.TODO(), "bucket", &azure.AccountOptions{}, "westeurope")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if name != dedicated {
+		t.Errorf("expected the account %s found on the third attempt, got %s", dedicated, name)
+	}
+	expected := []string{"GET " + taken, "GET " + unavailable, checkName, "GET Microsoft.Storage/storageAccounts/" + dedicated}
+	if calls := arm.getCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestDeleteDedicatedAccount(t *testing.T) {
+	tags := map[string]string{DedicatedBucketTagKey: "bucket", OwnerTagKey: OwnerTagValue}
+
+	t.Run("retaining the deleted bucket", func(t *testing.T) {
+		accounts := map[string]*testAccount{"account": {tags: tags, deletedContainers: []string{"bucket"}}}
+		client, _ := newTestStorageManagementClient(t, newTestAccountHandler(t, accounts))
+
+		account := &storage.Account{Name: to.StringPtr("account"), Tags: convertMapToMapPointer(tags)}
+		if err := client.deleteDedicatedAccount(context.TODO(), account, "bucket"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		kept, ok := accounts["account"]
+		if !ok {
+			t.Fatalf("expected the account to be kept for the deleted bucket")
+		}
+		if _, ok := kept.tags[RetainedAccountTagKey]; !ok {
+			t.Errorf("expected the account to be tagged %s for the sweep, got %v", RetainedAccountTagKey, kept.tags)
+		}
+
+		// the sweep deletes the account once Azure purged the container
+		kept.deletedContainers = nil
+		if err := client.SweepRetainedStorageAccounts(context.TODO()); err != nil {
+			t.Fatalf("unexpected error sweeping %v", err)
+		}
+		if _, ok := accounts["account"]; ok {
+			t.Errorf("expected the sweep to delete the account")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		accounts := map[string]*testAccount{"account": {tags: tags}}
+		client, _ := newTestStorageManagementClient(t, newTestAccountHandler(t, accounts))
+
+		account := &storage.Account{Name: to.StringPtr("account"), Tags: convertMapToMapPointer(tags)}
+		if err := client.deleteDedicatedAccount(context.TODO(), account, "bucket"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, ok := accounts["account"]; ok {
+			t.Errorf("expected the account to be deleted")
+		}
+	})
+}
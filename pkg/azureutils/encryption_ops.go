@@ -0,0 +1,177 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var (
+	// userAssignedIdentityRE matches the ARM resource id of a user-assigned managed identity
+	userAssignedIdentityRE = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.ManagedIdentity/userAssignedIdentities/[^/]+$`)
+)
+
+// customerManagedKeyOptions select the Key Vault key that encrypts the storage account, and the
+// user-assigned identity the account reads the key with
+type customerManagedKeyOptions struct {
+	keyVaultURI string
+	keyName     string
+	// keyVersion pins the key version, without it the account follows the latest version of the key
+	keyVersion string
+	identity   string
+}
+
+func parseCustomerManagedKeyOptions(parameters map[string]string) (*customerManagedKeyOptions, error) {
+	var options *customerManagedKeyOptions
+	get := func() *customerManagedKeyOptions {
+		if options == nil {
+			options = &customerManagedKeyOptions{}
+		}
+		return options
+	}
+
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case KeyVaultURIField:
+			get().keyVaultURI = strings.TrimSpace(val)
+		case KeyVaultKeyNameField:
+			get().keyName = strings.TrimSpace(val)
+		case KeyVaultKeyVersionField:
+			get().keyVersion = strings.TrimSpace(val)
+		case UserAssignedIdentityField:
+			get().identity = strings.TrimSpace(val)
+		}
+	}
+
+	if options == nil {
+		return nil, nil
+	}
+
+	if options.keyVaultURI == "" || options.keyName == "" || options.identity == "" {
+		return nil, fmt.Errorf("Customer-managed key encryption requires %s, %s and %s", KeyVaultURIField, KeyVaultKeyNameField, UserAssignedIdentityField)
+	}
+	uri, err := url.Parse(options.keyVaultURI)
+	if err != nil || uri.Scheme != "https" || uri.Host == "" || strings.Trim(uri.Path, "/") != "" {
+		return nil, fmt.Errorf("Invalid %s '%s', expected the https URI of a key vault", KeyVaultURIField, options.keyVaultURI)
+	}
+	if !userAssignedIdentityRE.MatchString(options.identity) {
+		return nil, fmt.Errorf("Invalid %s '%s', expected the resource id of a user-assigned managed identity", UserAssignedIdentityField, options.identity)
+	}
+
+	return options, nil
+}
+
+// applyCustomerManagedKey assigns the identity to the storage account and encrypts the account with the Key Vault key.
+// Storage accounts already encrypted with another key are not switched over, since other buckets rely on that key.
+// It returns status errors, FailedPrecondition when the key is in use or the identity can not reach the key.
+func (c *StorageManagementClient) applyCustomerManagedKey(ctx context.Context, storageAccount string, options *customerManagedKeyOptions) error {
+	if options == nil {
+		return nil
+	}
+
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return status.Error(codes.Unknown, fmt.Sprintf("Error getting properties of storage account %s : %v", storageAccount, err))
+	}
+
+	if account.AccountProperties != nil && account.Encryption != nil && account.Encryption.KeySource == storage.KeySourceMicrosoftKeyvault {
+		current := account.Encryption.KeyVaultProperties
+		if current != nil && (!sameKeyVault(to.String(current.KeyVaultURI), options.keyVaultURI) || !strings.EqualFold(to.String(current.KeyName), options.keyName)) {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s is encrypted with key %s of key vault %s, it can not be switched to key %s of key vault %s",
+				storageAccount, to.String(current.KeyName), to.String(current.KeyVaultURI), options.keyName, options.keyVaultURI))
+		}
+		currentIdentity := ""
+		if account.Encryption.EncryptionIdentity != nil {
+			currentIdentity = to.String(account.Encryption.EncryptionIdentity.EncryptionUserAssignedIdentity)
+		}
+		if current != nil && strings.EqualFold(to.String(current.KeyVersion), options.keyVersion) && strings.EqualFold(currentIdentity, options.identity) {
+			return nil
+		}
+	}
+
+	klog.Infof("Encrypting storage account %s with key %s of key vault %s", storageAccount, options.keyName, options.keyVaultURI)
+	_, err = c.accounts.Update(ctx, c.resourceGroup, storageAccount, storage.AccountUpdateParameters{
+		Identity: withUserAssignedIdentity(account.Identity, options.identity),
+		AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
+			Encryption: &storage.Encryption{
+				KeySource: storage.KeySourceMicrosoftKeyvault,
+				KeyVaultProperties: &storage.KeyVaultProperties{
+					KeyVaultURI: to.StringPtr(options.keyVaultURI),
+					KeyName:     to.StringPtr(options.keyName),
+					KeyVersion:  to.StringPtr(options.keyVersion),
+				},
+				EncryptionIdentity: &storage.EncryptionIdentity{
+					EncryptionUserAssignedIdentity: to.StringPtr(options.identity),
+				},
+			},
+		},
+	})
+	if err != nil {
+		if code, message, ok := getServiceError(err); ok && strings.Contains(strings.ToLower(code+message), "keyvault") {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Identity %s can not use key %s of key vault %s to encrypt storage account %s, check that the key exists and the identity has get, wrapKey and unwrapKey permissions on it : %s: %s",
+				options.identity, options.keyName, options.keyVaultURI, storageAccount, code, message))
+		}
+		return status.Error(codes.Unknown, fmt.Sprintf("Error setting customer-managed key encryption of storage account %s : %v", storageAccount, err))
+	}
+
+	return nil
+}
+
+// withUserAssignedIdentity adds the user-assigned identity to the identities the storage account already has
+func withUserAssignedIdentity(current *storage.Identity, identity string) *storage.Identity {
+	result := &storage.Identity{
+		Type:                   storage.IdentityTypeUserAssigned,
+		UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{identity: {}},
+	}
+	if current == nil {
+		return result
+	}
+
+	if current.Type == storage.IdentityTypeSystemAssigned || current.Type == storage.IdentityTypeSystemAssignedUserAssigned {
+		result.Type = storage.IdentityTypeSystemAssignedUserAssigned
+	}
+	for id := range current.UserAssignedIdentities {
+		if !strings.EqualFold(id, identity) {
+			result.UserAssignedIdentities[id] = &storage.UserAssignedIdentity{}
+		}
+	}
+	return result
+}
+
+func sameKeyVault(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/"))
+}
+
+// getServiceError returns the code and message of the error returned by an ARM operation
+func getServiceError(err error) (string, string, bool) {
+	if derr, ok := err.(autorest.DetailedError); ok {
+		err = derr.Original
+	}
+	if rerr, ok := err.(*azure.RequestError); ok && rerr.ServiceError != nil {
+		return rerr.ServiceError.Code, rerr.ServiceError.Message, true
+	}
+	return "", "", false
+}
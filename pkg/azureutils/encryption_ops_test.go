@@ -0,0 +1,239 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testKeyVaultURI = "https://vault.vault.azure.net"
+	testIdentity    = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/cosi"
+)
+
+func TestParseCustomerManagedKeyOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *customerManagedKeyOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "encryption of the platform",
+			parameters: map[string]string{"skuName": "Standard_LRS"},
+		},
+		{
+			desc: "key following its latest version",
+			parameters: map[string]string{
+				"keyVaultURI":          testKeyVaultURI + "/",
+				"keyVaultKeyName":      " cosi ",
+				"UserAssignedIdentity": testIdentity,
+			},
+			expected: &customerManagedKeyOptions{keyVaultURI: testKeyVaultURI + "/", keyName: "cosi", identity: testIdentity},
+		},
+		{
+			desc: "key with a pinned version",
+			parameters: map[string]string{
+				"keyVaultURI":          testKeyVaultURI,
+				"keyVaultKeyName":      "cosi",
+				"keyVaultKeyVersion":   "0123456789abcdef",
+				"userAssignedIdentity": testIdentity,
+			},
+			expected: &customerManagedKeyOptions{keyVaultURI: testKeyVaultURI, keyName: "cosi", keyVersion: "0123456789abcdef", identity: testIdentity},
+		},
+		{
+			desc:       "missing identity",
+			parameters: map[string]string{"keyVaultURI": testKeyVaultURI, "keyVaultKeyName": "cosi"},
+			expectErr:  true,
+		},
+		{
+			desc:       "key version alone",
+			parameters: map[string]string{"keyVaultKeyVersion": "0123456789abcdef"},
+			expectErr:  true,
+		},
+		{
+			desc:       "key vault over http",
+			parameters: map[string]string{"keyVaultURI": "http://vault.vault.azure.net", "keyVaultKeyName": "cosi", "userAssignedIdentity": testIdentity},
+			expectErr:  true,
+		},
+		{
+			desc:       "key URI instead of key vault URI",
+			parameters: map[string]string{"keyVaultURI": testKeyVaultURI + "/keys/cosi", "keyVaultKeyName": "cosi", "userAssignedIdentity": testIdentity},
+			expectErr:  true,
+		},
+		{
+			desc:       "system-assigned identity",
+			parameters: map[string]string{"keyVaultURI": testKeyVaultURI, "keyVaultKeyName": "cosi", "userAssignedIdentity": "SystemAssigned"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseCustomerManagedKeyOptions(test.parameters)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.desc, test.expectErr, err)
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected options %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestWithUserAssignedIdentity(t *testing.T) {
+	other := "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/other"
+
+	tests := []struct {
+		desc     string
+		current  *storage.Identity
+		expected *storage.Identity
+	}{
+		{
+			desc: "account without identity",
+			expected: &storage.Identity{
+				Type:                   storage.IdentityTypeUserAssigned,
+				UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{testIdentity: {}},
+			},
+		},
+		{
+			desc:    "account with a system-assigned identity",
+			current: &storage.Identity{Type: storage.IdentityTypeSystemAssigned},
+			expected: &storage.Identity{
+				Type:                   storage.IdentityTypeSystemAssignedUserAssigned,
+				UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{testIdentity: {}},
+			},
+		},
+		{
+			desc: "account with other user-assigned identities",
+			current: &storage.Identity{
+				Type:                   storage.IdentityTypeUserAssigned,
+				UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{other: {PrincipalID: to.StringPtr(testPrincipalId)}},
+			},
+			expected: &storage.Identity{
+				Type:                   storage.IdentityTypeUserAssigned,
+				UserAssignedIdentities: map[string]*storage.UserAssignedIdentity{testIdentity: {}, other: {}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if identity := withUserAssignedIdentity(test.current, testIdentity); !reflect.DeepEqual(identity, test.expected) {
+			t.Errorf("%s: expected identity %+v, got %+v", test.desc, test.expected, identity)
+		}
+	}
+}
+
+func TestApplyCustomerManagedKey(t *testing.T) {
+	accountPath := "Microsoft.Storage/storageAccounts/account"
+	options := &customerManagedKeyOptions{keyVaultURI: testKeyVaultURI, keyName: "cosi", identity: testIdentity}
+
+	// the SDK leaves the read-only encryption of accounts out of their JSON, so the fake answers with plain maps
+	encryptedWith := func(keyVaultURI, keyName string) interface{} {
+		return map[string]interface{}{
+			"name": "account",
+			"properties": map[string]interface{}{
+				"encryption": map[string]interface{}{
+					"keySource":          storage.KeySourceMicrosoftKeyvault,
+					"keyvaultproperties": map[string]string{"keyvaulturi": keyVaultURI, "keyname": keyName},
+					"identity":           map[string]string{"userAssignedIdentity": testIdentity},
+				},
+			},
+		}
+	}
+
+	t.Run("account encrypted by the platform", func(t *testing.T) {
+		sent := storage.AccountUpdateParameters{}
+		client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			switch call {
+			case "GET " + accountPath:
+				return http.StatusOK, storage.Account{Name: to.StringPtr("account"), AccountProperties: &storage.AccountProperties{}}
+			case "PATCH " + accountPath:
+				if err := json.Unmarshal(body, &sent); err != nil {
+					t.Errorf("unexpected body %s of %s", body, call)
+				}
+				return http.StatusOK, storage.Account{Name: to.StringPtr("account")}
+			}
+			t.Errorf("unexpected call %s", call)
+			return http.StatusBadRequest, nil
+		})
+
+		if err := client.applyCustomerManagedKey(context.TODO(), "account", options); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if calls := arm.getCalls(); len(calls) != 2 {
+			t.Errorf("expected the account to be read and updated, got %v", calls)
+		}
+		if sent.AccountPropertiesUpdateParameters == nil || sent.Encryption == nil || sent.Identity == nil {
+			t.Fatalf("expected the encryption and identity of the account to be updated, got %+v", sent)
+		}
+		encryption := sent.Encryption
+		if encryption.KeySource != storage.KeySourceMicrosoftKeyvault || to.String(encryption.KeyVaultProperties.KeyName) != "cosi" ||
+			to.String(encryption.EncryptionIdentity.EncryptionUserAssignedIdentity) != testIdentity {
+			t.Errorf("expected encryption with key cosi read by %s, got %+v", testIdentity, encryption)
+		}
+		if _, ok := sent.Identity.UserAssignedIdentities[testIdentity]; !ok {
+			t.Errorf("expected identity %s to be assigned to the account, got %+v", testIdentity, sent.Identity)
+		}
+	})
+
+	t.Run("account already encrypted with the key", func(t *testing.T) {
+		client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			// a trailing slash or another case does not make it another key vault
+			return http.StatusOK, encryptedWith("HTTPS://vault.vault.azure.net/", "COSI")
+		})
+
+		if err := client.applyCustomerManagedKey(context.TODO(), "account", options); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if calls := arm.getCalls(); !reflect.DeepEqual(calls, []string{"GET " + accountPath}) {
+			t.Errorf("expected the account to be left as is, got %v", calls)
+		}
+	})
+
+	t.Run("account encrypted with another key", func(t *testing.T) {
+		client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			return http.StatusOK, encryptedWith(testKeyVaultURI, "other")
+		})
+
+		err := client.applyCustomerManagedKey(context.TODO(), "account", options)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected %v, got %v", codes.FailedPrecondition, err)
+		}
+		if calls := arm.getCalls(); len(calls) != 1 {
+			t.Errorf("expected the key of the account to be kept, got %v", calls)
+		}
+	})
+
+	t.Run("identity without access to the key", func(t *testing.T) {
+		client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			if call == "PATCH "+accountPath {
+				return http.StatusBadRequest, armError("KeyVaultAuthenticationFailure", "The operation failed because of authentication issue on the keyvault.")
+			}
+			return http.StatusOK, storage.Account{Name: to.StringPtr("account"), AccountProperties: &storage.AccountProperties{}}
+		})
+
+		err := client.applyCustomerManagedKey(context.TODO(), "account", options)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected %v, got %v", codes.FailedPrecondition, err)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// encryptionScopeOptions select how the encryption scope of a bucket is keyed
+type encryptionScopeOptions struct {
+	source storage.EncryptionScopeSource
+	// keyURI is the Key Vault key of scopes with the Microsoft.KeyVault source, with or without a version
+	keyURI string
+}
+
+func parseEncryptionScopeOptions(parameters map[string]string) (*encryptionScopeOptions, error) {
+	scope := ""
+	keyURI := ""
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case EncryptionScopeField:
+			scope = strings.ToLower(strings.TrimSpace(val))
+		case EncryptionScopeKeyURIField:
+			keyURI = strings.TrimSpace(val)
+		}
+	}
+
+	if scope == "" && keyURI != "" {
+		scope = EncryptionScopeKeyVault
+	}
+
+	switch scope {
+	case "":
+		return nil, nil
+	case EncryptionScopeMicrosoftManaged:
+		if keyURI != "" {
+			return nil, fmt.Errorf("%s is only supported with %s '%s'", EncryptionScopeKeyURIField, EncryptionScopeField, EncryptionScopeKeyVault)
+		}
+		return &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftStorage}, nil
+	case EncryptionScopeKeyVault:
+		uri, err := url.Parse(keyURI)
+		if err != nil || uri.Scheme != "https" || uri.Host == "" || !strings.HasPrefix(uri.Path, "/keys/") {
+			return nil, fmt.Errorf("Invalid %s '%s', expected the https URI of a key vault key", EncryptionScopeKeyURIField, keyURI)
+		}
+		return &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftKeyVault, keyURI: keyURI}, nil
+	default:
+		return nil, fmt.Errorf("Invalid %s '%s', supported values are %s and %s", EncryptionScopeField, scope, EncryptionScopeMicrosoftManaged, EncryptionScopeKeyVault)
+	}
+}
+
+// ensureEncryptionScope creates or updates the encryption scope and enables it again when a deleted bucket left it
+// disabled. Scopes backed by Key Vault use the identity of the storage account to read the key. It returns status
+// errors, FailedPrecondition when the storage account can not reach the key.
+func (c *StorageManagementClient) ensureEncryptionScope(ctx context.Context, storageAccount, scopeName string, options *encryptionScopeOptions) error {
+	properties := &storage.EncryptionScopeProperties{
+		Source: options.source,
+		State:  storage.EncryptionScopeStateEnabled,
+	}
+	if options.source == storage.EncryptionScopeSourceMicrosoftKeyVault {
+		properties.KeyVaultProperties = &storage.EncryptionScopeKeyVaultProperties{KeyURI: to.StringPtr(options.keyURI)}
+	}
+
+	klog.Infof("Ensuring encryption scope %s in storage account %s", scopeName, storageAccount)
+	_, err := c.encryptionScopes.Put(ctx, c.resourceGroup, storageAccount, scopeName, storage.EncryptionScope{
+		EncryptionScopeProperties: properties,
+	})
+	if err != nil {
+		if code, message, ok := getServiceError(err); ok && strings.Contains(strings.ToLower(code+message), "keyvault") {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s can not use key %s for encryption scope %s, check that the key exists and the identity of the account has get, wrapKey and unwrapKey permissions on it : %s: %s",
+				storageAccount, options.keyURI, scopeName, code, message))
+		}
+		return status.Error(codes.Unknown, fmt.Sprintf("Error creating encryption scope %s in storage account %s : %v", scopeName, storageAccount, err))
+	}
+
+	return nil
+}
+
+// disableEncryptionScope disables the encryption scope, since scopes can not be deleted. Missing and already
+// disabled scopes are ignored.
+func (c *StorageManagementClient) disableEncryptionScope(ctx context.Context, storageAccount, scopeName string) error {
+	current, err := c.encryptionScopes.Get(ctx, c.resourceGroup, storageAccount, scopeName)
+	if err != nil {
+		if current.Response.Response != nil && current.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("Error getting encryption scope %s in storage account %s : %v", scopeName, storageAccount, err)
+	}
+	if current.EncryptionScopeProperties != nil && current.State == storage.EncryptionScopeStateDisabled {
+		return nil
+	}
+
+	klog.Infof("Disabling encryption scope %s in storage account %s", scopeName, storageAccount)
+	scope, err := c.encryptionScopes.Patch(ctx, c.resourceGroup, storageAccount, scopeName, storage.EncryptionScope{
+		EncryptionScopeProperties: &storage.EncryptionScopeProperties{State: storage.EncryptionScopeStateDisabled},
+	})
+	if err != nil {
+		if scope.Response.Response != nil && scope.StatusCode == http.StatusNotFound {
+			klog.Infof("Encryption scope %s does not exist in storage account %s", scopeName, storageAccount)
+			return nil
+		}
+		return fmt.Errorf("Error disabling encryption scope %s in storage account %s : %v", scopeName, storageAccount, err)
+	}
+
+	return nil
+}
+
+// getContainerEncryptionScope returns the default encryption scope of the container, or an empty string
+// when the container does not exist or uses the encryption of the storage account
+func (c *StorageManagementClient) getContainerEncryptionScope(ctx context.Context, storageAccount, containerName string) (string, error) {
+	container, err := c.blobContainers.Get(ctx, c.resourceGroup, storageAccount, containerName)
+	if err != nil {
+		if container.Response.Response != nil && container.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("Error getting container %s in storage account %s : %v", containerName, storageAccount, err)
+	}
+
+	if container.ContainerProperties == nil {
+		return "", nil
+	}
+	return to.String(container.ContainerProperties.DefaultEncryptionScope), nil
+}
+
+// getEncryptionScopeName derives the encryption scope of a bucket from its container name, so that deleting the
+// bucket finds the scope without the container. The prefix keeps the scopes of the driver apart from others.
+func getEncryptionScopeName(containerName string) string {
+	hash := sha256.Sum256([]byte(containerName))
+	return encryptionScopePrefix + hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testKeyURI = "https://vault.vault.azure.net/keys/cosi"
+
+func TestParseEncryptionScopeOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *encryptionScopeOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "encryption of the storage account",
+			parameters: map[string]string{"skuName": "Standard_LRS"},
+		},
+		{
+			desc:       "key managed by Microsoft",
+			parameters: map[string]string{"EncryptionScope": " MicrosoftManaged "},
+			expected:   &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftStorage},
+		},
+		{
+			desc:       "key vault key",
+			parameters: map[string]string{"encryptionScope": "keyVault", "encryptionScopeKeyURI": testKeyURI},
+			expected:   &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftKeyVault, keyURI: testKeyURI},
+		},
+		{
+			desc:       "key vault implied by the key",
+			parameters: map[string]string{"encryptionScopeKeyURI": testKeyURI + "/0123456789abcdef"},
+			expected:   &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftKeyVault, keyURI: testKeyURI + "/0123456789abcdef"},
+		},
+		{
+			desc:       "key with a key managed by Microsoft",
+			parameters: map[string]string{"encryptionScope": "microsoftManaged", "encryptionScopeKeyURI": testKeyURI},
+			expectErr:  true,
+		},
+		{
+			desc:       "key vault without a key",
+			parameters: map[string]string{"encryptionScope": "keyVault"},
+			expectErr:  true,
+		},
+		{
+			desc:       "key vault instead of a key",
+			parameters: map[string]string{"encryptionScopeKeyURI": "https://vault.vault.azure.net"},
+			expectErr:  true,
+		},
+		{
+			desc:       "unknown source",
+			parameters: map[string]string{"encryptionScope": "customer"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseEncryptionScopeOptions(test.parameters)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.desc, test.expectErr, err)
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected options %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestGetEncryptionScopeName(t *testing.T) {
+	// encryption scope names are 3 to 63 alphanumeric characters
+	validName := regexp.MustCompile(`^cosi[a-z0-9]{32}$`)
+
+	name := getEncryptionScopeName("bucket")
+	if !validName.MatchString(name) {
+		t.Errorf("expected an alphanumeric name with the prefix of the driver, got %s", name)
+	}
+	if again := getEncryptionScopeName("bucket"); again != name {
+		t.Errorf("expected the same name for the same container, got %s and %s", name, again)
+	}
+	if other := getEncryptionScopeName("bucket-2"); other == name {
+		t.Errorf("expected another name for another container, got %s", other)
+	}
+}
+
+func TestEnsureEncryptionScope(t *testing.T) {
+	scopePath := "Microsoft.Storage/storageAccounts/account/encryptionScopes/" + getEncryptionScopeName("bucket")
+	options := &encryptionScopeOptions{source: storage.EncryptionScopeSourceMicrosoftKeyVault, keyURI: testKeyURI}
+
+	t.Run("scope created or enabled again", func(t *testing.T) {
+		sent := storage.EncryptionScope{}
+		client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			if call != "PUT "+scopePath {
+				t.Errorf("unexpected call %s", call)
+			}
+			if err := json.Unmarshal(body, &sent); err != nil {
+				t.Errorf("unexpected body %s of %s", body, call)
+			}
+			return http.StatusOK, sent
+		})
+
+		if err := client.ensureEncryptionScope(context.TODO(), "account", getEncryptionScopeName("bucket"), options); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if calls := arm.getCalls(); len(calls) != 1 {
+			t.Errorf("expected a single call, got %v", calls)
+		}
+		expected := &storage.EncryptionScopeProperties{
+			Source:             storage.EncryptionScopeSourceMicrosoftKeyVault,
+			State:              storage.EncryptionScopeStateEnabled,
+			KeyVaultProperties: &storage.EncryptionScopeKeyVaultProperties{KeyURI: to.StringPtr(testKeyURI)},
+		}
+		if !reflect.DeepEqual(sent.EncryptionScopeProperties, expected) {
+			t.Errorf("expected properties %+v, got %+v", expected, sent.EncryptionScopeProperties)
+		}
+	})
+
+	for desc, test := range map[string]struct {
+		code     string
+		expected codes.Code
+	}{
+		"key out of reach of the account": {code: "KeyVaultAuthenticationFailure", expected: codes.FailedPrecondition},
+		"other failure":                   {code: "InternalError", expected: codes.Unknown},
+	} {
+		t.Run(desc, func(t *testing.T) {
+			client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				return http.StatusBadRequest, armError(test.code, "The operation failed.")
+			})
+
+			err := client.ensureEncryptionScope(context.TODO(), "account", getEncryptionScopeName("bucket"), options)
+			if status.Code(err) != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestDisableEncryptionScope(t *testing.T) {
+	scopePath := "Microsoft.Storage/storageAccounts/account/encryptionScopes/" + getEncryptionScopeName("bucket")
+
+	tests := []struct {
+		desc          string
+		getCode       int
+		state         storage.EncryptionScopeState
+		expectedCalls []string
+		expectErr     bool
+	}{
+		{
+			desc:          "enabled scope",
+			getCode:       http.StatusOK,
+			state:         storage.EncryptionScopeStateEnabled,
+			expectedCalls: []string{"GET " + scopePath, "PATCH " + scopePath},
+		},
+		{
+			desc:          "scope disabled by an earlier deletion",
+			getCode:       http.StatusOK,
+			state:         storage.EncryptionScopeStateDisabled,
+			expectedCalls: []string{"GET " + scopePath},
+		},
+		{
+			desc:          "missing scope",
+			getCode:       http.StatusNotFound,
+			expectedCalls: []string{"GET " + scopePath},
+		},
+		{
+			desc:          "scope that can not be read",
+			getCode:       http.StatusForbidden,
+			expectedCalls: []string{"GET " + scopePath},
+			expectErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case "GET " + scopePath:
+					if test.getCode != http.StatusOK {
+						return test.getCode, armError("Error", http.StatusText(test.getCode))
+					}
+					return http.StatusOK, storage.EncryptionScope{EncryptionScopeProperties: &storage.EncryptionScopeProperties{State: test.state}}
+				case "PATCH " + scopePath:
+					sent := storage.EncryptionScope{}
+					if err := json.Unmarshal(body, &sent); err != nil || sent.EncryptionScopeProperties == nil || sent.State != storage.EncryptionScopeStateDisabled {
+						t.Errorf("expected the scope to be disabled, got %s", body)
+					}
+					return http.StatusOK, sent
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			err := client.disableEncryptionScope(context.TODO(), "account", getEncryptionScopeName("bucket"))
+			if test.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", test.expectErr, err)
+			}
+			if calls := arm.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestGetContainerEncryptionScope(t *testing.T) {
+	scope := getEncryptionScopeName("bucket")
+	client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+		switch call {
+		case "GET Microsoft.Storage/storageAccounts/account/blobServices/default/containers/bucket":
+			return http.StatusOK, map[string]interface{}{"name": "bucket", "properties": map[string]interface{}{"defaultEncryptionScope": scope}}
+		case "GET Microsoft.Storage/storageAccounts/account/blobServices/default/containers/plain":
+			return http.StatusOK, map[string]interface{}{"name": "plain", "properties": map[string]interface{}{}}
+		}
+		return http.StatusNotFound, armError("ContainerNotFound", "The specified container does not exist.")
+	})
+
+	for container, expected := range map[string]string{"bucket": scope, "plain": "", "deleted": ""} {
+		actual, err := client.getContainerEncryptionScope(context.TODO(), "account", container)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", container, err)
+		}
+		if actual != expected {
+			t.Errorf("%s: expected encryption scope '%s', got '%s'", container, expected, actual)
+		}
+	}
+}
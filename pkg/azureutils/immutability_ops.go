@@ -0,0 +1,278 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var (
+	// legalHoldTagRE matches the alphanumeric legal hold tags Azure accepts
+	legalHoldTagRE = regexp.MustCompile(`^[a-zA-Z0-9]{3,23}$`)
+)
+
+// immutabilityOptions are the WORM settings of a container
+type immutabilityOptions struct {
+	// periodDays is the retention of the time based immutability policy, zero for no policy
+	periodDays                 int32
+	allowProtectedAppendWrites bool
+	locked                     bool
+	legalHoldTags              []string
+}
+
+func parseImmutabilityOptions(parameters map[string]string) (*immutabilityOptions, error) {
+	options := &immutabilityOptions{}
+	appendWritesSet := false
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case ImmutabilityPeriodDaysField:
+			days, err := strconv.ParseInt(val, 10, 32)
+			if err != nil || days < 1 || days > MaxImmutabilityPeriodDays {
+				return nil, fmt.Errorf("Invalid %s '%s', the retention must be between 1 and %d days", ImmutabilityPeriodDaysField, val, MaxImmutabilityPeriodDays)
+			}
+			options.periodDays = int32(days)
+		case ImmutabilityAllowProtectedAppendWritesField:
+			options.allowProtectedAppendWrites = strings.EqualFold(val, TrueValue)
+			appendWritesSet = true
+		case ImmutabilityPolicyLockedField:
+			options.locked = strings.EqualFold(val, TrueValue)
+		case LegalHoldTagsField:
+			for _, tag := range strings.Split(val, TagsDelimiter) {
+				tag = strings.TrimSpace(tag)
+				if !legalHoldTagRE.MatchString(tag) {
+					return nil, fmt.Errorf("Invalid legal hold tag '%s' in %s, tags must be 3 to 23 alphanumeric characters", tag, LegalHoldTagsField)
+				}
+				options.legalHoldTags = append(options.legalHoldTags, tag)
+			}
+			if len(options.legalHoldTags) > MaxLegalHoldTags {
+				return nil, fmt.Errorf("Invalid %s '%s', at most %d legal hold tags are allowed", LegalHoldTagsField, val, MaxLegalHoldTags)
+			}
+		}
+	}
+
+	if options.periodDays == 0 && (appendWritesSet || options.locked) {
+		return nil, fmt.Errorf("%s and %s require %s", ImmutabilityAllowProtectedAppendWritesField, ImmutabilityPolicyLockedField, ImmutabilityPeriodDaysField)
+	}
+
+	return options, nil
+}
+
+// applyContainerImmutability sets the time based immutability policy and the legal hold of the container. The policy
+// is read first, so that repeating a create finds the policy it set before: a locked policy can no longer be shortened,
+// changed or removed, only extended. It returns status errors, FailedPrecondition when the class asks for a policy the
+// locked policy of the container can not be turned into.
+func (c *StorageManagementClient) applyContainerImmutability(
+	ctx context.Context,
+	storageAccount string,
+	containerName string,
+	options *immutabilityOptions) error {
+	if options.periodDays != 0 {
+		if err := c.applyImmutabilityPolicy(ctx, storageAccount, containerName, options); err != nil {
+			return err
+		}
+	}
+
+	if len(options.legalHoldTags) > 0 {
+		_, err := c.blobContainers.SetLegalHold(ctx, c.resourceGroup, storageAccount, containerName, storage.LegalHold{
+			Tags: &options.legalHoldTags,
+		})
+		if err != nil {
+			return status.Error(codes.Unknown, fmt.Sprintf("Error setting legal hold of container %s in storage account %s : %v", containerName, storageAccount, err))
+		}
+	}
+
+	return nil
+}
+
+func (c *StorageManagementClient) applyImmutabilityPolicy(ctx context.Context, storageAccount, containerName string, options *immutabilityOptions) error {
+	current, err := c.blobContainers.GetImmutabilityPolicy(ctx, c.resourceGroup, storageAccount, containerName, "")
+	if err != nil && (current.Response.Response == nil || current.StatusCode != http.StatusNotFound) {
+		return status.Error(codes.Unknown, fmt.Sprintf("Error getting immutability policy of container %s in storage account %s : %v", containerName, storageAccount, err))
+	}
+
+	var properties *storage.ImmutabilityPolicyProperty
+	if err == nil && current.ImmutabilityPolicyProperty != nil && to.Int32(current.ImmutabilityPeriodSinceCreationInDays) != 0 {
+		properties = current.ImmutabilityPolicyProperty
+	}
+	desired := &storage.ImmutabilityPolicy{
+		ImmutabilityPolicyProperty: &storage.ImmutabilityPolicyProperty{
+			ImmutabilityPeriodSinceCreationInDays: to.Int32Ptr(options.periodDays),
+			AllowProtectedAppendWrites:            to.BoolPtr(options.allowProtectedAppendWrites),
+		},
+	}
+
+	switch action, err := getImmutabilityPolicyAction(properties, options); {
+	case err != nil:
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Container %s in storage account %s : %v", containerName, storageAccount, err))
+	case action == immutabilityPolicyExtend:
+		klog.Infof("Extending locked immutability policy of container %s in storage account %s to %d days", containerName, storageAccount, options.periodDays)
+		if _, err := c.blobContainers.ExtendImmutabilityPolicy(ctx, c.resourceGroup, storageAccount, containerName, to.String(current.Etag), desired); err != nil {
+			return status.Error(codes.Unknown, fmt.Sprintf("Error extending immutability policy of container %s in storage account %s : %v", containerName, storageAccount, err))
+		}
+		return nil
+	case action == immutabilityPolicySet:
+		current, err = c.blobContainers.CreateOrUpdateImmutabilityPolicy(ctx, c.resourceGroup, storageAccount, containerName, desired, "")
+		if err != nil {
+			return status.Error(codes.Unknown, fmt.Sprintf("Error setting immutability policy of container %s in storage account %s : %v", containerName, storageAccount, err))
+		}
+	}
+
+	if options.locked && current.State != storage.ImmutabilityPolicyStateLocked {
+		klog.Infof("Locking immutability policy of container %s in storage account %s", containerName, storageAccount)
+		_, err = c.blobContainers.LockImmutabilityPolicy(ctx, c.resourceGroup, storageAccount, containerName, to.String(current.Etag))
+		if err != nil {
+			return status.Error(codes.Unknown, fmt.Sprintf("Error locking immutability policy of container %s in storage account %s : %v", containerName, storageAccount, err))
+		}
+	}
+
+	return nil
+}
+
+type immutabilityPolicyAction int
+
+const (
+	immutabilityPolicyKeep immutabilityPolicyAction = iota
+	immutabilityPolicySet
+	immutabilityPolicyExtend
+)
+
+// getImmutabilityPolicyAction decides how the current policy of a container, nil when it has none, becomes the policy
+// of the options. Unlocked policies are set as requested, locked ones can only be extended, and are kept when they
+// already retain blobs at least as long, for example when the class no longer asks for a locked policy.
+func getImmutabilityPolicyAction(current *storage.ImmutabilityPolicyProperty, options *immutabilityOptions) (immutabilityPolicyAction, error) {
+	if current == nil {
+		return immutabilityPolicySet, nil
+	}
+
+	days := to.Int32(current.ImmutabilityPeriodSinceCreationInDays)
+	appendWrites := to.Bool(current.AllowProtectedAppendWrites)
+	if current.State != storage.ImmutabilityPolicyStateLocked {
+		if days == options.periodDays && appendWrites == options.allowProtectedAppendWrites {
+			return immutabilityPolicyKeep, nil
+		}
+		return immutabilityPolicySet, nil
+	}
+
+	if appendWrites != options.allowProtectedAppendWrites {
+		return immutabilityPolicyKeep, fmt.Errorf("its locked immutability policy has %s %t, which can not be changed to %t",
+			ImmutabilityAllowProtectedAppendWritesField, appendWrites, options.allowProtectedAppendWrites)
+	}
+	if options.periodDays < days {
+		return immutabilityPolicyKeep, fmt.Errorf("its locked immutability policy retains blobs for %d days, which can not be shortened to the %d days of %s",
+			days, options.periodDays, ImmutabilityPeriodDaysField)
+	}
+	if options.periodDays > days {
+		return immutabilityPolicyExtend, nil
+	}
+	return immutabilityPolicyKeep, nil
+}
+
+// getContainerDeletionBlocker returns why the container can not be deleted, or an empty string when it can: when it has
+// no legal hold, and no locked time based immutability policy still retaining one of its blobs. Unlocked policies and
+// expired retention do not prevent deleting the container.
+func (c *StorageManagementClient) getContainerDeletionBlocker(ctx context.Context, storageAccount, containerName string) (string, error) {
+	container, err := c.blobContainers.Get(ctx, c.resourceGroup, storageAccount, containerName)
+	if err != nil {
+		if container.Response.Response != nil && container.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("Error getting container %s in storage account %s : %v", containerName, storageAccount, err)
+	}
+
+	properties := container.ContainerProperties
+	if properties == nil {
+		return "", nil
+	}
+
+	if to.Bool(properties.HasLegalHold) {
+		tags := []string{}
+		if properties.LegalHold != nil && properties.LegalHold.Tags != nil {
+			for _, tag := range *properties.LegalHold.Tags {
+				tags = append(tags, to.String(tag.Tag))
+			}
+		}
+		return fmt.Sprintf("it has a legal hold with tags %s", strings.Join(tags, ", ")), nil
+	}
+
+	if !to.Bool(properties.HasImmutabilityPolicy) || properties.ImmutabilityPolicy == nil || properties.ImmutabilityPolicy.ImmutabilityPolicyProperty == nil {
+		return "", nil
+	}
+	policy := properties.ImmutabilityPolicy.ImmutabilityPolicyProperty
+	if policy.State != storage.ImmutabilityPolicyStateLocked {
+		return "", nil
+	}
+
+	days := to.Int32(policy.ImmutabilityPeriodSinceCreationInDays)
+	retained, err := c.getRetainedBlob(ctx, storageAccount, containerName, days)
+	if err != nil {
+		return "", err
+	}
+	if retained != "" {
+		return fmt.Sprintf("its locked time based immutability policy retains blob %s for %d days after creation", retained, days), nil
+	}
+
+	return "", nil
+}
+
+// getRetainedBlob returns a blob of the container created less than the retention ago, or an empty string when the
+// retention of every blob has passed. Blobs of storage accounts without shared key access or behind a firewall can
+// not be listed by the driver, the deletion of their containers is left to fail with ContainerProtectedFromDeletion.
+func (c *StorageManagementClient) getRetainedBlob(ctx context.Context, storageAccount, containerName string, days int32) (string, error) {
+	useARM, err := c.useARMForContainers(ctx, storageAccount)
+	if err != nil {
+		return "", err
+	}
+	if useARM {
+		klog.Infof("Not checking the retention of blobs in container %s, storage account %s can not be reached with its account key", containerName, storageAccount)
+		return "", nil
+	}
+
+	accessKey, err := c.getAccountKey(ctx, storageAccount, AccountKey1)
+	if err != nil {
+		return "", err
+	}
+	containerURL, err := createContainerUrl(storageAccount, accessKey, containerName)
+	if err != nil {
+		return "", err
+	}
+
+	retainedSince := time.Now().UTC().AddDate(0, 0, -int(days))
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		segment, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{})
+		if err != nil {
+			return "", fmt.Errorf("Error listing blobs of container %s in storage account %s : %v", containerName, storageAccount, err)
+		}
+		for _, blob := range segment.Segment.BlobItems {
+			if blob.Properties.CreationTime == nil || blob.Properties.CreationTime.After(retainedSince) {
+				return blob.Name, nil
+			}
+		}
+		marker = segment.NextMarker
+	}
+
+	return "", nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testContainerPath = "Microsoft.Storage/storageAccounts/account/blobServices/default/containers/bucket"
+
+func TestParseImmutabilityOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *immutabilityOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "no immutability",
+			parameters: map[string]string{},
+			expected:   &immutabilityOptions{},
+		},
+		{
+			desc: "locked policy with append writes",
+			parameters: map[string]string{
+				"immutabilityPeriodDays":                 "365",
+				"immutabilityAllowProtectedAppendWrites": "true",
+				"immutabilityPolicyLocked":               "TRUE",
+			},
+			expected: &immutabilityOptions{periodDays: 365, allowProtectedAppendWrites: true, locked: true},
+		},
+		{
+			desc:       "legal hold tags",
+			parameters: map[string]string{"legalHoldTags": "case123, audit2021"},
+			expected:   &immutabilityOptions{legalHoldTags: []string{"case123", "audit2021"}},
+		},
+		{
+			desc:       "lock without a period",
+			parameters: map[string]string{"immutabilityPolicyLocked": "true"},
+			expectErr:  true,
+		},
+		{
+			desc:       "period above the maximum",
+			parameters: map[string]string{"immutabilityPeriodDays": "146001"},
+			expectErr:  true,
+		},
+		{
+			desc:       "legal hold tag with a dash",
+			parameters: map[string]string{"legalHoldTags": "case-123"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseImmutabilityOptions(test.parameters)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got options %+v", test.desc, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+// testImmutabilityPolicy is the ARM representation of an immutability policy, nil state for no policy
+func testImmutabilityPolicy(state storage.ImmutabilityPolicyState, days int32, appendWrites bool) map[string]interface{} {
+	return map[string]interface{}{
+		"etag": `"etag"`,
+		"properties": map[string]interface{}{
+			"immutabilityPeriodSinceCreationInDays": days,
+			"allowProtectedAppendWrites":            appendWrites,
+			"state":                                 state,
+		},
+	}
+}
+
+func TestApplyContainerImmutability(t *testing.T) {
+	policyPath := testContainerPath + "/immutabilityPolicies/default"
+
+	tests := []struct {
+		desc string
+		// current is the policy of the container, nil when it has none
+		current       map[string]interface{}
+		options       *immutabilityOptions
+		expectedCalls []string
+		// expectedDays is the retention sent with a PUT or extend
+		expectedDays int32
+		expectedCode codes.Code
+	}{
+		{
+			desc:          "new policy is set and locked",
+			options:       &immutabilityOptions{periodDays: 30, locked: true},
+			expectedCalls: []string{"GET " + policyPath, "PUT " + policyPath, "POST " + policyPath + "/lock"},
+			expectedDays:  30,
+		},
+		{
+			desc:          "matching locked policy is kept",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 30, locked: true},
+			expectedCalls: []string{"GET " + policyPath},
+		},
+		{
+			desc:          "locked policy is kept for an unlocked class",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 30},
+			expectedCalls: []string{"GET " + policyPath},
+		},
+		{
+			desc:          "locked policy is extended",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 90, locked: true},
+			expectedCalls: []string{"GET " + policyPath, "POST " + policyPath + "/extend"},
+			expectedDays:  90,
+		},
+		{
+			desc:          "locked policy can not be shortened",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 7, locked: true},
+			expectedCalls: []string{"GET " + policyPath},
+			expectedCode:  codes.FailedPrecondition,
+		},
+		{
+			desc:          "append writes of a locked policy can not be changed",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 30, allowProtectedAppendWrites: true},
+			expectedCalls: []string{"GET " + policyPath},
+			expectedCode:  codes.FailedPrecondition,
+		},
+		{
+			desc:          "unlocked policy is shortened",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateUnlocked, 30, false),
+			options:       &immutabilityOptions{periodDays: 7},
+			expectedCalls: []string{"GET " + policyPath, "PUT " + policyPath},
+			expectedDays:  7,
+		},
+		{
+			desc:          "matching unlocked policy is only locked",
+			current:       testImmutabilityPolicy(storage.ImmutabilityPolicyStateUnlocked, 30, true),
+			options:       &immutabilityOptions{periodDays: 30, allowProtectedAppendWrites: true, locked: true},
+			expectedCalls: []string{"GET " + policyPath, "POST " + policyPath + "/lock"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			sentDays := int32(0)
+			client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case "GET " + policyPath:
+					if test.current == nil {
+						return http.StatusNotFound, armError("ImmutabilityPolicyNotFound", "The container has no immutability policy")
+					}
+					return http.StatusOK, test.current
+				case "PUT " + policyPath, "POST " + policyPath + "/extend":
+					policy := storage.ImmutabilityPolicy{}
+					if err := json.Unmarshal(body, &policy); err != nil {
+						t.Errorf("unexpected body %s of %s", body, call)
+					}
+					sentDays = to.Int32(policy.ImmutabilityPeriodSinceCreationInDays)
+					return http.StatusOK, testImmutabilityPolicy(storage.ImmutabilityPolicyStateUnlocked, sentDays, false)
+				case "POST " + policyPath + "/lock":
+					return http.StatusOK, testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false)
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			err := client.applyContainerImmutability(context.TODO(), "account", "bucket", test.options)
+			if code := status.Code(err); code != test.expectedCode {
+				t.Errorf("expected code %v, got error %v", test.expectedCode, err)
+			}
+			if calls := arm.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+			if sentDays != test.expectedDays {
+				t.Errorf("expected a policy of %d days to be sent, got %d", test.expectedDays, sentDays)
+			}
+		})
+	}
+}
+
+func TestGetContainerDeletionBlocker(t *testing.T) {
+	tests := []struct {
+		desc       string
+		properties map[string]interface{}
+		blocked    bool
+	}{
+		{
+			desc:       "no protection",
+			properties: map[string]interface{}{},
+		},
+		{
+			desc: "legal hold",
+			properties: map[string]interface{}{
+				"hasLegalHold": true,
+				"legalHold":    map[string]interface{}{"hasLegalHold": true, "tags": []interface{}{map[string]interface{}{"tag": "case123"}}},
+			},
+			blocked: true,
+		},
+		{
+			desc: "unlocked policy",
+			properties: map[string]interface{}{
+				"hasImmutabilityPolicy": true,
+				"immutabilityPolicy":    testImmutabilityPolicy(storage.ImmutabilityPolicyStateUnlocked, 30, false),
+			},
+		},
+		{
+			// the blobs of accounts behind a firewall can not be listed, Azure refuses the delete if they are retained
+			desc: "locked policy on an account behind a firewall",
+			properties: map[string]interface{}{
+				"hasImmutabilityPolicy": true,
+				"immutabilityPolicy":    testImmutabilityPolicy(storage.ImmutabilityPolicyStateLocked, 30, false),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case "GET " + testContainerPath:
+					return http.StatusOK, map[string]interface{}{"name": "bucket", "properties": test.properties}
+				case "GET Microsoft.Storage/storageAccounts/account":
+					return http.StatusOK, map[string]interface{}{"properties": map[string]interface{}{"networkAcls": map[string]interface{}{"defaultAction": "Deny"}}}
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			blocker, err := client.getContainerDeletionBlocker(context.TODO(), "account", "bucket")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if (blocker != "") != test.blocked {
+				t.Errorf("expected blocked %v, got '%s'", test.blocked, blocker)
+			}
+			if test.blocked && !strings.Contains(blocker, "case123") {
+				t.Errorf("expected the legal hold tags in '%s'", blocker)
+			}
+		})
+	}
+}
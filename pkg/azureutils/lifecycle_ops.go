@@ -0,0 +1,231 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+// lifecycleOptions are the tiering and expiry actions of the lifecycle rule of a bucket, zero days skip the action
+type lifecycleOptions struct {
+	tierToCoolAfterDays    int32
+	tierToArchiveAfterDays int32
+	deleteAfterDays        int32
+	// prefix narrows the rule to blobs below the prefix within the container
+	prefix        string
+	blobIndexTags map[string]string
+}
+
+func (o *lifecycleOptions) isEmpty() bool {
+	return o.tierToCoolAfterDays == 0 && o.tierToArchiveAfterDays == 0 && o.deleteAfterDays == 0
+}
+
+func parseLifecycleOptions(parameters map[string]string) (*lifecycleOptions, error) {
+	options := &lifecycleOptions{}
+	filtered := false
+	for key, val := range parameters {
+		var err error
+		switch strings.ToLower(key) {
+		case TierToCoolAfterDaysField:
+			options.tierToCoolAfterDays, err = parseDays(key, val, MaxLifecycleDays)
+		case TierToArchiveAfterDaysField:
+			options.tierToArchiveAfterDays, err = parseDays(key, val, MaxLifecycleDays)
+		case DeleteAfterDaysField:
+			options.deleteAfterDays, err = parseDays(key, val, MaxLifecycleDays)
+		case LifecyclePrefixField:
+			options.prefix = strings.TrimPrefix(strings.TrimSpace(val), "/")
+			filtered = true
+		case LifecycleBlobIndexTagsField:
+			options.blobIndexTags, err = convertTagsToMap(val)
+			if err == nil && len(options.blobIndexTags) > MaxBlobIndexTagFilters {
+				err = fmt.Errorf("Invalid %s '%s', at most %d blob index tags are allowed", LifecycleBlobIndexTagsField, val, MaxBlobIndexTagFilters)
+			}
+			filtered = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.isEmpty() {
+		if filtered {
+			return nil, fmt.Errorf("%s and %s require at least one of %s, %s and %s", LifecyclePrefixField, LifecycleBlobIndexTagsField,
+				TierToCoolAfterDaysField, TierToArchiveAfterDaysField, DeleteAfterDaysField)
+		}
+		return options, nil
+	}
+
+	// Blobs move to colder tiers before they expire, so every later action must come after the earlier ones
+	if options.tierToCoolAfterDays != 0 && options.tierToArchiveAfterDays != 0 && options.tierToArchiveAfterDays <= options.tierToCoolAfterDays {
+		return nil, fmt.Errorf("%s must be greater than %s", TierToArchiveAfterDaysField, TierToCoolAfterDaysField)
+	}
+	if options.deleteAfterDays != 0 &&
+		(options.deleteAfterDays <= options.tierToCoolAfterDays || options.deleteAfterDays <= options.tierToArchiveAfterDays) {
+		return nil, fmt.Errorf("%s must be greater than %s and %s", DeleteAfterDaysField, TierToCoolAfterDaysField, TierToArchiveAfterDaysField)
+	}
+
+	return options, nil
+}
+
+// applyLifecycleRule adds or replaces the lifecycle rule of the container in the management policy of the storage
+// account. The rule only matches blobs of the container, so the rules of other buckets sharing the account are kept.
+func (c *StorageManagementClient) applyLifecycleRule(ctx context.Context, storageAccount, containerName string, options *lifecycleOptions) error {
+	if options.isEmpty() {
+		return nil
+	}
+
+	c.managementPoliciesLock.Lock()
+	defer c.managementPoliciesLock.Unlock()
+
+	rules, err := c.getLifecycleRules(ctx, storageAccount)
+	if err != nil {
+		return err
+	}
+
+	name := getLifecycleRuleName(containerName)
+	rules = removeLifecycleRule(rules, name)
+	rules = append(rules, newLifecycleRule(name, containerName, options))
+
+	klog.Infof("Setting lifecycle rule %s for container %s in storage account %s", name, containerName, storageAccount)
+	return c.setLifecycleRules(ctx, storageAccount, rules)
+}
+
+// removeContainerLifecycleRule removes the lifecycle rule of the container from the management policy of the
+// storage account, and the policy itself with its last rule. Containers without a rule are ignored.
+func (c *StorageManagementClient) removeContainerLifecycleRule(ctx context.Context, storageAccount, containerName string) error {
+	c.managementPoliciesLock.Lock()
+	defer c.managementPoliciesLock.Unlock()
+
+	rules, err := c.getLifecycleRules(ctx, storageAccount)
+	if err != nil {
+		return err
+	}
+
+	name := getLifecycleRuleName(containerName)
+	remaining := removeLifecycleRule(rules, name)
+	if len(remaining) == len(rules) {
+		return nil
+	}
+
+	klog.Infof("Removing lifecycle rule %s of container %s in storage account %s", name, containerName, storageAccount)
+	if len(remaining) == 0 {
+		_, err := c.managementPolicies.Delete(ctx, c.resourceGroup, storageAccount)
+		if err != nil {
+			return fmt.Errorf("Error deleting lifecycle management policy of storage account %s : %v", storageAccount, err)
+		}
+		return nil
+	}
+
+	return c.setLifecycleRules(ctx, storageAccount, remaining)
+}
+
+// getLifecycleRules returns the rules of the management policy of the storage account, none when it has no policy
+func (c *StorageManagementClient) getLifecycleRules(ctx context.Context, storageAccount string) ([]storage.ManagementPolicyRule, error) {
+	policy, err := c.managementPolicies.Get(ctx, c.resourceGroup, storageAccount)
+	if err != nil {
+		if policy.Response.Response != nil && policy.StatusCode == http.StatusNotFound {
+			return []storage.ManagementPolicyRule{}, nil
+		}
+		return nil, fmt.Errorf("Error getting lifecycle management policy of storage account %s : %v", storageAccount, err)
+	}
+
+	if policy.ManagementPolicyProperties == nil || policy.Policy == nil || policy.Policy.Rules == nil {
+		return []storage.ManagementPolicyRule{}, nil
+	}
+	return *policy.Policy.Rules, nil
+}
+
+func (c *StorageManagementClient) setLifecycleRules(ctx context.Context, storageAccount string, rules []storage.ManagementPolicyRule) error {
+	_, err := c.managementPolicies.CreateOrUpdate(ctx, c.resourceGroup, storageAccount, storage.ManagementPolicy{
+		ManagementPolicyProperties: &storage.ManagementPolicyProperties{
+			Policy: &storage.ManagementPolicySchema{Rules: &rules},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting lifecycle management policy of storage account %s : %v", storageAccount, err)
+	}
+
+	return nil
+}
+
+func newLifecycleRule(name, containerName string, options *lifecycleOptions) storage.ManagementPolicyRule {
+	daysAfterModification := func(days int32) *storage.DateAfterModification {
+		if days == 0 {
+			return nil
+		}
+		return &storage.DateAfterModification{DaysAfterModificationGreaterThan: to.Float64Ptr(float64(days))}
+	}
+
+	filters := &storage.ManagementPolicyFilter{
+		PrefixMatch: &[]string{containerName + "/" + options.prefix},
+		BlobTypes:   &[]string{"blockBlob"},
+	}
+	if len(options.blobIndexTags) > 0 {
+		// Sorted, so that applying the same class twice yields the same rule
+		names := make([]string, 0, len(options.blobIndexTags))
+		for name := range options.blobIndexTags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		tags := []storage.TagFilter{}
+		for _, name := range names {
+			tags = append(tags, storage.TagFilter{Name: to.StringPtr(name), Op: to.StringPtr("=="), Value: to.StringPtr(options.blobIndexTags[name])})
+		}
+		filters.BlobIndexMatch = &tags
+	}
+
+	return storage.ManagementPolicyRule{
+		Enabled: to.BoolPtr(true),
+		Name:    to.StringPtr(name),
+		Type:    to.StringPtr("Lifecycle"),
+		Definition: &storage.ManagementPolicyDefinition{
+			Actions: &storage.ManagementPolicyAction{
+				BaseBlob: &storage.ManagementPolicyBaseBlob{
+					TierToCool:    daysAfterModification(options.tierToCoolAfterDays),
+					TierToArchive: daysAfterModification(options.tierToArchiveAfterDays),
+					Delete:        daysAfterModification(options.deleteAfterDays),
+				},
+			},
+			Filters: filters,
+		},
+	}
+}
+
+func removeLifecycleRule(rules []storage.ManagementPolicyRule, name string) []storage.ManagementPolicyRule {
+	remaining := []storage.ManagementPolicyRule{}
+	for _, rule := range rules {
+		if to.String(rule.Name) != name {
+			remaining = append(remaining, rule)
+		}
+	}
+	return remaining
+}
+
+// getLifecycleRuleName derives the rule of a container from its name, so that it can be found again on delete.
+// Rule names must be alphanumeric, so the container name is hashed rather than used as is.
+func getLifecycleRuleName(containerName string) string {
+	hash := sha256.Sum256([]byte(containerName))
+	return lifecycleRulePrefix + hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParseLifecycleOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *lifecycleOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "no lifecycle rule",
+			parameters: map[string]string{"skuName": "Standard_LRS"},
+			expected:   &lifecycleOptions{},
+		},
+		{
+			desc:       "tiering and expiry",
+			parameters: map[string]string{"tierToCoolAfterDays": "30", "tierToArchiveAfterDays": "90", "deleteAfterDays": "365"},
+			expected:   &lifecycleOptions{tierToCoolAfterDays: 30, tierToArchiveAfterDays: 90, deleteAfterDays: 365},
+		},
+		{
+			desc:       "filters",
+			parameters: map[string]string{"deleteAfterDays": "7", "lifecyclePrefix": "/logs/", "lifecycleBlobIndexTags": "class=temp"},
+			expected:   &lifecycleOptions{deleteAfterDays: 7, prefix: "logs/", blobIndexTags: map[string]string{"class": "temp"}},
+		},
+		{
+			desc:       "filters without actions",
+			parameters: map[string]string{"lifecyclePrefix": "logs/"},
+			expectErr:  true,
+		},
+		{
+			desc:       "archive before cool",
+			parameters: map[string]string{"tierToCoolAfterDays": "90", "tierToArchiveAfterDays": "30"},
+			expectErr:  true,
+		},
+		{
+			desc:       "delete before archive",
+			parameters: map[string]string{"tierToArchiveAfterDays": "90", "deleteAfterDays": "90"},
+			expectErr:  true,
+		},
+		{
+			desc:       "days above the maximum",
+			parameters: map[string]string{"deleteAfterDays": "100000"},
+			expectErr:  true,
+		},
+		{
+			desc: "too many blob index tags",
+			parameters: map[string]string{"deleteAfterDays": "7",
+				"lifecycleBlobIndexTags": "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11"},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseLifecycleOptions(test.parameters)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got options %+v", test.desc, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestNewLifecycleRule(t *testing.T) {
+	rule := newLifecycleRule("cosirule", "bucket", &lifecycleOptions{
+		tierToArchiveAfterDays: 30,
+		prefix:                 "logs/",
+		blobIndexTags:          map[string]string{"tier": "archive", "class": "temp"},
+	})
+
+	if to.String(rule.Name) != "cosirule" || !to.Bool(rule.Enabled) {
+		t.Errorf("expected enabled rule cosirule, got %s enabled %v", to.String(rule.Name), to.Bool(rule.Enabled))
+	}
+	if prefixes := *rule.Definition.Filters.PrefixMatch; !reflect.DeepEqual(prefixes, []string{"bucket/logs/"}) {
+		t.Errorf("expected the rule to match bucket/logs/, got %v", prefixes)
+	}
+
+	tags := []string{}
+	for _, tag := range *rule.Definition.Filters.BlobIndexMatch {
+		tags = append(tags, to.String(tag.Name)+to.String(tag.Op)+to.String(tag.Value))
+	}
+	if !reflect.DeepEqual(tags, []string{"class==temp", "tier==archive"}) {
+		t.Errorf("expected sorted blob index tag filters, got %v", tags)
+	}
+
+	baseBlob := rule.Definition.Actions.BaseBlob
+	if baseBlob.TierToCool != nil || baseBlob.Delete != nil {
+		t.Errorf("expected only the archive action, got cool %v and delete %v", baseBlob.TierToCool, baseBlob.Delete)
+	}
+	if baseBlob.TierToArchive == nil || to.Float64(baseBlob.TierToArchive.DaysAfterModificationGreaterThan) != 30 {
+		t.Errorf("expected archive after 30 days, got %v", baseBlob.TierToArchive)
+	}
+}
+
+func TestRemoveLifecycleRule(t *testing.T) {
+	rules := []storage.ManagementPolicyRule{
+		{Name: to.StringPtr("other")},
+		{Name: to.StringPtr(getLifecycleRuleName("bucket"))},
+		{Name: to.StringPtr(getLifecycleRuleName("bucket2"))},
+	}
+
+	remaining := removeLifecycleRule(rules, getLifecycleRuleName("bucket"))
+	names := []string{}
+	for _, rule := range remaining {
+		names = append(names, to.String(rule.Name))
+	}
+	if !reflect.DeepEqual(names, []string{"other", getLifecycleRuleName("bucket2")}) {
+		t.Errorf("expected the rules of other buckets to be kept, got %v", names)
+	}
+
+	if remaining := removeLifecycleRule(rules, getLifecycleRuleName("missing")); len(remaining) != len(rules) {
+		t.Errorf("expected removing a missing rule to keep all %d rules, got %d", len(rules), len(remaining))
+	}
+}
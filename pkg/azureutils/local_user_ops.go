@@ -0,0 +1,149 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+)
+
+// Local users and SFTP are not part of the vendored storage SDK, so they are managed through plain ARM requests
+type sftpAccountUpdate struct {
+	Properties sftpAccountProperties `json:"properties"`
+}
+
+type sftpAccountProperties struct {
+	IsSftpEnabled *bool `json:"isSftpEnabled"`
+}
+
+type localUser struct {
+	Properties localUserProperties `json:"properties"`
+}
+
+type localUserProperties struct {
+	PermissionScopes  []localUserPermissionScope `json:"permissionScopes"`
+	HomeDirectory     string                     `json:"homeDirectory"`
+	SSHAuthorizedKeys []localUserSSHKey          `json:"sshAuthorizedKeys,omitempty"`
+	HasSSHPassword    *bool                      `json:"hasSshPassword"`
+	HasSSHKey         *bool                      `json:"hasSshKey"`
+}
+
+type localUserPermissionScope struct {
+	Permissions  string `json:"permissions"`
+	Service      string `json:"service"`
+	ResourceName string `json:"resourceName"`
+}
+
+type localUserSSHKey struct {
+	Description string `json:"description,omitempty"`
+	Key         string `json:"key"`
+}
+
+type localUserPassword struct {
+	SSHPassword string `json:"sshPassword"`
+}
+
+// isHNSEnabled checks whether the storage account has a hierarchical namespace, which SFTP requires
+func (c *StorageManagementClient) isHNSEnabled(ctx context.Context, storageAccount string) (bool, error) {
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return false, fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	return account.AccountProperties != nil && to.Bool(account.AccountProperties.IsHnsEnabled), nil
+}
+
+// enableSftp turns on the SFTP endpoint of the storage account, enabling it again is a no-op
+func (c *StorageManagementClient) enableSftp(ctx context.Context, storageAccount string) error {
+	_, err := c.sendARMRequest(ctx, http.MethodPatch, c.getStorageAccountPath(storageAccount), localUsersAPIVersion,
+		sftpAccountUpdate{Properties: sftpAccountProperties{IsSftpEnabled: to.BoolPtr(true)}}, nil,
+		http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return fmt.Errorf("Error enabling SFTP on storage account %s : %v", storageAccount, err)
+	}
+
+	return nil
+}
+
+// createLocalUser creates or updates the local user with the container as home directory and the only permission scope.
+// With an authorized key the user logs in with that key, otherwise a password is generated and returned.
+func (c *StorageManagementClient) createLocalUser(
+	ctx context.Context,
+	storageAccount string,
+	username string,
+	containerName string,
+	permissions string,
+	authorizedKey string) (string, error) {
+	user := localUser{
+		Properties: localUserProperties{
+			PermissionScopes: []localUserPermissionScope{{
+				Permissions:  permissions,
+				Service:      "blob",
+				ResourceName: containerName,
+			}},
+			HomeDirectory:  containerName,
+			HasSSHPassword: to.BoolPtr(authorizedKey == ""),
+			HasSSHKey:      to.BoolPtr(authorizedKey != ""),
+		},
+	}
+	if authorizedKey != "" {
+		user.Properties.SSHAuthorizedKeys = []localUserSSHKey{{Key: authorizedKey}}
+	}
+
+	path := c.getLocalUserPath(storageAccount, username)
+	_, err := c.sendARMRequest(ctx, http.MethodPut, path, localUsersAPIVersion, user, nil, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("Error creating local user %s on storage account %s : %v", username, storageAccount, err)
+	}
+
+	if authorizedKey != "" {
+		return "", nil
+	}
+
+	password := localUserPassword{}
+	_, err = c.sendARMRequest(ctx, http.MethodPost, path+"/regeneratePassword", localUsersAPIVersion, nil, &password, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("Error generating password of local user %s on storage account %s : %v", username, storageAccount, err)
+	}
+
+	return password.SSHPassword, nil
+}
+
+// deleteLocalUser deletes the local user, missing users are ignored
+func (c *StorageManagementClient) deleteLocalUser(ctx context.Context, storageAccount, username string) error {
+	resp, err := c.sendARMRequest(ctx, http.MethodDelete, c.getLocalUserPath(storageAccount, username), localUsersAPIVersion, nil, nil,
+		http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			klog.Infof("Local user %s does not exist on storage account %s", username, storageAccount)
+			return nil
+		}
+		return fmt.Errorf("Error deleting local user %s on storage account %s : %v", username, storageAccount, err)
+	}
+
+	return nil
+}
+
+func (c *StorageManagementClient) getLocalUserPath(storageAccount, username string) string {
+	return fmt.Sprintf("%s/localUsers/%s", c.getStorageAccountPath(storageAccount), username)
+}
+
+// getLocalUserName derives the local user of a grant from the account id, so that it can be found again on revoke
+func getLocalUserName(accountId string) string {
+	return localUserPrefix + accountId
+}
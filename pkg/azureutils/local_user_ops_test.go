@@ -0,0 +1,119 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestCreateLocalUser(t *testing.T) {
+	userPath := "Microsoft.Storage/storageAccounts/account/localUsers/" + getLocalUserName(testAccountId)
+
+	tests := []struct {
+		desc             string
+		authorizedKey    string
+		expectedPassword string
+		expectedCalls    []string
+	}{
+		{
+			desc:          "user logging in with a key",
+			authorizedKey: "ssh-rsa AAAAB3NzaC1yc2E",
+			expectedCalls: []string{"PUT " + userPath},
+		},
+		{
+			desc:             "user logging in with a generated password",
+			expectedPassword: "generated",
+			expectedCalls:    []string{"PUT " + userPath, "POST " + userPath + "/regeneratePassword"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			sent := localUser{}
+			client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case "PUT " + userPath:
+					if err := json.Unmarshal(body, &sent); err != nil {
+						t.Errorf("unexpected body %s of %s", body, call)
+					}
+					return http.StatusOK, sent
+				case "POST " + userPath + "/regeneratePassword":
+					return http.StatusOK, localUserPassword{SSHPassword: "generated"}
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			password, err := client.createLocalUser(context.TODO(), "account", getLocalUserName(testAccountId), "bucket", "rl", test.authorizedKey)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if password != test.expectedPassword {
+				t.Errorf("expected password '%s', got '%s'", test.expectedPassword, password)
+			}
+			if calls := arm.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+
+			// the user is confined to the container
+			expectedScopes := []localUserPermissionScope{{Permissions: "rl", Service: "blob", ResourceName: "bucket"}}
+			if !reflect.DeepEqual(sent.Properties.PermissionScopes, expectedScopes) || sent.Properties.HomeDirectory != "bucket" {
+				t.Errorf("expected scopes %+v and home directory bucket, got %+v", expectedScopes, sent.Properties)
+			}
+			withKey := test.authorizedKey != ""
+			if to.Bool(sent.Properties.HasSSHKey) != withKey || to.Bool(sent.Properties.HasSSHPassword) == withKey {
+				t.Errorf("expected key login %v, got %+v", withKey, sent.Properties)
+			}
+			if withKey && (len(sent.Properties.SSHAuthorizedKeys) != 1 || sent.Properties.SSHAuthorizedKeys[0].Key != test.authorizedKey) {
+				t.Errorf("expected authorized key %s, got %+v", test.authorizedKey, sent.Properties.SSHAuthorizedKeys)
+			}
+		})
+	}
+}
+
+func TestDeleteLocalUser(t *testing.T) {
+	userPath := "Microsoft.Storage/storageAccounts/account/localUsers/" + getLocalUserName(testAccountId)
+
+	for desc, test := range map[string]struct {
+		code      int
+		expectErr bool
+	}{
+		"deleted":       {code: http.StatusOK},
+		"already gone":  {code: http.StatusNotFound},
+		"service error": {code: http.StatusForbidden, expectErr: true},
+	} {
+		t.Run(desc, func(t *testing.T) {
+			client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				if call != "DELETE "+userPath {
+					t.Errorf("unexpected call %s", call)
+				}
+				if test.code != http.StatusOK {
+					return test.code, armError("Error", http.StatusText(test.code))
+				}
+				return test.code, nil
+			})
+
+			err := client.deleteLocalUser(context.TODO(), "account", getLocalUserName(testAccountId))
+			if test.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", test.expectErr, err)
+			}
+		})
+	}
+}
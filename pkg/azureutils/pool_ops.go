@@ -0,0 +1,445 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+var (
+	// poolNameRE matches the pool names, which are stored as tag values of the storage accounts
+	poolNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// storagePoolOptions place the buckets of a class in a pool of storage accounts instead of one named account
+type storagePoolOptions struct {
+	name          string
+	maxContainers int
+	// settings is the hash of the account settings of the class that are applied after the account is created
+	settings string
+}
+
+// parseStoragePoolOptions returns nil when the bucket class names a storage account and no pool, since the bucket
+// then goes to that account. Without an account name the bucket goes to the default pool.
+func parseStoragePoolOptions(parameters map[string]string, storageAccount string) (*storagePoolOptions, error) {
+	options := &storagePoolOptions{maxContainers: DefaultMaxContainersPerAccount}
+	for key, val := range parameters {
+		switch strings.ToLower(key) {
+		case StorageAccountPoolField:
+			options.name = strings.ToLower(strings.TrimSpace(val))
+			if !poolNameRE.MatchString(options.name) {
+				return nil, fmt.Errorf("Invalid %s '%s', pool names must be 1 to 63 lowercase letters, digits and hyphens", StorageAccountPoolField, val)
+			}
+		case MaxContainersPerAccountField:
+			max, err := strconv.Atoi(strings.TrimSpace(val))
+			if err != nil || max < 1 {
+				return nil, fmt.Errorf("Invalid %s '%s', the value must be a positive number", MaxContainersPerAccountField, val)
+			}
+			options.maxContainers = max
+		}
+	}
+
+	if options.name == "" {
+		if storageAccount != "" {
+			return nil, nil
+		}
+		options.name = DefaultStorageAccountPool
+	}
+
+	return options, nil
+}
+
+// selectPoolAccount picks the storage account of the pool that matches the account options and holds the fewest
+// containers, so that buckets spread across the accounts of the pool. Accounts at the container cap are skipped, and
+// an account already holding the container is picked again, so that a retried create does not place it twice. It
+// returns an empty name when the pool has no account with room left. Callers hold the pool lock and reserve the
+// container in the picked account before releasing it, so that concurrent creates count each other's containers.
+// Accounts being cleaned up are skipped.
+func (c *StorageManagementClient) selectPoolAccount(
+	ctx context.Context,
+	accountOptions *azure.AccountOptions,
+	pool *storagePoolOptions,
+	defaultLocation string,
+	containerName string) (string, error) {
+	iter, err := c.accounts.ListByResourceGroupComplete(ctx, c.resourceGroup)
+	if err != nil {
+		return "", fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+	}
+
+	selected := ""
+	selectedCount := pool.maxContainers
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return "", fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+		}
+
+		account := iter.Value()
+		if account.Tags == nil || to.String(account.Tags[PoolTagKey]) != pool.name || to.String(account.Tags[PoolSettingsTagKey]) != pool.settings ||
+			!isPoolAccountMatching(account, accountOptions, defaultLocation) {
+			continue
+		}
+
+		name := to.String(account.Name)
+		if c.removingAccounts[name] {
+			continue
+		}
+		count, found, err := c.countContainers(ctx, name, containerName, c.pendingContainers[name])
+		if err != nil {
+			return "", err
+		}
+		if found {
+			klog.Infof("Container %s already exists in storage account %s of pool %s", containerName, name, pool.name)
+			return name, nil
+		}
+		if count < selectedCount {
+			selected, selectedCount = name, count
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+	}
+
+	if selected != "" {
+		klog.Infof("Placing container %s in storage account %s of pool %s, which holds %d of at most %d containers", containerName, selected, pool.name, selectedCount, pool.maxContainers)
+	}
+	return selected, nil
+}
+
+// countContainers returns the number of containers in the storage account, including the pending ones that are
+// still being created, and whether the container is one of them
+func (c *StorageManagementClient) countContainers(ctx context.Context, storageAccount, containerName string, pending map[string]bool) (int, bool, error) {
+	iter, err := c.blobContainers.ListComplete(ctx, c.resourceGroup, storageAccount, "", "", "")
+	count := 0
+	found := pending[containerName]
+	listedPending := 0
+	for ; err == nil && iter.NotDone(); err = iter.NextWithContext(ctx) {
+		name := to.String(iter.Value().Name)
+		count++
+		found = found || name == containerName
+		if pending[name] {
+			listedPending++
+		}
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Error listing containers of storage account %s : %v", storageAccount, err)
+	}
+
+	return count + len(pending) - listedPending, found, nil
+}
+
+// placePooledBucket picks the storage account of the pool for the container and reserves the container in it. When
+// no account has room left, one create of the pool creates a new account while the others wait for it and place
+// their containers in it. The pool lock is only held while picking and reserving, not for the creation of the account
+// or the container. The returned function releases the reservation and is called once the create is done.
+func placePooledBucket(
+	ctx context.Context,
+	clients *BucketClients,
+	options *azure.AccountOptions,
+	pool *storagePoolOptions,
+	containerName string) (func(), error) {
+	c := clients.StorageManagement
+	key := pool.name + "/" + pool.settings
+	for {
+		c.poolLock.Lock()
+		name, err := c.selectPoolAccount(ctx, options, pool, clients.Cloud.Location, containerName)
+		if err != nil {
+			c.poolLock.Unlock()
+			return nil, status.Error(codes.Unknown, err.Error())
+		}
+		if name != "" {
+			options.Name = name
+			release := c.reserveContainerLocked(name, containerName)
+			c.poolLock.Unlock()
+			return release, nil
+		}
+
+		if creating, ok := c.poolCreations[key]; ok {
+			c.poolLock.Unlock()
+			select {
+			case <-creating:
+				continue
+			case <-ctx.Done():
+				return nil, status.Error(codes.DeadlineExceeded, fmt.Sprintf("Timed out waiting for a new storage account of pool %s", pool.name))
+			}
+		}
+		created := make(chan struct{})
+		c.poolCreations[key] = created
+		c.poolLock.Unlock()
+
+		// No account of the pool has room left, EnsureStorageAccount creates a new one with a generated name
+		if options.Tags == nil {
+			options.Tags = make(map[string]string)
+		}
+		options.Tags[PoolTagKey] = pool.name
+		options.Tags[PoolSettingsTagKey] = pool.settings
+		options.Tags[OwnerTagKey] = OwnerTagValue
+		klog.Infof("Creating a storage account for pool %s", pool.name)
+		name, _, err = clients.Cloud.EnsureStorageAccount(options, poolAccountNamePrefix)
+
+		c.poolLock.Lock()
+		delete(c.poolCreations, key)
+		close(created)
+		if err != nil {
+			c.poolLock.Unlock()
+			return nil, status.Error(codes.Unknown, fmt.Sprintf("Error creating storage account for pool %s : %v", pool.name, err))
+		}
+		options.Name = name
+		release := c.reserveContainerLocked(name, containerName)
+		c.poolLock.Unlock()
+		return release, nil
+	}
+}
+
+// reserveContainer records that the container is being created in the storage account, so that the account is not
+// cleaned up as empty meanwhile. It fails with Unavailable while the account is being cleaned up.
+func (c *StorageManagementClient) reserveContainer(storageAccount, containerName string) (func(), error) {
+	c.poolLock.Lock()
+	defer c.poolLock.Unlock()
+
+	if c.removingAccounts[storageAccount] {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("Storage account %s is being cleaned up after its last bucket was deleted, retry later", storageAccount))
+	}
+	return c.reserveContainerLocked(storageAccount, containerName), nil
+}
+
+// reserveContainerLocked records the pending container, callers hold the pool lock
+func (c *StorageManagementClient) reserveContainerLocked(storageAccount, containerName string) func() {
+	if c.pendingContainers[storageAccount] == nil {
+		c.pendingContainers[storageAccount] = make(map[string]bool)
+	}
+	c.pendingContainers[storageAccount][containerName] = true
+
+	return func() {
+		c.poolLock.Lock()
+		defer c.poolLock.Unlock()
+		delete(c.pendingContainers[storageAccount], containerName)
+		if len(c.pendingContainers[storageAccount]) == 0 {
+			delete(c.pendingContainers, storageAccount)
+		}
+	}
+}
+
+// cleanUpEmptyStorageAccount removes what the driver created for the storage account once its last container is
+// gone: its blob private endpoints, the account itself when it is dedicated to the bucket of the container, and with
+// deleteOwned any account the driver created. Accounts with containers being created are left alone, and the account
+// is marked while it is cleaned up, so that creates neither pick it nor lose their endpoint or account to the cleanup.
+func (c *StorageManagementClient) cleanUpEmptyStorageAccount(ctx context.Context, storageAccount, containerName string, deleteOwned bool) error {
+	c.poolLock.Lock()
+	if c.removingAccounts[storageAccount] {
+		c.poolLock.Unlock()
+		// The other cleanup may have started before the container of this bucket was gone
+		return status.Error(codes.Unavailable, fmt.Sprintf("Storage account %s is being cleaned up by another bucket delete, retry later", storageAccount))
+	}
+	if len(c.pendingContainers[storageAccount]) > 0 {
+		c.poolLock.Unlock()
+		klog.Infof("Not cleaning up storage account %s, buckets are being created in it", storageAccount)
+		return nil
+	}
+	c.removingAccounts[storageAccount] = true
+	c.poolLock.Unlock()
+
+	defer func() {
+		c.poolLock.Lock()
+		delete(c.removingAccounts, storageAccount)
+		c.poolLock.Unlock()
+	}()
+
+	// The tags of the account tell what the driver created for it
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		if account.Response.Response != nil && account.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	if err := c.removeUnusedPrivateEndpoint(ctx, &account); err != nil {
+		return err
+	}
+
+	// Accounts dedicated to the bucket go with it, the tag set at creation tells them apart from shared accounts
+	if bucket, ok := account.Tags[DedicatedBucketTagKey]; ok && to.String(bucket) == containerName {
+		return c.deleteDedicatedAccount(ctx, &account, containerName)
+	}
+
+	if deleteOwned {
+		return c.deleteEmptyStorageAccount(ctx, &account)
+	}
+	return nil
+}
+
+// deleteEmptyStorageAccount deletes the storage account once its last container is gone, when the driver created it.
+// Accounts retaining soft deleted containers are kept, so that the containers can still be restored.
+func (c *StorageManagementClient) deleteEmptyStorageAccount(ctx context.Context, account *storage.Account) error {
+	if account.Tags == nil || to.String(account.Tags[OwnerTagKey]) != OwnerTagValue {
+		return nil
+	}
+
+	return c.deleteStorageAccountOnceEmpty(ctx, account)
+}
+
+// deleteStorageAccountOnceEmpty deletes the storage account when it holds no containers. An account retaining soft
+// deleted containers is kept and tagged, so that SweepRetainedStorageAccounts deletes it once the containers are purged.
+// Accounts that took buckets again lose the tag.
+func (c *StorageManagementClient) deleteStorageAccountOnceEmpty(ctx context.Context, account *storage.Account) error {
+	storageAccount := to.String(account.Name)
+	_, retained := account.Tags[RetainedAccountTagKey]
+
+	empty, err := c.isStorageAccountEmpty(ctx, storageAccount, true)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		onlyDeleted, err := c.isStorageAccountEmpty(ctx, storageAccount, false)
+		if err != nil {
+			return err
+		}
+		if !onlyDeleted {
+			klog.Infof("Keeping storage account %s, it still holds containers", storageAccount)
+			if retained {
+				return c.setStorageAccountTag(ctx, storageAccount, RetainedAccountTagKey, "")
+			}
+			return nil
+		}
+
+		klog.Infof("Keeping storage account %s until its soft deleted containers are purged", storageAccount)
+		if retained {
+			return nil
+		}
+		return c.setStorageAccountTag(ctx, storageAccount, RetainedAccountTagKey, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	klog.Infof("Deleting storage account %s, its last bucket is gone", storageAccount)
+	if _, err := c.accounts.Delete(ctx, c.resourceGroup, storageAccount); err != nil {
+		return fmt.Errorf("Error deleting storage account %s : %v", storageAccount, err)
+	}
+
+	return nil
+}
+
+// SweepRetainedStorageAccounts deletes the storage accounts the driver kept for their soft deleted containers once
+// the containers are purged, which Azure does when their retention lapsed. The accounts are cleaned up as after
+// their last bucket was deleted, so that creates placing buckets in them at the same time keep them.
+func (c *StorageManagementClient) SweepRetainedStorageAccounts(ctx context.Context) error {
+	iter, err := c.accounts.ListByResourceGroupComplete(ctx, c.resourceGroup)
+	if err != nil {
+		return fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+	}
+
+	retained := []string{}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+		}
+		account := iter.Value()
+		if _, ok := account.Tags[RetainedAccountTagKey]; ok && to.String(account.Tags[OwnerTagKey]) == OwnerTagValue {
+			retained = append(retained, to.String(account.Name))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error listing storage accounts of resource group %s : %v", c.resourceGroup, err)
+	}
+
+	var lastErr error
+	for _, storageAccount := range retained {
+		if err := c.cleanUpEmptyStorageAccount(ctx, storageAccount, "", true); err != nil {
+			klog.Warningf("Error cleaning up retained storage account %s : %v", storageAccount, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// isPoolAccountMatching checks the settings the storage account was created with against the account options,
+// the same way the cloud provider matches accounts. Settings applied after creation are converged on every create.
+func isPoolAccountMatching(account storage.Account, options *azure.AccountOptions, defaultLocation string) bool {
+	if account.Sku == nil || !strings.EqualFold(string(account.Sku.Name), options.Type) {
+		return false
+	}
+	if options.Kind != "" && !strings.EqualFold(string(account.Kind), options.Kind) {
+		return false
+	}
+
+	location := options.Location
+	if location == "" {
+		location = defaultLocation
+	}
+	if location != "" && !strings.EqualFold(to.String(account.Location), location) {
+		return false
+	}
+
+	if _, ok := account.Tags[azure.SkipMatchingTag]; ok {
+		return false
+	}
+	if account.AccountProperties == nil {
+		return false
+	}
+
+	return to.Bool(account.IsHnsEnabled) == to.Bool(options.IsHnsEnabled) &&
+		to.Bool(account.EnableNfsV3) == to.Bool(options.EnableNfsV3) &&
+		azure.AreVNetRulesEqual(account, options)
+}
+
+// getPoolSettingsHash hashes the security and customer-managed key settings of a class. Both are applied to the
+// storage account after it is created, so classes asking for different ones would keep overwriting each other's
+// settings, or fail on the key already in use, if they shared an account.
+func getPoolSettingsHash(security *accountSecurityOptions, customerManagedKey *customerManagedKeyOptions) string {
+	sorted := func(values []string) string {
+		copied := append([]string{}, values...)
+		sort.Strings(copied)
+		return strings.Join(copied, ",")
+	}
+	optionalBool := func(value *bool) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatBool(*value)
+	}
+
+	settings := []string{
+		"ipRules=" + sorted(security.ipRules),
+		"defaultAction=" + security.defaultAction,
+		"bypass=" + sorted(security.bypass),
+		"minimumTlsVersion=" + security.minimumTLSVersion,
+		"allowSharedKeyAccess=" + optionalBool(security.allowSharedKeyAccess),
+		"allowBlobPublicAccess=" + optionalBool(security.allowBlobPublicAccess),
+		"allowCrossTenantReplication=" + optionalBool(security.allowCrossTenantReplication),
+	}
+	if customerManagedKey != nil {
+		settings = append(settings,
+			"keyVaultUri="+strings.ToLower(strings.TrimSuffix(customerManagedKey.keyVaultURI, "/")),
+			"keyName="+strings.ToLower(customerManagedKey.keyName),
+			"keyVersion="+strings.ToLower(customerManagedKey.keyVersion),
+			"identity="+strings.ToLower(customerManagedKey.identity))
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(settings, ";")))
+	return hex.EncodeToString(hash[:16])
+}
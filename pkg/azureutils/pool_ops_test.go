@@ -0,0 +1,496 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// testAccount is the state of a storage account behind the fake ARM
+type testAccount struct {
+	tags       map[string]string
+	containers []string
+	// deletedContainers are the soft deleted containers the account retains
+	deletedContainers []string
+}
+
+// newTestAccountHandler answers the requests for the storage accounts, their containers and the private endpoint of
+// account. Updates of the account tags are applied to the accounts, deleted accounts are removed.
+func newTestAccountHandler(t *testing.T, accounts map[string]*testAccount) armHandler {
+	return func(call string, body []byte) (int, interface{}) {
+		if call == "GET Microsoft.Storage/storageAccounts" {
+			values := []interface{}{}
+			for name, account := range accounts {
+				values = append(values, map[string]interface{}{"name": name, "tags": account.tags})
+			}
+			return http.StatusOK, map[string]interface{}{"value": values}
+		}
+		if call == "DELETE Microsoft.Network/privateEndpoints/account-blob-pvtendpoint" {
+			return http.StatusOK, nil
+		}
+
+		method, path := strings.SplitN(call, " ", 2)[0], strings.SplitN(call, " ", 2)[1]
+		parts := strings.Split(strings.TrimPrefix(path, "Microsoft.Storage/storageAccounts/"), "/")
+		name := parts[0]
+		account, ok := accounts[name]
+		if !ok {
+			return http.StatusNotFound, armError("ResourceNotFound", "The storage account was not found")
+		}
+
+		switch {
+		case len(parts) == 1 && method == http.MethodGet:
+			return http.StatusOK, map[string]interface{}{"name": name, "tags": account.tags}
+		case len(parts) == 1 && method == http.MethodPatch:
+			update := storage.AccountUpdateParameters{}
+			if err := json.Unmarshal(body, &update); err != nil {
+				t.Errorf("unexpected body %s of %s", body, call)
+			}
+			account.tags = map[string]string{}
+			for key, value := range update.Tags {
+				account.tags[key] = to.String(value)
+			}
+			return http.StatusOK, map[string]interface{}{"name": name, "tags": account.tags}
+		case len(parts) == 1 && method == http.MethodDelete:
+			delete(accounts, name)
+			return http.StatusOK, nil
+		case strings.HasSuffix(path, "/blobServices/default/containers"):
+			return http.StatusOK, map[string]interface{}{"value": getTestContainers(account.containers, false)}
+		case strings.HasSuffix(path, "/blobServices/default/containers?$include=deleted"):
+			containers := append(getTestContainers(account.containers, false), getTestContainers(account.deletedContainers, true)...)
+			return http.StatusOK, map[string]interface{}{"value": containers}
+		}
+		t.Errorf("unexpected call %s", call)
+		return http.StatusBadRequest, nil
+	}
+}
+
+func getTestContainers(names []string, deleted bool) []interface{} {
+	containers := []interface{}{}
+	for _, name := range names {
+		containers = append(containers, map[string]interface{}{"name": name, "properties": map[string]interface{}{"deleted": deleted}})
+	}
+	return containers
+}
+
+func TestCleanUpEmptyStorageAccount(t *testing.T) {
+	accountPath := "Microsoft.Storage/storageAccounts/account"
+	containersPath := accountPath + "/blobServices/default/containers"
+	allContainersPath := containersPath + "?$include=deleted"
+	endpointPath := "Microsoft.Network/privateEndpoints/account-blob-pvtendpoint"
+	endpointId := "/subscriptions/" + testSubscriptionID + "/resourceGroups/" + testResourceGroup + "/providers/" + endpointPath
+	owned := map[string]string{OwnerTagKey: OwnerTagValue}
+	retained := map[string]string{OwnerTagKey: OwnerTagValue, RetainedAccountTagKey: "2021-09-01T00:00:00Z"}
+
+	tests := []struct {
+		desc string
+		// account is nil when the storage account does not exist
+		account       *testAccount
+		deleteOwned   bool
+		expectedCalls []string
+		// expectedTags are the tags the account ends up with, nil when it is deleted
+		expectedTags map[string]string
+	}{
+		{
+			desc:          "account gone",
+			expectedCalls: []string{"GET " + accountPath},
+		},
+		{
+			desc:          "shared account without private endpoint",
+			account:       &testAccount{tags: map[string]string{}},
+			expectedCalls: []string{"GET " + accountPath},
+			expectedTags:  map[string]string{},
+		},
+		{
+			desc:          "recorded private endpoint of an account in use",
+			account:       &testAccount{tags: map[string]string{PrivateEndpointTagKey: endpointId}, containers: []string{"other"}},
+			expectedCalls: []string{"GET " + accountPath, "GET " + containersPath},
+			expectedTags:  map[string]string{PrivateEndpointTagKey: endpointId},
+		},
+		{
+			desc:    "recorded private endpoint of an empty account",
+			account: &testAccount{tags: map[string]string{PrivateEndpointTagKey: endpointId}},
+			expectedCalls: []string{"GET " + accountPath, "GET " + containersPath, "DELETE " + endpointPath,
+				"GET " + accountPath, "PATCH " + accountPath},
+			expectedTags: map[string]string{},
+		},
+		{
+			desc:          "empty account dedicated to the bucket",
+			account:       &testAccount{tags: map[string]string{DedicatedBucketTagKey: "bucket", OwnerTagKey: OwnerTagValue}},
+			deleteOwned:   true,
+			expectedCalls: []string{"GET " + accountPath, "GET " + allContainersPath, "DELETE " + accountPath},
+		},
+		{
+			desc:          "owned account in use",
+			account:       &testAccount{tags: owned, containers: []string{"other"}},
+			deleteOwned:   true,
+			expectedCalls: []string{"GET " + accountPath, "GET " + allContainersPath, "GET " + containersPath},
+			expectedTags:  owned,
+		},
+		{
+			desc:        "owned account retaining the deleted bucket",
+			account:     &testAccount{tags: owned, deletedContainers: []string{"bucket"}},
+			deleteOwned: true,
+			expectedCalls: []string{"GET " + accountPath, "GET " + allContainersPath, "GET " + containersPath,
+				"GET " + accountPath, "PATCH " + accountPath},
+			expectedTags: map[string]string{OwnerTagKey: OwnerTagValue, RetainedAccountTagKey: ""},
+		},
+		{
+			desc:          "retained account still retaining the deleted bucket",
+			account:       &testAccount{tags: retained, deletedContainers: []string{"bucket"}},
+			deleteOwned:   true,
+			expectedCalls: []string{"GET " + accountPath, "GET " + allContainersPath, "GET " + containersPath},
+			expectedTags:  retained,
+		},
+		{
+			desc:        "retained account that took a bucket again",
+			account:     &testAccount{tags: retained, containers: []string{"other"}},
+			deleteOwned: true,
+			expectedCalls: []string{"GET " + accountPath, "GET " + allContainersPath, "GET " + containersPath,
+				"GET " + accountPath, "PATCH " + accountPath},
+			expectedTags: owned,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			accounts := map[string]*testAccount{}
+			if test.account != nil {
+				accounts["account"] = test.account
+			}
+			client, arm := newTestStorageManagementClient(t, newTestAccountHandler(t, accounts))
+
+			if err := client.cleanUpEmptyStorageAccount(context.TODO(), "account", "bucket", test.deleteOwned); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if calls := arm.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+
+			account, ok := accounts["account"]
+			if test.expectedTags == nil {
+				if ok && test.account != nil {
+					t.Errorf("expected the account to be deleted, it has tags %v", account.tags)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected the account to be kept")
+			}
+			for key, value := range test.expectedTags {
+				// the time an account was retained since is only checked to be set
+				if actual, ok := account.tags[key]; !ok || value != "" && actual != value {
+					t.Errorf("expected tag %s=%s, got tags %v", key, value, account.tags)
+				}
+			}
+			if len(account.tags) != len(test.expectedTags) {
+				t.Errorf("expected tags %v, got %v", test.expectedTags, account.tags)
+			}
+		})
+	}
+}
+
+func TestSweepRetainedStorageAccounts(t *testing.T) {
+	retained := func() map[string]string {
+		return map[string]string{OwnerTagKey: OwnerTagValue, RetainedAccountTagKey: "2021-09-01T00:00:00Z"}
+	}
+	accounts := map[string]*testAccount{
+		"purged":    {tags: retained()},
+		"retaining": {tags: retained(), deletedContainers: []string{"bucket"}},
+		"reused":    {tags: retained(), containers: []string{"other"}},
+		// accounts the driver does not own, or did not keep, are not looked at
+		"foreign": {tags: map[string]string{RetainedAccountTagKey: "2021-09-01T00:00:00Z"}},
+		"pooled":  {tags: map[string]string{OwnerTagKey: OwnerTagValue}},
+	}
+	client, arm := newTestStorageManagementClient(t, newTestAccountHandler(t, accounts))
+
+	if err := client.SweepRetainedStorageAccounts(context.TODO()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	remaining := []string{}
+	for name := range accounts {
+		remaining = append(remaining, name)
+	}
+	sort.Strings(remaining)
+	if expected := []string{"foreign", "pooled", "retaining", "reused"}; !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("expected accounts %v to remain, got %v", expected, remaining)
+	}
+	if _, ok := accounts["reused"].tags[RetainedAccountTagKey]; ok {
+		t.Errorf("expected the reused account to lose tag %s, got %v", RetainedAccountTagKey, accounts["reused"].tags)
+	}
+	if _, ok := accounts["retaining"].tags[RetainedAccountTagKey]; !ok {
+		t.Errorf("expected the retaining account to keep tag %s, got %v", RetainedAccountTagKey, accounts["retaining"].tags)
+	}
+	for _, call := range arm.getCalls() {
+		if strings.Contains(call, "/foreign") || strings.Contains(call, "/pooled") {
+			t.Errorf("unexpected call %s", call)
+		}
+	}
+}
+
+func TestParseStoragePoolOptions(t *testing.T) {
+	tests := []struct {
+		desc           string
+		parameters     map[string]string
+		storageAccount string
+		expected       *storagePoolOptions
+		expectErr      bool
+	}{
+		{
+			desc:           "named storage account",
+			parameters:     map[string]string{},
+			storageAccount: "account",
+		},
+		{
+			desc:       "no storage account",
+			parameters: map[string]string{},
+			expected:   &storagePoolOptions{name: DefaultStorageAccountPool, maxContainers: DefaultMaxContainersPerAccount},
+		},
+		{
+			desc:           "pool taking precedence over the named account",
+			parameters:     map[string]string{"StorageAccountPool": " Analytics ", "maxContainersPerAccount": "20"},
+			storageAccount: "account",
+			expected:       &storagePoolOptions{name: "analytics", maxContainers: 20},
+		},
+		{
+			desc:       "pool name with an underscore",
+			parameters: map[string]string{"storageAccountPool": "analytics_eu"},
+			expectErr:  true,
+		},
+		{
+			desc:       "container cap of zero",
+			parameters: map[string]string{"maxContainersPerAccount": "0"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := parseStoragePoolOptions(test.parameters, test.storageAccount)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.desc, test.expectErr, err)
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected options %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestIsPoolAccountMatching(t *testing.T) {
+	newAccount := func(update func(account *storage.Account)) storage.Account {
+		account := storage.Account{
+			Name:              to.StringPtr("account"),
+			Sku:               &storage.Sku{Name: storage.SkuNameStandardLRS},
+			Kind:              storage.KindStorageV2,
+			Location:          to.StringPtr("westus2"),
+			AccountProperties: &storage.AccountProperties{},
+		}
+		if update != nil {
+			update(&account)
+		}
+		return account
+	}
+	options := &azure.AccountOptions{Type: "Standard_LRS", Kind: "StorageV2"}
+
+	tests := []struct {
+		desc     string
+		account  storage.Account
+		options  *azure.AccountOptions
+		expected bool
+	}{
+		{
+			desc:     "same settings in the default location",
+			account:  newAccount(nil),
+			options:  options,
+			expected: true,
+		},
+		{
+			desc:    "other sku",
+			account: newAccount(func(account *storage.Account) { account.Sku.Name = storage.SkuNameStandardGRS }),
+			options: options,
+		},
+		{
+			desc:    "other location",
+			account: newAccount(nil),
+			options: &azure.AccountOptions{Type: "Standard_LRS", Location: "eastus"},
+		},
+		{
+			desc:    "hierarchical namespace asked for",
+			account: newAccount(nil),
+			options: &azure.AccountOptions{Type: "Standard_LRS", IsHnsEnabled: to.BoolPtr(true)},
+		},
+		{
+			desc: "account skipped by the cloud provider",
+			account: newAccount(func(account *storage.Account) {
+				account.Tags = map[string]*string{azure.SkipMatchingTag: to.StringPtr("")}
+			}),
+			options: options,
+		},
+		{
+			desc:    "account without properties",
+			account: newAccount(func(account *storage.Account) { account.AccountProperties = nil }),
+			options: options,
+		},
+	}
+
+	for _, test := range tests {
+		if matching := isPoolAccountMatching(test.account, test.options, "westus2"); matching != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.expected, matching)
+		}
+	}
+}
+
+func TestGetPoolSettingsHash(t *testing.T) {
+	security := &accountSecurityOptions{ipRules: []string{"10.0.0.0/8", "192.168.0.1"}, defaultAction: "Deny", minimumTLSVersion: "TLS1_2"}
+	key := &customerManagedKeyOptions{keyVaultURI: "https://vault.vault.azure.net/", keyName: "cosi", identity: "/subscriptions/sub/identity"}
+	hash := getPoolSettingsHash(security, key)
+
+	t.Run("same settings written differently", func(t *testing.T) {
+		reordered := &accountSecurityOptions{ipRules: []string{"192.168.0.1", "10.0.0.0/8"}, defaultAction: "Deny", minimumTLSVersion: "TLS1_2"}
+		sameKey := &customerManagedKeyOptions{keyVaultURI: "https://VAULT.vault.azure.net", keyName: "COSI", identity: "/subscriptions/SUB/identity"}
+		if other := getPoolSettingsHash(reordered, sameKey); other != hash {
+			t.Errorf("expected hash %s, got %s", hash, other)
+		}
+		if !reflect.DeepEqual(security.ipRules, []string{"10.0.0.0/8", "192.168.0.1"}) || !reflect.DeepEqual(reordered.ipRules, []string{"192.168.0.1", "10.0.0.0/8"}) {
+			t.Errorf("expected the IP rules of the options to be left in order")
+		}
+	})
+
+	t.Run("other settings", func(t *testing.T) {
+		disallowed := false
+		others := map[string]string{
+			"other TLS version":   getPoolSettingsHash(&accountSecurityOptions{ipRules: security.ipRules, defaultAction: "Deny", minimumTLSVersion: "TLS1_1"}, key),
+			"shared key disabled": getPoolSettingsHash(&accountSecurityOptions{ipRules: security.ipRules, defaultAction: "Deny", minimumTLSVersion: "TLS1_2", allowSharedKeyAccess: &disallowed}, key),
+			"key of the platform": getPoolSettingsHash(security, nil),
+			"pinned key version":  getPoolSettingsHash(security, &customerManagedKeyOptions{keyVaultURI: key.keyVaultURI, keyName: "cosi", keyVersion: "1", identity: key.identity}),
+		}
+		for desc, other := range others {
+			if other == hash {
+				t.Errorf("%s: expected a hash other than %s", desc, hash)
+			}
+		}
+	})
+}
+
+func TestSelectPoolAccount(t *testing.T) {
+	pool := &storagePoolOptions{name: "analytics", maxContainers: 3, settings: "settings"}
+	poolTags := map[string]string{PoolTagKey: "analytics", PoolSettingsTagKey: "settings"}
+	accounts := map[string]struct {
+		tags       map[string]string
+		containers []string
+	}{
+		"full":     {tags: poolTags, containers: []string{"a", "b", "c"}},
+		"busy":     {tags: poolTags, containers: []string{"d", "e"}},
+		"quiet":    {tags: poolTags, containers: []string{"f"}},
+		"empty":    {tags: poolTags},
+		"other":    {tags: map[string]string{PoolTagKey: "other", PoolSettingsTagKey: "settings"}},
+		"settings": {tags: map[string]string{PoolTagKey: "analytics", PoolSettingsTagKey: "others"}},
+		"plain":    {},
+	}
+
+	newClient := func(t *testing.T) (*StorageManagementClient, *fakeARM) {
+		return newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+			if call == "GET Microsoft.Storage/storageAccounts" {
+				values := []interface{}{}
+				for name, account := range accounts {
+					values = append(values, map[string]interface{}{
+						"name":       name,
+						"tags":       account.tags,
+						"sku":        map[string]string{"name": "Standard_LRS"},
+						"kind":       "StorageV2",
+						"location":   "westus2",
+						"properties": map[string]interface{}{},
+					})
+				}
+				return http.StatusOK, map[string]interface{}{"value": values}
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(call, "GET Microsoft.Storage/storageAccounts/"), "/blobServices/default/containers")
+			if account, ok := accounts[name]; ok {
+				return http.StatusOK, map[string]interface{}{"value": getTestContainers(account.containers, false)}
+			}
+			t.Errorf("unexpected call %s", call)
+			return http.StatusBadRequest, nil
+		})
+	}
+	options := &azure.AccountOptions{Type: "Standard_LRS"}
+
+	t.Run("account with the fewest containers", func(t *testing.T) {
+		client, arm := newClient(t)
+
+		selected, err := client.selectPoolAccount(context.TODO(), options, pool, "westus2", "bucket")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if selected != "empty" {
+			t.Errorf("expected account empty, got %s", selected)
+		}
+		for _, call := range arm.getCalls() {
+			if strings.Contains(call, "/other/") || strings.Contains(call, "/settings/") || strings.Contains(call, "/plain/") {
+				t.Errorf("expected only the accounts of the pool to be counted, got %s", call)
+			}
+		}
+	})
+
+	t.Run("containers being created", func(t *testing.T) {
+		client, _ := newClient(t)
+		client.pendingContainers["empty"] = map[string]bool{"g": true, "h": true}
+		client.pendingContainers["quiet"] = map[string]bool{"f": true}
+
+		// the container already listed in quiet is counted once
+		selected, err := client.selectPoolAccount(context.TODO(), options, pool, "westus2", "bucket")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if selected != "quiet" {
+			t.Errorf("expected account quiet, got %s", selected)
+		}
+	})
+
+	t.Run("retried create", func(t *testing.T) {
+		client, _ := newClient(t)
+
+		// the container is picked again from the full account instead of being placed twice
+		selected, err := client.selectPoolAccount(context.TODO(), options, pool, "westus2", "b")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if selected != "full" {
+			t.Errorf("expected account full, got %s", selected)
+		}
+	})
+
+	t.Run("no room left", func(t *testing.T) {
+		client, _ := newClient(t)
+		client.removingAccounts["empty"] = true
+		client.removingAccounts["quiet"] = true
+		client.pendingContainers["busy"] = map[string]bool{"g": true}
+
+		selected, err := client.selectPoolAccount(context.TODO(), options, pool, "westus2", "bucket")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if selected != "" {
+			t.Errorf("expected no account, got %s", selected)
+		}
+	})
+}
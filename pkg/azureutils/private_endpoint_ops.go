@@ -0,0 +1,340 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-02-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/privatedns/mgmt/2018-09-01/privatedns"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+var (
+	// privateEndpointIdRE matches the resource id of a private endpoint
+	privateEndpointIdRE = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/([^/]+)/providers/Microsoft\.Network/privateEndpoints/([^/]+)$`)
+	// privateEndpointNameRE matches the names Azure accepts for private endpoints
+	privateEndpointNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,78}[a-zA-Z0-9_]$`)
+)
+
+// privateEndpointOptions place the blob private endpoint of the storage account. The cloud provider only
+// creates file endpoints, so the driver creates the blob endpoint and its DNS records itself.
+type privateEndpointOptions struct {
+	vnetResourceGroup    string
+	vnetName             string
+	subnetName           string
+	dnsZoneResourceGroup string
+	nameTemplate         string
+	location             string
+}
+
+// parsePrivateEndpointOptions returns nil unless the bucket class asks for a private endpoint. The placement
+// defaults to the virtual network of the cloud config, and the DNS zone to the resource group of the network.
+func parsePrivateEndpointOptions(parameters map[string]string, cloud *azure.Cloud) (*privateEndpointOptions, error) {
+	enabled := false
+	options := &privateEndpointOptions{
+		vnetResourceGroup: cloud.VnetResourceGroup,
+		vnetName:          cloud.VnetName,
+		subnetName:        cloud.SubnetName,
+		nameTemplate:      DefaultPrivateEndpointNameTemplate,
+		location:          cloud.Location,
+	}
+	for key, val := range parameters {
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(key) {
+		case CreatePrivateEndpointField:
+			enabled = enabled || strings.EqualFold(val, TrueValue)
+		case PrivateEndpointVNetResourceGroupField:
+			options.vnetResourceGroup, enabled = val, true
+		case PrivateEndpointVNetNameField:
+			options.vnetName, enabled = val, true
+		case PrivateEndpointSubnetNameField:
+			options.subnetName, enabled = val, true
+		case PrivateDNSZoneResourceGroupField:
+			options.dnsZoneResourceGroup, enabled = val, true
+		case PrivateEndpointNameTemplateField:
+			options.nameTemplate, enabled = val, true
+		}
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	if options.vnetResourceGroup == "" {
+		options.vnetResourceGroup = cloud.ResourceGroup
+	}
+	if options.dnsZoneResourceGroup == "" {
+		options.dnsZoneResourceGroup = options.vnetResourceGroup
+	}
+	if options.vnetName == "" || options.subnetName == "" {
+		return nil, fmt.Errorf("Private endpoints require %s and %s, or a virtual network and subnet in the cloud config", PrivateEndpointVNetNameField, PrivateEndpointSubnetNameField)
+	}
+	if !strings.Contains(options.nameTemplate, AccountNamePlaceholder) {
+		return nil, fmt.Errorf("Invalid %s '%s', the template must contain %s so that every storage account gets its own endpoint", PrivateEndpointNameTemplateField, options.nameTemplate, AccountNamePlaceholder)
+	}
+
+	return options, nil
+}
+
+// applyNetworkDefaults makes the firewall of the storage account deny traffic by default, as the cloud provider does for
+// the accounts it creates with a private endpoint, unless the bucket class sets networkDefaultAction itself
+func (o *privateEndpointOptions) applyNetworkDefaults(security *accountSecurityOptions) {
+	if o != nil && security.defaultAction == "" {
+		security.defaultAction = "Deny"
+	}
+}
+
+// getPrivateEndpointName renders the name template for the storage account
+func (o *privateEndpointOptions) getPrivateEndpointName(storageAccount string) (string, error) {
+	name := strings.ReplaceAll(o.nameTemplate, AccountNamePlaceholder, storageAccount)
+	if !privateEndpointNameRE.MatchString(name) {
+		return "", fmt.Errorf("Invalid private endpoint name '%s' from %s '%s'", name, PrivateEndpointNameTemplateField, o.nameTemplate)
+	}
+	return name, nil
+}
+
+// privateEndpointAddress is the private IP address and FQDN of the blob endpoint of a storage account
+type privateEndpointAddress struct {
+	ip   string
+	fqdn string
+}
+
+// ensurePrivateEndpoint creates the blob private endpoint of the storage account in the subnet, and registers it in the
+// privatelink.blob.core.windows.net zone linked to the virtual network. Existing endpoints are kept as they are, and so
+// is the subnet, whose network policies belong to the cluster admin. The endpoint is recorded in a tag of the account,
+// which grants and the cleanup after the last bucket of the account look for instead of searching its endpoints.
+func (c *StorageManagementClient) ensurePrivateEndpoint(ctx context.Context, storageAccount string, options *privateEndpointOptions) error {
+	if options == nil {
+		return nil
+	}
+
+	name, err := options.getPrivateEndpointName(storageAccount)
+	if err != nil {
+		return err
+	}
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/privateEndpoints/%s", c.subscriptionID, options.vnetResourceGroup, name)
+
+	endpoint, err := c.privateEndpoints.Get(ctx, options.vnetResourceGroup, name, "")
+	if err == nil {
+		klog.V(2).Infof("Private endpoint %s of storage account %s already exists", name, storageAccount)
+		if endpoint.Tags == nil || to.String(endpoint.Tags[OwnerTagKey]) != OwnerTagValue {
+			return nil
+		}
+		// A create that failed after the endpoint was created may not have recorded it
+		return c.recordPrivateEndpoint(ctx, storageAccount, id)
+	}
+	if endpoint.Response.Response == nil || endpoint.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Error getting private endpoint %s : %v", name, err)
+	}
+
+	subnet, err := c.subnets.Get(ctx, options.vnetResourceGroup, options.vnetName, options.subnetName, "")
+	if err != nil {
+		return fmt.Errorf("Error getting subnet %s of virtual network %s in resource group %s : %v", options.subnetName, options.vnetName, options.vnetResourceGroup, err)
+	}
+	klog.Infof("Creating private endpoint %s for storage account %s in subnet %s of virtual network %s", name, storageAccount, options.subnetName, options.vnetName)
+	future, err := c.privateEndpoints.CreateOrUpdate(ctx, options.vnetResourceGroup, name, network.PrivateEndpoint{
+		Location: to.StringPtr(options.location),
+		Tags:     map[string]*string{OwnerTagKey: to.StringPtr(OwnerTagValue)},
+		PrivateEndpointProperties: &network.PrivateEndpointProperties{
+			Subnet: &network.Subnet{ID: subnet.ID},
+			PrivateLinkServiceConnections: &[]network.PrivateLinkServiceConnection{{
+				Name: to.StringPtr(name + "-conn"),
+				PrivateLinkServiceConnectionProperties: &network.PrivateLinkServiceConnectionProperties{
+					PrivateLinkServiceID: to.StringPtr(c.getStorageAccountPath(storageAccount)),
+					GroupIds:             &[]string{blobGroupID},
+				},
+			}},
+		},
+	})
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, c.privateEndpoints.Client)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating private endpoint %s for storage account %s : %v", name, storageAccount, err)
+	}
+	if err := c.recordPrivateEndpoint(ctx, storageAccount, id); err != nil {
+		return err
+	}
+
+	if err := c.ensureBlobPrivateDNSZone(ctx, options); err != nil {
+		return err
+	}
+
+	zoneID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/privateDnsZones/%s", c.subscriptionID, options.dnsZoneResourceGroup, blobPrivateDNSZoneName)
+	groupFuture, err := c.privateDNSZoneGroups.CreateOrUpdate(ctx, options.vnetResourceGroup, name, "default", network.PrivateDNSZoneGroup{
+		PrivateDNSZoneGroupPropertiesFormat: &network.PrivateDNSZoneGroupPropertiesFormat{
+			PrivateDNSZoneConfigs: &[]network.PrivateDNSZoneConfig{{
+				Name:                           to.StringPtr(strings.ReplaceAll(blobPrivateDNSZoneName, ".", "-")),
+				PrivateDNSZonePropertiesFormat: &network.PrivateDNSZonePropertiesFormat{PrivateDNSZoneID: to.StringPtr(zoneID)},
+			}},
+		},
+	})
+	if err == nil {
+		err = groupFuture.WaitForCompletionRef(ctx, c.privateDNSZoneGroups.Client)
+	}
+	if err != nil {
+		return fmt.Errorf("Error registering private endpoint %s in private DNS zone %s : %v", name, blobPrivateDNSZoneName, err)
+	}
+
+	return nil
+}
+
+// ensureBlobPrivateDNSZone creates the blob private DNS zone and links it to the virtual network, so that the blob
+// endpoint of the storage account resolves to the private endpoint within the network
+func (c *StorageManagementClient) ensureBlobPrivateDNSZone(ctx context.Context, options *privateEndpointOptions) error {
+	zone, err := c.privateZones.Get(ctx, options.dnsZoneResourceGroup, blobPrivateDNSZoneName)
+	if err != nil {
+		if zone.Response.Response == nil || zone.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("Error getting private DNS zone %s in resource group %s : %v", blobPrivateDNSZoneName, options.dnsZoneResourceGroup, err)
+		}
+
+		klog.Infof("Creating private DNS zone %s in resource group %s", blobPrivateDNSZoneName, options.dnsZoneResourceGroup)
+		future, err := c.privateZones.CreateOrUpdate(ctx, options.dnsZoneResourceGroup, blobPrivateDNSZoneName, privatedns.PrivateZone{
+			Location: to.StringPtr("global"),
+		}, "", "")
+		if err == nil {
+			err = future.WaitForCompletionRef(ctx, c.privateZones.Client)
+		}
+		if err != nil {
+			return fmt.Errorf("Error creating private DNS zone %s in resource group %s : %v", blobPrivateDNSZoneName, options.dnsZoneResourceGroup, err)
+		}
+	}
+
+	linkName := options.vnetName + "-vnetlink"
+	link, err := c.virtualNetworkLinks.Get(ctx, options.dnsZoneResourceGroup, blobPrivateDNSZoneName, linkName)
+	if err == nil {
+		return nil
+	}
+	if link.Response.Response == nil || link.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Error getting link %s of private DNS zone %s : %v", linkName, blobPrivateDNSZoneName, err)
+	}
+
+	vnetID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/virtualNetworks/%s", c.subscriptionID, options.vnetResourceGroup, options.vnetName)
+	future, err := c.virtualNetworkLinks.CreateOrUpdate(ctx, options.dnsZoneResourceGroup, blobPrivateDNSZoneName, linkName, privatedns.VirtualNetworkLink{
+		Location: to.StringPtr("global"),
+		VirtualNetworkLinkProperties: &privatedns.VirtualNetworkLinkProperties{
+			VirtualNetwork:      &privatedns.SubResource{ID: to.StringPtr(vnetID)},
+			RegistrationEnabled: to.BoolPtr(false),
+		},
+	}, "", "")
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, c.virtualNetworkLinks.Client)
+	}
+	if err != nil {
+		return fmt.Errorf("Error linking private DNS zone %s to virtual network %s : %v", blobPrivateDNSZoneName, options.vnetName, err)
+	}
+
+	return nil
+}
+
+// recordPrivateEndpoint tags the storage account with the resource id of its private endpoint, or removes the tag
+// when id is empty, and forgets the cached address of the endpoint
+func (c *StorageManagementClient) recordPrivateEndpoint(ctx context.Context, storageAccount, id string) error {
+	err := c.setStorageAccountTag(ctx, storageAccount, PrivateEndpointTagKey, id)
+
+	c.privateEndpointLock.Lock()
+	delete(c.privateEndpointAddresses, storageAccount)
+	c.privateEndpointLock.Unlock()
+
+	return err
+}
+
+// getPrivateEndpointAddress returns the private IP address and FQDN of the blob endpoint of the storage account, or
+// empty strings when the account has no blob private endpoint of the driver. The address is cached, so that only the
+// first grant on the account looks it up.
+func (c *StorageManagementClient) getPrivateEndpointAddress(ctx context.Context, storageAccount string) (string, string, error) {
+	c.privateEndpointLock.Lock()
+	address, ok := c.privateEndpointAddresses[storageAccount]
+	c.privateEndpointLock.Unlock()
+	if ok {
+		return address.ip, address.fqdn, nil
+	}
+
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return "", "", fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	if matches := privateEndpointIdRE.FindStringSubmatch(to.String(account.Tags[PrivateEndpointTagKey])); matches != nil {
+		endpoint, err := c.privateEndpoints.Get(ctx, matches[1], matches[2], "")
+		if err != nil && (endpoint.Response.Response == nil || endpoint.StatusCode != http.StatusNotFound) {
+			return "", "", fmt.Errorf("Error getting private endpoint %s of storage account %s : %v", matches[2], storageAccount, err)
+		}
+
+		blobFQDN := fmt.Sprintf("%s.blob.core.windows.net", storageAccount)
+		if err == nil && endpoint.PrivateEndpointProperties != nil && endpoint.CustomDNSConfigs != nil {
+			for _, config := range *endpoint.CustomDNSConfigs {
+				if strings.EqualFold(to.String(config.Fqdn), blobFQDN) && config.IPAddresses != nil && len(*config.IPAddresses) > 0 {
+					address = privateEndpointAddress{ip: (*config.IPAddresses)[0], fqdn: to.String(config.Fqdn)}
+					break
+				}
+			}
+		}
+	}
+
+	c.privateEndpointLock.Lock()
+	c.privateEndpointAddresses[storageAccount] = address
+	c.privateEndpointLock.Unlock()
+
+	return address.ip, address.fqdn, nil
+}
+
+// removeUnusedPrivateEndpoint deletes the private endpoint the driver created for the storage account once no container
+// is left in it. Accounts without the tag recording such an endpoint are left alone without listing their containers.
+func (c *StorageManagementClient) removeUnusedPrivateEndpoint(ctx context.Context, account *storage.Account) error {
+	storageAccount := to.String(account.Name)
+	matches := privateEndpointIdRE.FindStringSubmatch(to.String(account.Tags[PrivateEndpointTagKey]))
+	if matches == nil {
+		return nil
+	}
+
+	empty, err := c.isStorageAccountEmpty(ctx, storageAccount, false)
+	if err != nil || !empty {
+		return err
+	}
+
+	klog.Infof("Deleting private endpoint %s of storage account %s, its last bucket is gone", matches[2], storageAccount)
+	future, err := c.privateEndpoints.Delete(ctx, matches[1], matches[2])
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, c.privateEndpoints.Client)
+	}
+	if err != nil {
+		return fmt.Errorf("Error deleting private endpoint %s of storage account %s : %v", matches[2], storageAccount, err)
+	}
+
+	return c.recordPrivateEndpoint(ctx, storageAccount, "")
+}
+
+// isStorageAccountEmpty checks whether the storage account has no containers left. With includeDeleted, soft deleted
+// containers that are still retained count as well, since deleting the account would make them unrecoverable.
+func (c *StorageManagementClient) isStorageAccountEmpty(ctx context.Context, storageAccount string, includeDeleted bool) (bool, error) {
+	include := storage.ListContainersInclude("")
+	if includeDeleted {
+		include = storage.ListContainersIncludeDeleted
+	}
+	page, err := c.blobContainers.List(ctx, c.resourceGroup, storageAccount, "1", "", include)
+	if err != nil {
+		return false, fmt.Errorf("Error listing containers of storage account %s : %v", storageAccount, err)
+	}
+
+	return len(page.Values()) == 0, nil
+}
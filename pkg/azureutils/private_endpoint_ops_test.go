@@ -0,0 +1,193 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func newTestCloud() *azure.Cloud {
+	cloud := &azure.Cloud{}
+	cloud.ResourceGroup = testResourceGroup
+	cloud.Location = "westeurope"
+	cloud.VnetName = "cluster-vnet"
+	cloud.SubnetName = "nodes"
+	return cloud
+}
+
+func TestParsePrivateEndpointOptions(t *testing.T) {
+	defaults := privateEndpointOptions{
+		vnetResourceGroup:    testResourceGroup,
+		vnetName:             "cluster-vnet",
+		subnetName:           "nodes",
+		dnsZoneResourceGroup: testResourceGroup,
+		nameTemplate:         DefaultPrivateEndpointNameTemplate,
+		location:             "westeurope",
+	}
+
+	t.Run("not requested", func(t *testing.T) {
+		options, err := parsePrivateEndpointOptions(map[string]string{"createPrivateEndpoint": "false"}, newTestCloud())
+		if err != nil || options != nil {
+			t.Errorf("expected no private endpoint, got %+v and error %v", options, err)
+		}
+	})
+
+	t.Run("placement of the cloud config", func(t *testing.T) {
+		options, err := parsePrivateEndpointOptions(map[string]string{"createPrivateEndpoint": "TRUE"}, newTestCloud())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(*options, defaults) {
+			t.Errorf("expected %+v, got %+v", defaults, *options)
+		}
+	})
+
+	t.Run("placement of the bucket class", func(t *testing.T) {
+		// setting the placement turns the endpoint on without createPrivateEndpoint
+		options, err := parsePrivateEndpointOptions(map[string]string{
+			"privateEndpointVnetResourceGroup": "network-rg",
+			"privateEndpointVnetName":          "shared-vnet",
+			"privateEndpointSubnetName":        "endpoints",
+		}, newTestCloud())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := defaults
+		expected.vnetResourceGroup, expected.vnetName, expected.subnetName = "network-rg", "shared-vnet", "endpoints"
+		// the DNS zone follows the virtual network
+		expected.dnsZoneResourceGroup = "network-rg"
+		if !reflect.DeepEqual(*options, expected) {
+			t.Errorf("expected %+v, got %+v", expected, *options)
+		}
+	})
+
+	t.Run("no subnet", func(t *testing.T) {
+		cloud := newTestCloud()
+		cloud.SubnetName = ""
+		if _, err := parsePrivateEndpointOptions(map[string]string{"createPrivateEndpoint": "true"}, cloud); err == nil {
+			t.Errorf("expected an error without a subnet")
+		}
+	})
+
+	t.Run("template without the account name", func(t *testing.T) {
+		_, err := parsePrivateEndpointOptions(map[string]string{"privateEndpointNameTemplate": "blob-endpoint"}, newTestCloud())
+		if err == nil || !strings.Contains(err.Error(), AccountNamePlaceholder) {
+			t.Errorf("expected an error naming %s, got %v", AccountNamePlaceholder, err)
+		}
+	})
+}
+
+func TestGetPrivateEndpointName(t *testing.T) {
+	for template, expected := range map[string]string{
+		DefaultPrivateEndpointNameTemplate: "account-blob-pvtendpoint",
+		"pe-{accountName}":                 "pe-account",
+		"{accountName}-":                   "",
+		"-{accountName}":                   "",
+	} {
+		options := &privateEndpointOptions{nameTemplate: template}
+		name, err := options.getPrivateEndpointName("account")
+		if expected == "" {
+			if err == nil {
+				t.Errorf("expected template %s to yield an invalid name, got %s", template, name)
+			}
+			continue
+		}
+		if err != nil || name != expected {
+			t.Errorf("expected template %s to yield %s, got %s and error %v", template, expected, name, err)
+		}
+	}
+}
+
+func TestApplyNetworkDefaults(t *testing.T) {
+	var none *privateEndpointOptions
+	security := &accountSecurityOptions{}
+	none.applyNetworkDefaults(security)
+	if security.defaultAction != "" {
+		t.Errorf("expected accounts without private endpoint to keep their default action, got %s", security.defaultAction)
+	}
+
+	options := &privateEndpointOptions{}
+	options.applyNetworkDefaults(security)
+	if security.defaultAction != "Deny" {
+		t.Errorf("expected accounts with a private endpoint to deny by default, got '%s'", security.defaultAction)
+	}
+
+	security = &accountSecurityOptions{defaultAction: "Allow"}
+	options.applyNetworkDefaults(security)
+	if security.defaultAction != "Allow" {
+		t.Errorf("expected the default action of the bucket class to be kept, got %s", security.defaultAction)
+	}
+}
+
+func TestGetPrivateEndpointAddress(t *testing.T) {
+	accountPath := "Microsoft.Storage/storageAccounts/account"
+	endpointPath := "Microsoft.Network/privateEndpoints/account-blob-pvtendpoint"
+	endpointId := "/subscriptions/" + testSubscriptionID + "/resourceGroups/" + testResourceGroup + "/providers/" + endpointPath
+
+	tests := []struct {
+		desc          string
+		tags          map[string]string
+		expectedIP    string
+		expectedCalls []string
+	}{
+		{
+			desc:          "account without endpoint of the driver",
+			tags:          map[string]string{OwnerTagKey: OwnerTagValue},
+			expectedCalls: []string{"GET " + accountPath},
+		},
+		{
+			desc:          "recorded endpoint",
+			tags:          map[string]string{PrivateEndpointTagKey: endpointId},
+			expectedIP:    "10.0.0.5",
+			expectedCalls: []string{"GET " + accountPath, "GET " + endpointPath},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, arm := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case "GET " + accountPath:
+					return http.StatusOK, map[string]interface{}{"name": "account", "tags": test.tags}
+				case "GET " + endpointPath:
+					return http.StatusOK, map[string]interface{}{"properties": map[string]interface{}{
+						"customDnsConfigs": []interface{}{map[string]interface{}{"fqdn": "account.blob.core.windows.net", "ipAddresses": []string{"10.0.0.5"}}},
+					}}
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			// the second grant is served from the cache
+			for i := 0; i < 2; i++ {
+				ip, fqdn, err := client.getPrivateEndpointAddress(context.TODO(), "account")
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if ip != test.expectedIP || (ip != "") != (fqdn == "account.blob.core.windows.net") {
+					t.Errorf("expected address '%s', got '%s' and '%s'", test.expectedIP, ip, fqdn)
+				}
+			}
+			if calls := arm.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+var (
+	guidRE      = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	accountIdRE = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	// microsoftGraphEndpoints are the Microsoft Graph endpoints of the Azure clouds, which the vendored
+	// environments do not carry yet
+	microsoftGraphEndpoints = map[string]string{
+		"AZUREPUBLICCLOUD":       "https://graph.microsoft.com/",
+		"AZURECHINACLOUD":        "https://microsoftgraph.chinacloudapi.cn/",
+		"AZUREUSGOVERNMENTCLOUD": "https://graph.microsoft.us/",
+		"AZUREGERMANCLOUD":       "https://graph.microsoft.de/",
+	}
+
+	// errPrincipalNotFound is returned when no principal has the object id or client id
+	errPrincipalNotFound = errors.New("principal not found")
+)
+
+// AuthorizationClient manages role assignments on containers and resolves AAD principals through Microsoft Graph
+type AuthorizationClient struct {
+	subscriptionID  string
+	roleAssignments authorization.RoleAssignmentsClient
+	graphEndpoint   string
+	graph           autorest.Client
+}
+
+func NewAuthorizationClient(cloud *azure.Cloud) (*AuthorizationClient, error) {
+	armAuthorizer, err := getARMAuthorizer(cloud)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating authorization client : %v", err)
+	}
+
+	graphEndpoint, ok := microsoftGraphEndpoints[strings.ToUpper(cloud.Environment.Name)]
+	if !ok {
+		return nil, fmt.Errorf("Error creating authorization client : no Microsoft Graph endpoint is known for cloud %s", cloud.Environment.Name)
+	}
+
+	graphToken, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, graphEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting Microsoft Graph token for authorization client : %v", err)
+	}
+
+	return newAuthorizationClient(cloud.Environment.ResourceManagerEndpoint, graphEndpoint, cloud.SubscriptionID, armAuthorizer, autorest.NewBearerAuthorizer(graphToken)), nil
+}
+
+func newAuthorizationClient(baseURI, graphEndpoint, subscriptionID string, armAuthorizer, graphAuthorizer autorest.Authorizer) *AuthorizationClient {
+	roleAssignments := authorization.NewRoleAssignmentsClientWithBaseURI(baseURI, subscriptionID)
+	roleAssignments.Authorizer = armAuthorizer
+
+	graph := autorest.NewClientWithUserAgent(roleAssignments.UserAgent)
+	graph.Authorizer = graphAuthorizer
+
+	return &AuthorizationClient{
+		subscriptionID:  subscriptionID,
+		roleAssignments: roleAssignments,
+		graphEndpoint:   graphEndpoint,
+		graph:           graph,
+	}
+}
+
+// isAADPrincipal checks whether the account name of a grant request is an AAD object id or client id
+func isAADPrincipal(accountName string) bool {
+	return guidRE.MatchString(accountName)
+}
+
+// graphDirectoryObject holds the Microsoft Graph fields of users, groups and service principals the driver reads
+type graphDirectoryObject struct {
+	ODataType string `json:"@odata.type"`
+	ID        string `json:"id"`
+	AppID     string `json:"appId"`
+}
+
+type graphDirectoryObjectList struct {
+	Value []graphDirectoryObject `json:"value"`
+}
+
+// resolvePrincipal returns the object id and client id of the principal named by a client id or object id.
+// Client ids are looked up among the service principals first. Principals that are not service principals,
+// such as users and groups, resolve to their object id only. It returns errPrincipalNotFound when neither
+// lookup finds the principal, and fails rather than guess when Microsoft Graph can not be queried.
+func (c *AuthorizationClient) resolvePrincipal(ctx context.Context, principal string) (string, string, error) {
+	if !isAADPrincipal(principal) {
+		return "", "", fmt.Errorf("Invalid principal '%s', expected an object id or client id", principal)
+	}
+
+	list := graphDirectoryObjectList{}
+	query := url.Values{
+		"$filter": []string{fmt.Sprintf("appId eq '%s'", principal)},
+		"$select": []string{"id,appId"},
+	}
+	if _, err := c.sendGraphRequest(ctx, "v1.0/servicePrincipals", query, &list); err != nil {
+		return "", "", fmt.Errorf("Error looking up service principal by client id %s : %v", principal, err)
+	}
+	if len(list.Value) > 0 {
+		return list.Value[0].ID, list.Value[0].AppID, nil
+	}
+
+	object := graphDirectoryObject{}
+	resp, err := c.sendGraphRequest(ctx, "v1.0/directoryObjects/"+principal, nil, &object)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return "", "", fmt.Errorf("No user, group or service principal has object id or client id %s : %w", principal, errPrincipalNotFound)
+		}
+		return "", "", fmt.Errorf("Error looking up principal by object id %s : %v", principal, err)
+	}
+
+	switch object.ODataType {
+	case "#microsoft.graph.servicePrincipal", "#microsoft.graph.user", "#microsoft.graph.group":
+		return object.ID, object.AppID, nil
+	default:
+		return "", "", fmt.Errorf("Object %s is a %s, only users, groups and service principals can be granted access", principal, strings.TrimPrefix(object.ODataType, "#microsoft.graph."))
+	}
+}
+
+// sendGraphRequest sends a GET request to Microsoft Graph and unmarshals the response into result. It returns the
+// response, so that callers can tell missing objects apart.
+func (c *AuthorizationClient) sendGraphRequest(ctx context.Context, path string, query url.Values, result interface{}) (*http.Response, error) {
+	decorators := []autorest.PrepareDecorator{
+		autorest.AsGet(),
+		autorest.WithBaseURL(c.graphEndpoint),
+		autorest.WithPath(path),
+	}
+	if len(query) > 0 {
+		parameters := map[string]interface{}{}
+		for key := range query {
+			parameters[key] = query.Get(key)
+		}
+		decorators = append(decorators, autorest.WithQueryParameters(parameters))
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := autorest.SendWithSender(c.graph, req, autorest.DoRetryForStatusCodes(c.graph.RetryAttempts, c.graph.RetryDuration, autorest.StatusCodesForRetry...))
+	if err != nil {
+		return resp, err
+	}
+
+	return resp, autorest.Respond(resp,
+		autorest.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(result),
+		autorest.ByClosing())
+}
+
+// createContainerRoleAssignment assigns the role to the principal on the container. The role assignment
+// name is derived from the account id so that it can be found again on revoke. An assignment of the grant
+// that holds another role or principal, for example after the access policy changed, is replaced.
+func (c *AuthorizationClient) createContainerRoleAssignment(
+	ctx context.Context,
+	scope string,
+	accountId string,
+	principalId string,
+	roleDefinitionID string) error {
+	roleDefinitionResourceID := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", c.subscriptionID, roleDefinitionID)
+	name := getRoleAssignmentName(accountId)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := c.roleAssignments.Create(ctx, scope, name, authorization.RoleAssignmentCreateParameters{
+			Properties: &authorization.RoleAssignmentProperties{
+				RoleDefinitionID: to.StringPtr(roleDefinitionResourceID),
+				PrincipalID:      to.StringPtr(principalId),
+			},
+		})
+		if err == nil {
+			return nil
+		}
+		if derr, ok := err.(autorest.DetailedError); !ok || derr.StatusCode != http.StatusConflict {
+			return fmt.Errorf("Error creating role assignment for principal %s on %s : %v", principalId, scope, err)
+		}
+
+		existing, err := c.roleAssignments.Get(ctx, scope, name)
+		if err != nil {
+			if existing.Response.Response != nil && existing.StatusCode == http.StatusNotFound {
+				// The conflict is with an assignment of someone else that already gives the principal the role
+				klog.Infof("Principal %s already holds role %s on %s through another role assignment", principalId, roleDefinitionID, scope)
+				return nil
+			}
+			return fmt.Errorf("Error getting role assignment for account id %s on %s : %v", accountId, scope, err)
+		}
+
+		properties := existing.Properties
+		if properties != nil && strings.EqualFold(to.String(properties.RoleDefinitionID), roleDefinitionResourceID) && strings.EqualFold(to.String(properties.PrincipalID), principalId) {
+			klog.Infof("Role assignment for account id %s already exists on %s", accountId, scope)
+			return nil
+		}
+		if attempt > 0 {
+			break
+		}
+
+		klog.Infof("Replacing role assignment for account id %s on %s, it holds another role or principal", accountId, scope)
+		if err := c.deleteContainerRoleAssignment(ctx, scope, accountId); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Role assignment for account id %s on %s holds another role or principal and could not be replaced", accountId, scope)
+}
+
+// deleteContainerRoleAssignment removes the role assignment of the grant, missing assignments are ignored
+func (c *AuthorizationClient) deleteContainerRoleAssignment(
+	ctx context.Context,
+	scope string,
+	accountId string) error {
+	if !accountIdRE.MatchString(accountId) {
+		return nil
+	}
+
+	result, err := c.roleAssignments.Delete(ctx, scope, getRoleAssignmentName(accountId))
+	if err != nil {
+		// ARM answers with no content when the role assignment does not exist
+		if result.Response.Response != nil &&
+			(result.StatusCode == http.StatusNotFound || result.StatusCode == http.StatusNoContent) {
+			return nil
+		}
+		return fmt.Errorf("Error deleting role assignment for account id %s on %s : %v", accountId, scope, err)
+	}
+
+	return nil
+}
+
+// getContainerResourceId returns the ARM resource id of the container, used as role assignment scope
+func getContainerResourceId(subscriptionID, resourceGroup, storageAccount, containerName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s/blobServices/default/containers/%s",
+		subscriptionID, resourceGroup, storageAccount, containerName)
+}
+
+// getRoleAssignmentName formats the 32 hex characters of the account id as the GUID role assignments are named by
+func getRoleAssignmentName(accountId string) string {
+	return fmt.Sprintf("%s-%s-%s-%s-%s", accountId[0:8], accountId[8:12], accountId[12:16], accountId[16:20], accountId[20:32])
+}
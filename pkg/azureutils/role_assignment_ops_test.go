@@ -0,0 +1,228 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"project/azure-cosi-driver/pkg/accesspolicy"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	testPrincipal   = "11111111-2222-3333-4444-555555555555"
+	testPrincipalId = "66666666-7777-8888-9999-000000000000"
+	testAccountId   = "0123456789abcdef0123456789abcdef"
+)
+
+// newTestAuthorizationClient returns a client whose Graph and ARM requests are both answered by the handler.
+// Requests are identified by their method and full path, e.g. "GET /v1.0/servicePrincipals".
+func newTestAuthorizationClient(t *testing.T, handler armHandler) (*AuthorizationClient, *fakeARM) {
+	t.Helper()
+
+	arm := &fakeARM{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		call := r.Method + " " + r.URL.Path
+
+		arm.lock.Lock()
+		arm.calls = append(arm.calls, call)
+		arm.lock.Unlock()
+
+		code, result := handler(call, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if result != nil {
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				t.Errorf("Error encoding the response to %s : %v", call, err)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := newAuthorizationClient(server.URL, server.URL+"/", testSubscriptionID, autorest.NullAuthorizer{}, autorest.NullAuthorizer{})
+	client.roleAssignments.RetryAttempts = 1
+	client.graph.RetryAttempts = 1
+	return client, arm
+}
+
+func TestResolvePrincipal(t *testing.T) {
+	servicePrincipals := "GET /v1.0/servicePrincipals"
+	directoryObject := "GET /v1.0/directoryObjects/" + testPrincipal
+
+	tests := []struct {
+		desc string
+		// servicePrincipals are the service principals whose client id is the principal
+		servicePrincipals []interface{}
+		// object is the directory object with the principal as object id, nil when there is none
+		object              map[string]interface{}
+		expectedPrincipalId string
+		expectedClientId    string
+		expectNotFound      bool
+		expectErr           bool
+		expectedCalls       []string
+	}{
+		{
+			desc:                "client id of a service principal",
+			servicePrincipals:   []interface{}{map[string]string{"id": testPrincipalId, "appId": testPrincipal}},
+			expectedPrincipalId: testPrincipalId,
+			expectedClientId:    testPrincipal,
+			expectedCalls:       []string{servicePrincipals},
+		},
+		{
+			desc:                "object id of a user",
+			object:              map[string]interface{}{"@odata.type": "#microsoft.graph.user", "id": testPrincipal},
+			expectedPrincipalId: testPrincipal,
+			expectedCalls:       []string{servicePrincipals, directoryObject},
+		},
+		{
+			desc:           "unknown principal",
+			expectNotFound: true,
+			expectErr:      true,
+			expectedCalls:  []string{servicePrincipals, directoryObject},
+		},
+		{
+			desc:          "object id of a device",
+			object:        map[string]interface{}{"@odata.type": "#microsoft.graph.device", "id": testPrincipal},
+			expectErr:     true,
+			expectedCalls: []string{servicePrincipals, directoryObject},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, graph := newTestAuthorizationClient(t, func(call string, body []byte) (int, interface{}) {
+				switch call {
+				case servicePrincipals:
+					return http.StatusOK, map[string]interface{}{"value": append([]interface{}{}, test.servicePrincipals...)}
+				case directoryObject:
+					if test.object == nil {
+						return http.StatusNotFound, armError("Request_ResourceNotFound", "Resource does not exist")
+					}
+					return http.StatusOK, test.object
+				}
+				t.Errorf("unexpected call %s", call)
+				return http.StatusBadRequest, nil
+			})
+
+			principalId, clientId, err := client.resolvePrincipal(context.TODO(), testPrincipal)
+			if test.expectErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", test.expectErr, err)
+			}
+			if notFound := errors.Is(err, errPrincipalNotFound); notFound != test.expectNotFound {
+				t.Errorf("expected principal not found %v, got error %v", test.expectNotFound, err)
+			}
+			if principalId != test.expectedPrincipalId || clientId != test.expectedClientId {
+				t.Errorf("expected principal %s with client id '%s', got %s and '%s'", test.expectedPrincipalId, test.expectedClientId, principalId, clientId)
+			}
+			if calls := graph.getCalls(); !reflect.DeepEqual(calls, test.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", test.expectedCalls, calls)
+			}
+		})
+	}
+
+	t.Run("malformed principal", func(t *testing.T) {
+		client, graph := newTestAuthorizationClient(t, func(call string, body []byte) (int, interface{}) {
+			t.Errorf("unexpected call %s", call)
+			return http.StatusBadRequest, nil
+		})
+		if _, _, err := client.resolvePrincipal(context.TODO(), "app"); err == nil {
+			t.Errorf("expected an error for a principal that is no GUID")
+		}
+		if calls := graph.getCalls(); len(calls) != 0 {
+			t.Errorf("expected Graph not to be queried, got %v", calls)
+		}
+	})
+}
+
+func TestCreateContainerRoleAssignment(t *testing.T) {
+	scope := getContainerResourceId(testSubscriptionID, testResourceGroup, "account", "bucket")
+	// the SDK joins the scope to the path with another slash
+	assignment := "/" + scope + "/providers/Microsoft.Authorization/roleAssignments/" + getRoleAssignmentName(testAccountId)
+	readerRole := "/subscriptions/" + testSubscriptionID + "/providers/Microsoft.Authorization/roleDefinitions/" + accesspolicy.StorageBlobDataReaderRoleId
+
+	// existingRole is the role of the grant's role assignment, empty while it does not exist
+	existingRole := ""
+	client, arm := newTestAuthorizationClient(t, func(call string, body []byte) (int, interface{}) {
+		switch call {
+		case "PUT " + assignment:
+			if existingRole != "" {
+				return http.StatusConflict, armError("RoleAssignmentExists", "The role assignment already exists.")
+			}
+			existingRole = readerRole
+			return http.StatusCreated, map[string]interface{}{"name": getRoleAssignmentName(testAccountId)}
+		case "GET " + assignment:
+			return http.StatusOK, map[string]interface{}{"properties": map[string]string{"roleDefinitionId": existingRole, "principalId": testPrincipalId}}
+		case "DELETE " + assignment:
+			existingRole = ""
+			return http.StatusOK, map[string]interface{}{}
+		}
+		t.Errorf("unexpected call %s", call)
+		return http.StatusBadRequest, nil
+	})
+
+	// the grant's assignment holds another role, so it is replaced
+	existingRole = "/subscriptions/" + testSubscriptionID + "/providers/Microsoft.Authorization/roleDefinitions/other"
+	if err := client.createContainerRoleAssignment(context.TODO(), scope, testAccountId, testPrincipalId, accesspolicy.StorageBlobDataReaderRoleId); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"PUT " + assignment, "GET " + assignment, "DELETE " + assignment, "PUT " + assignment}
+	if calls := arm.getCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if existingRole != readerRole {
+		t.Errorf("expected the assignment to hold role %s, got %s", readerRole, existingRole)
+	}
+
+	// granting the same role again keeps the assignment
+	if err := client.createContainerRoleAssignment(context.TODO(), scope, testAccountId, testPrincipalId, accesspolicy.StorageBlobDataReaderRoleId); err != nil {
+		t.Fatalf("unexpected error granting again %v", err)
+	}
+	expected = append(expected, "PUT "+assignment, "GET "+assignment)
+	if calls := arm.getCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestRoleAssignmentsWithoutAuthorizationClient(t *testing.T) {
+	clients := &AccessClients{
+		Cloud:       &azure.Cloud{},
+		AccountKeys: NewAccountKeyRegistry(),
+	}
+	policy, err := accesspolicy.Parse("read")
+	if err != nil {
+		t.Fatalf("unexpected error parsing access policy %v", err)
+	}
+
+	err = grantRoleAssignment(context.TODO(), "account", "bucket", testAccountId, testPrincipal, policy, &BucketAccessCredentials{}, clients)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected grant to fail with %v, got %v", codes.FailedPrecondition, err)
+	}
+
+	issued := &IssuedGrant{CredentialType: CredentialTypeRoleAssignment, AccountName: testPrincipal, AccessPolicy: "read"}
+	err = RevokeBucketAccess(context.TODO(), "https://account.blob.core.windows.net/bucket", testAccountId, issued, clients)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected revoke to fail with %v rather than leave the role assignment behind, got %v", codes.FailedPrecondition, err)
+	}
+}
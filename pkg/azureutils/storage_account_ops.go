@@ -14,23 +14,31 @@
 package azureutils
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
 func parseParametersForStorageAccount(
 	parameters map[string]string,
-	cloud *azure.Cloud) (*azure.AccountOptions, error) {
+	cloud *azure.Cloud) (*azure.AccountOptions, *accountSecurityOptions, error) {
 	if parameters == nil {
 		parameters = make(map[string]string)
 	}
 
 	var (
 		enableHTTPSTrafficOnly bool
-		createPrivateEndpoint  bool
 		isHnsEnabled           bool
 		enableNfsV3            bool
 		enableLargeFileShares  bool
@@ -40,6 +48,7 @@ func parseParametersForStorageAccount(
 		customTags             string
 		location               string
 	)
+	security := &accountSecurityOptions{}
 
 	for key, val := range parameters {
 		switch strings.ToLower(key) {
@@ -57,10 +66,6 @@ func parseParametersForStorageAccount(
 			if strings.EqualFold(val, TrueValue) {
 				enableHTTPSTrafficOnly = true
 			}
-		case CreatePrivateEndpointField:
-			if strings.EqualFold(val, TrueValue) {
-				createPrivateEndpoint = true
-			}
 		case HNSEnabledField:
 			if strings.EqualFold(val, TrueValue) {
 				isHnsEnabled = true
@@ -73,6 +78,11 @@ func parseParametersForStorageAccount(
 			if strings.EqualFold(val, TrueValue) {
 				enableLargeFileShares = true
 			}
+		case IPRulesField, NetworkDefaultActionField, NetworkBypassField, MinimumTLSVersionField,
+			AllowSharedKeyAccessField, AllowBlobPublicAccessField, AllowCrossTenantReplicationField:
+			if err := security.parse(strings.ToLower(key), val); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
@@ -80,9 +90,15 @@ func parseParametersForStorageAccount(
 		accountType = consts.DefaultStorageAccountType
 	}
 
+	// Splitting an empty list would yield a rule for an empty subnet id
+	vnetResourceIds := []string{}
+	if nvResourceIdsStr != "" {
+		vnetResourceIds = strings.Split(nvResourceIdsStr, TagsDelimiter)
+	}
+
 	tags, err := convertTagsToMap(customTags)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	return &azure.AccountOptions{
@@ -93,8 +109,267 @@ func parseParametersForStorageAccount(
 		IsHnsEnabled:              to.BoolPtr(isHnsEnabled),
 		EnableLargeFileShare:      enableLargeFileShares,
 		EnableNfsV3:               to.BoolPtr(enableNfsV3),
-		CreatePrivateEndpoint:     createPrivateEndpoint,
-		VirtualNetworkResourceIDs: strings.Split(nvResourceIdsStr, TagsDelimiter),
+		VirtualNetworkResourceIDs: vnetResourceIds,
 		Tags:                      tags,
-	}, nil
+	}, security, nil
+}
+
+// accountSecurityOptions are the firewall and hardening settings of the storage account, nil and empty
+// values leave the setting of the account as it is
+type accountSecurityOptions struct {
+	ipRules                     []string
+	defaultAction               string
+	bypass                      []string
+	minimumTLSVersion           string
+	allowSharedKeyAccess        *bool
+	allowBlobPublicAccess       *bool
+	allowCrossTenantReplication *bool
+}
+
+// The account properties are newer than the vendored SDK, so they are read and patched through plain ARM requests
+type accountSecurity struct {
+	Properties accountSecurityProperties `json:"properties"`
+}
+
+type accountSecurityProperties struct {
+	NetworkACLs                 *accountNetworkACLs `json:"networkAcls,omitempty"`
+	MinimumTLSVersion           string              `json:"minimumTlsVersion,omitempty"`
+	AllowSharedKeyAccess        *bool               `json:"allowSharedKeyAccess,omitempty"`
+	AllowBlobPublicAccess       *bool               `json:"allowBlobPublicAccess,omitempty"`
+	AllowCrossTenantReplication *bool               `json:"allowCrossTenantReplication,omitempty"`
+}
+
+type accountNetworkACLs struct {
+	Bypass        string          `json:"bypass,omitempty"`
+	DefaultAction string          `json:"defaultAction"`
+	IPRules       []accountIPRule `json:"ipRules"`
+	// The virtual network and resource access rules are sent back as they were read
+	VirtualNetworkRules []json.RawMessage `json:"virtualNetworkRules"`
+	ResourceAccessRules []json.RawMessage `json:"resourceAccessRules,omitempty"`
+}
+
+type accountIPRule struct {
+	Value  string `json:"value"`
+	Action string `json:"action,omitempty"`
+}
+
+var (
+	networkDefaultActions = []string{"Allow", "Deny"}
+	networkBypassValues   = []string{"None", "AzureServices", "Logging", "Metrics"}
+	minimumTLSVersions    = []string{"TLS1_0", "TLS1_1", "TLS1_2"}
+)
+
+func (o *accountSecurityOptions) isEmpty() bool {
+	return len(o.ipRules) == 0 && o.defaultAction == "" && len(o.bypass) == 0 && o.minimumTLSVersion == "" &&
+		o.allowSharedKeyAccess == nil && o.allowBlobPublicAccess == nil && o.allowCrossTenantReplication == nil
+}
+
+func (o *accountSecurityOptions) parse(key, val string) error {
+	var err error
+	switch key {
+	case IPRulesField:
+		for _, rule := range strings.Split(val, TagsDelimiter) {
+			ipRule, perr := parseIPRule(rule)
+			if perr != nil {
+				return perr
+			}
+			o.ipRules = append(o.ipRules, ipRule)
+		}
+	case NetworkDefaultActionField:
+		o.defaultAction, err = parseEnumValue(key, val, networkDefaultActions)
+	case NetworkBypassField:
+		o.bypass = []string{}
+		for _, bypass := range strings.Split(val, TagsDelimiter) {
+			value, perr := parseEnumValue(key, bypass, networkBypassValues)
+			if perr != nil {
+				return perr
+			}
+			if value != "None" {
+				o.bypass = append(o.bypass, value)
+			}
+		}
+		if len(o.bypass) == 0 {
+			o.bypass = []string{"None"}
+		}
+	case MinimumTLSVersionField:
+		o.minimumTLSVersion, err = parseEnumValue(key, val, minimumTLSVersions)
+	case AllowSharedKeyAccessField:
+		o.allowSharedKeyAccess = to.BoolPtr(strings.EqualFold(val, TrueValue))
+	case AllowBlobPublicAccessField:
+		o.allowBlobPublicAccess = to.BoolPtr(strings.EqualFold(val, TrueValue))
+	case AllowCrossTenantReplicationField:
+		o.allowCrossTenantReplication = to.BoolPtr(strings.EqualFold(val, TrueValue))
+	}
+	return err
+}
+
+// parseIPRule accepts a public IPv4 address or CIDR range, Azure takes single addresses without a prefix length
+func parseIPRule(val string) (string, error) {
+	val = strings.TrimSpace(val)
+	if ip := net.ParseIP(val); ip != nil && ip.To4() != nil {
+		return ip.To4().String(), nil
+	}
+	ip, ipNet, err := net.ParseCIDR(val)
+	if err != nil || ip.To4() == nil {
+		return "", fmt.Errorf("Invalid %s entry '%s', the format should be like '20.1.2.3' or '20.1.2.0/24'", IPRulesField, val)
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ones == 32 {
+		return ip.To4().String(), nil
+	}
+	if ones > 30 {
+		return "", fmt.Errorf("Invalid %s entry '%s', ranges must have a prefix length of at most /30", IPRulesField, val)
+	}
+	return ipNet.String(), nil
+}
+
+func parseEnumValue(key, val string, values []string) (string, error) {
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(val), value) {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid %s '%s', supported values are %s", key, val, strings.Join(values, ", "))
+}
+
+// applyAccountSecurity converges the firewall and hardening settings of the storage account with the options and
+// verifies them, whether the driver created the account or reuses it. IP rules are added to the rules of the account,
+// so that the rules of other bucket classes are kept. It returns status errors, FailedPrecondition when the account
+// does not end up with the requested settings.
+func (c *StorageManagementClient) applyAccountSecurity(ctx context.Context, storageAccount string, options *accountSecurityOptions) error {
+	if options.isEmpty() {
+		return nil
+	}
+
+	path := c.getStorageAccountPath(storageAccount)
+	current := accountSecurity{}
+	if _, err := c.sendARMRequest(ctx, http.MethodGet, path, accountSecurityAPIVersion, nil, &current, http.StatusOK); err != nil {
+		return status.Error(codes.Unknown, fmt.Sprintf("Error getting properties of storage account %s : %v", storageAccount, err))
+	}
+	if len(getAccountSecurityMismatches(&current.Properties, options)) == 0 {
+		return nil
+	}
+
+	desired := accountSecurityProperties{
+		MinimumTLSVersion:           options.minimumTLSVersion,
+		AllowSharedKeyAccess:        options.allowSharedKeyAccess,
+		AllowBlobPublicAccess:       options.allowBlobPublicAccess,
+		AllowCrossTenantReplication: options.allowCrossTenantReplication,
+	}
+	if len(options.ipRules) > 0 || options.defaultAction != "" || len(options.bypass) > 0 {
+		desired.NetworkACLs = mergeNetworkACLs(current.Properties.NetworkACLs, options)
+	}
+
+	klog.Infof("Updating network security of storage account %s", storageAccount)
+	updated := accountSecurity{}
+	_, err := c.sendARMRequest(ctx, http.MethodPatch, path, accountSecurityAPIVersion, accountSecurity{Properties: desired}, &updated, http.StatusOK)
+	if err != nil {
+		return status.Error(codes.Unknown, fmt.Sprintf("Error updating network security of storage account %s : %v", storageAccount, err))
+	}
+
+	if mismatches := getAccountSecurityMismatches(&updated.Properties, options); len(mismatches) > 0 {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Storage account %s does not have the requested security settings, %s", storageAccount, strings.Join(mismatches, ", ")))
+	}
+
+	return nil
+}
+
+func mergeNetworkACLs(current *accountNetworkACLs, options *accountSecurityOptions) *accountNetworkACLs {
+	acls := &accountNetworkACLs{
+		Bypass:              "AzureServices",
+		DefaultAction:       "Allow",
+		IPRules:             []accountIPRule{},
+		VirtualNetworkRules: []json.RawMessage{},
+	}
+	if current != nil {
+		acls.Bypass = current.Bypass
+		acls.DefaultAction = current.DefaultAction
+		acls.ResourceAccessRules = current.ResourceAccessRules
+		if current.IPRules != nil {
+			acls.IPRules = current.IPRules
+		}
+		if current.VirtualNetworkRules != nil {
+			acls.VirtualNetworkRules = current.VirtualNetworkRules
+		}
+	}
+
+	if options.defaultAction != "" {
+		acls.DefaultAction = options.defaultAction
+	}
+	if len(options.bypass) > 0 {
+		acls.Bypass = strings.Join(options.bypass, ", ")
+	}
+	for _, rule := range options.ipRules {
+		if !hasIPRule(acls.IPRules, rule) {
+			acls.IPRules = append(acls.IPRules, accountIPRule{Value: rule, Action: "Allow"})
+		}
+	}
+	return acls
+}
+
+// getAccountSecurityMismatches describes the settings of the account that differ from the options,
+// properties the account never set have their Azure defaults
+func getAccountSecurityMismatches(properties *accountSecurityProperties, options *accountSecurityOptions) []string {
+	mismatches := []string{}
+	acls := properties.NetworkACLs
+	if acls == nil {
+		acls = &accountNetworkACLs{DefaultAction: "Allow", Bypass: "AzureServices"}
+	}
+
+	for _, rule := range options.ipRules {
+		if !hasIPRule(acls.IPRules, rule) {
+			mismatches = append(mismatches, fmt.Sprintf("ip rule %s is missing", rule))
+		}
+	}
+	if options.defaultAction != "" && !strings.EqualFold(acls.DefaultAction, options.defaultAction) {
+		mismatches = append(mismatches, fmt.Sprintf("network default action is %s instead of %s", acls.DefaultAction, options.defaultAction))
+	}
+	if len(options.bypass) > 0 && !sameBypass(acls.Bypass, options.bypass) {
+		mismatches = append(mismatches, fmt.Sprintf("network bypass is %s instead of %s", acls.Bypass, strings.Join(options.bypass, ", ")))
+	}
+	if options.minimumTLSVersion != "" && !strings.EqualFold(properties.MinimumTLSVersion, options.minimumTLSVersion) {
+		mismatches = append(mismatches, fmt.Sprintf("minimum TLS version is %s instead of %s", properties.MinimumTLSVersion, options.minimumTLSVersion))
+	}
+
+	checkBool := func(name string, current, desired *bool) {
+		// Azure treats the unset properties as true
+		if desired != nil && (current == nil || *current) != *desired {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %t instead of %t", name, current == nil || *current, *desired))
+		}
+	}
+	checkBool("allowSharedKeyAccess", properties.AllowSharedKeyAccess, options.allowSharedKeyAccess)
+	checkBool("allowBlobPublicAccess", properties.AllowBlobPublicAccess, options.allowBlobPublicAccess)
+	checkBool("allowCrossTenantReplication", properties.AllowCrossTenantReplication, options.allowCrossTenantReplication)
+
+	return mismatches
+}
+
+func hasIPRule(rules []accountIPRule, value string) bool {
+	for _, rule := range rules {
+		if rule.Value == value || rule.Value == value+"/32" {
+			return true
+		}
+	}
+	return false
+}
+
+func sameBypass(current string, desired []string) bool {
+	values := []string{}
+	for _, value := range strings.Split(current, TagsDelimiter) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, strings.ToLower(value))
+		}
+	}
+	if len(values) == 0 {
+		values = []string{"none"}
+	}
+
+	expected := []string{}
+	for _, value := range desired {
+		expected = append(expected, strings.ToLower(value))
+	}
+
+	sort.Strings(values)
+	sort.Strings(expected)
+	return strings.Join(values, ",") == strings.Join(expected, ",")
 }
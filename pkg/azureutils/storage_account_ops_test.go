@@ -0,0 +1,222 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParseAccountSecurityOptions(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *accountSecurityOptions
+		expectErr  bool
+	}{
+		{
+			desc:       "ip rules",
+			parameters: map[string]string{IPRulesField: "20.1.2.3, 20.1.2.0/24,20.1.2.4/32"},
+			expected:   &accountSecurityOptions{ipRules: []string{"20.1.2.3", "20.1.2.0/24", "20.1.2.4"}},
+		},
+		{
+			desc:       "enum values are case insensitive",
+			parameters: map[string]string{NetworkDefaultActionField: "deny", MinimumTLSVersionField: "tls1_2"},
+			expected:   &accountSecurityOptions{defaultAction: "Deny", minimumTLSVersion: "TLS1_2"},
+		},
+		{
+			desc:       "bypass list",
+			parameters: map[string]string{NetworkBypassField: "AzureServices,Logging"},
+			expected:   &accountSecurityOptions{bypass: []string{"AzureServices", "Logging"}},
+		},
+		{
+			desc:       "no bypass",
+			parameters: map[string]string{NetworkBypassField: "None"},
+			expected:   &accountSecurityOptions{bypass: []string{"None"}},
+		},
+		{
+			desc:       "hardening flags",
+			parameters: map[string]string{AllowSharedKeyAccessField: "false", AllowBlobPublicAccessField: "False", AllowCrossTenantReplicationField: "true"},
+			expected: &accountSecurityOptions{
+				allowSharedKeyAccess:        to.BoolPtr(false),
+				allowBlobPublicAccess:       to.BoolPtr(false),
+				allowCrossTenantReplication: to.BoolPtr(true),
+			},
+		},
+		{
+			desc:       "IPv6 ip rule",
+			parameters: map[string]string{IPRulesField: "2001:db8::1"},
+			expectErr:  true,
+		},
+		{
+			desc:       "ip rule range too small",
+			parameters: map[string]string{IPRulesField: "20.1.2.0/31"},
+			expectErr:  true,
+		},
+		{
+			desc:       "unknown default action",
+			parameters: map[string]string{NetworkDefaultActionField: "Block"},
+			expectErr:  true,
+		},
+		{
+			desc:       "unknown bypass",
+			parameters: map[string]string{NetworkBypassField: "AzureServices,Everything"},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options := &accountSecurityOptions{}
+		var err error
+		for key, val := range test.parameters {
+			if err = options.parse(key, val); err != nil {
+				break
+			}
+		}
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got options %+v", test.desc, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, options)
+		}
+	}
+}
+
+func TestMergeNetworkACLs(t *testing.T) {
+	vnetRule := json.RawMessage(`{"id":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet","action":"Allow"}`)
+
+	tests := []struct {
+		desc     string
+		current  *accountNetworkACLs
+		options  *accountSecurityOptions
+		expected *accountNetworkACLs
+	}{
+		{
+			desc:    "account without network rules",
+			options: &accountSecurityOptions{ipRules: []string{"20.1.2.3"}},
+			expected: &accountNetworkACLs{
+				Bypass:              "AzureServices",
+				DefaultAction:       "Allow",
+				IPRules:             []accountIPRule{{Value: "20.1.2.3", Action: "Allow"}},
+				VirtualNetworkRules: []json.RawMessage{},
+			},
+		},
+		{
+			desc: "existing rules are kept",
+			current: &accountNetworkACLs{
+				Bypass:              "Logging",
+				DefaultAction:       "Deny",
+				IPRules:             []accountIPRule{{Value: "20.1.2.0/24", Action: "Allow"}, {Value: "20.1.3.4/32", Action: "Allow"}},
+				VirtualNetworkRules: []json.RawMessage{vnetRule},
+			},
+			options: &accountSecurityOptions{ipRules: []string{"20.1.3.4", "20.1.4.0/24"}},
+			expected: &accountNetworkACLs{
+				Bypass:        "Logging",
+				DefaultAction: "Deny",
+				IPRules: []accountIPRule{
+					{Value: "20.1.2.0/24", Action: "Allow"},
+					{Value: "20.1.3.4/32", Action: "Allow"},
+					{Value: "20.1.4.0/24", Action: "Allow"},
+				},
+				VirtualNetworkRules: []json.RawMessage{vnetRule},
+			},
+		},
+		{
+			desc:    "default action and bypass are replaced",
+			current: &accountNetworkACLs{Bypass: "AzureServices", DefaultAction: "Allow"},
+			options: &accountSecurityOptions{defaultAction: "Deny", bypass: []string{"AzureServices", "Metrics"}},
+			expected: &accountNetworkACLs{
+				Bypass:              "AzureServices, Metrics",
+				DefaultAction:       "Deny",
+				IPRules:             []accountIPRule{},
+				VirtualNetworkRules: []json.RawMessage{},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeNetworkACLs(test.current, test.options)
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.desc, test.expected, merged)
+		}
+	}
+}
+
+func TestGetAccountSecurityMismatches(t *testing.T) {
+	tests := []struct {
+		desc       string
+		properties *accountSecurityProperties
+		options    *accountSecurityOptions
+		expected   []string
+	}{
+		{
+			desc:       "unset properties have the Azure defaults",
+			properties: &accountSecurityProperties{},
+			options:    &accountSecurityOptions{defaultAction: "Allow", bypass: []string{"AzureServices"}, allowBlobPublicAccess: to.BoolPtr(true)},
+			expected:   []string{},
+		},
+		{
+			desc:       "unset properties differ from hardened options",
+			properties: &accountSecurityProperties{},
+			options:    &accountSecurityOptions{defaultAction: "Deny", allowSharedKeyAccess: to.BoolPtr(false)},
+			expected:   []string{"network default action is Allow instead of Deny", "allowSharedKeyAccess is true instead of false"},
+		},
+		{
+			desc: "matching account",
+			properties: &accountSecurityProperties{
+				NetworkACLs: &accountNetworkACLs{
+					Bypass:        "Metrics, AzureServices",
+					DefaultAction: "Deny",
+					IPRules:       []accountIPRule{{Value: "20.1.2.3/32"}},
+				},
+				MinimumTLSVersion:    "TLS1_2",
+				AllowSharedKeyAccess: to.BoolPtr(false),
+			},
+			options: &accountSecurityOptions{
+				ipRules:              []string{"20.1.2.3"},
+				defaultAction:        "Deny",
+				bypass:               []string{"AzureServices", "Metrics"},
+				minimumTLSVersion:    "TLS1_2",
+				allowSharedKeyAccess: to.BoolPtr(false),
+			},
+			expected: []string{},
+		},
+		{
+			desc: "missing ip rule and older TLS",
+			properties: &accountSecurityProperties{
+				NetworkACLs:       &accountNetworkACLs{Bypass: "None", DefaultAction: "Deny"},
+				MinimumTLSVersion: "TLS1_0",
+			},
+			options:  &accountSecurityOptions{ipRules: []string{"20.1.2.0/24"}, bypass: []string{"None"}, minimumTLSVersion: "TLS1_2"},
+			expected: []string{"ip rule 20.1.2.0/24 is missing", "minimum TLS version is TLS1_0 instead of TLS1_2"},
+		},
+	}
+
+	for _, test := range tests {
+		mismatches := getAccountSecurityMismatches(test.properties, test.options)
+		if !reflect.DeepEqual(mismatches, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.expected, mismatches)
+		}
+	}
+}
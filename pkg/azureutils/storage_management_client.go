@@ -0,0 +1,321 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-02-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/privatedns/mgmt/2018-09-01/privatedns"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-02-01/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// StorageManagementClient wraps the storage ARM clients for the operations
+// that are not exposed by the cloud provider, and the network clients for
+// the private endpoints of storage accounts
+type StorageManagementClient struct {
+	subscriptionID string
+	resourceGroup  string
+	baseURI        string
+	accounts       storage.AccountsClient
+	blobContainers storage.BlobContainersClient
+	blobServices   storage.BlobServicesClient
+	// blobServicesLock serializes the read-modify-write of blob service properties shared by buckets
+	blobServicesLock   sync.Mutex
+	encryptionScopes   storage.EncryptionScopesClient
+	managementPolicies storage.ManagementPoliciesClient
+	// managementPoliciesLock serializes the read-modify-write of the lifecycle policy shared by buckets
+	managementPoliciesLock sync.Mutex
+	privateEndpoints       network.PrivateEndpointsClient
+	privateDNSZoneGroups   network.PrivateDNSZoneGroupsClient
+	subnets                network.SubnetsClient
+	privateZones           privatedns.PrivateZonesClient
+	virtualNetworkLinks    privatedns.VirtualNetworkLinksClient
+	// poolLock guards the placement of buckets in storage accounts against the cleanup of empty accounts
+	poolLock sync.Mutex
+	// pendingContainers are the containers being created, by storage account
+	pendingContainers map[string]map[string]bool
+	// removingAccounts are the storage accounts whose resources are being removed after their last bucket was deleted
+	removingAccounts map[string]bool
+	// poolCreations are closed once the storage account being created for a pool, keyed by name and settings, exists
+	poolCreations map[string]chan struct{}
+	// privateEndpointAddresses caches the address of the driver's blob private endpoint by storage account, so that
+	// grants do not look it up every time. Accounts without such an endpoint have an empty address.
+	privateEndpointAddresses map[string]privateEndpointAddress
+	privateEndpointLock      sync.Mutex
+	// arm sends requests for the resources that are newer than the vendored SDK, such as local users
+	arm autorest.Client
+}
+
+func NewStorageManagementClient(cloud *azure.Cloud) (*StorageManagementClient, error) {
+	authorizer, err := getARMAuthorizer(cloud)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating storage management client : %v", err)
+	}
+
+	return newStorageManagementClient(cloud.Environment.ResourceManagerEndpoint, cloud.SubscriptionID, cloud.ResourceGroup, authorizer), nil
+}
+
+// newStorageManagementClient creates the clients against the ARM endpoint baseURI
+func newStorageManagementClient(baseURI, subscriptionID, resourceGroup string, authorizer autorest.Authorizer) *StorageManagementClient {
+	accounts := storage.NewAccountsClientWithBaseURI(baseURI, subscriptionID)
+	accounts.Authorizer = authorizer
+
+	blobContainers := storage.NewBlobContainersClientWithBaseURI(baseURI, subscriptionID)
+	blobContainers.Authorizer = authorizer
+
+	blobServices := storage.NewBlobServicesClientWithBaseURI(baseURI, subscriptionID)
+	blobServices.Authorizer = authorizer
+
+	encryptionScopes := storage.NewEncryptionScopesClientWithBaseURI(baseURI, subscriptionID)
+	encryptionScopes.Authorizer = authorizer
+
+	managementPolicies := storage.NewManagementPoliciesClientWithBaseURI(baseURI, subscriptionID)
+	managementPolicies.Authorizer = authorizer
+
+	privateEndpoints := network.NewPrivateEndpointsClientWithBaseURI(baseURI, subscriptionID)
+	privateEndpoints.Authorizer = authorizer
+
+	privateDNSZoneGroups := network.NewPrivateDNSZoneGroupsClientWithBaseURI(baseURI, subscriptionID)
+	privateDNSZoneGroups.Authorizer = authorizer
+
+	subnets := network.NewSubnetsClientWithBaseURI(baseURI, subscriptionID)
+	subnets.Authorizer = authorizer
+
+	privateZones := privatedns.NewPrivateZonesClientWithBaseURI(baseURI, subscriptionID)
+	privateZones.Authorizer = authorizer
+
+	virtualNetworkLinks := privatedns.NewVirtualNetworkLinksClientWithBaseURI(baseURI, subscriptionID)
+	virtualNetworkLinks.Authorizer = authorizer
+
+	arm := autorest.NewClientWithUserAgent(accounts.UserAgent)
+	arm.Authorizer = authorizer
+
+	return &StorageManagementClient{
+		subscriptionID:           subscriptionID,
+		resourceGroup:            resourceGroup,
+		baseURI:                  baseURI,
+		accounts:                 accounts,
+		blobContainers:           blobContainers,
+		blobServices:             blobServices,
+		encryptionScopes:         encryptionScopes,
+		managementPolicies:       managementPolicies,
+		privateEndpoints:         privateEndpoints,
+		privateDNSZoneGroups:     privateDNSZoneGroups,
+		subnets:                  subnets,
+		privateZones:             privateZones,
+		virtualNetworkLinks:      virtualNetworkLinks,
+		pendingContainers:        make(map[string]map[string]bool),
+		removingAccounts:         make(map[string]bool),
+		poolCreations:            make(map[string]chan struct{}),
+		privateEndpointAddresses: make(map[string]privateEndpointAddress),
+		arm:                      arm,
+	}
+}
+
+// setStorageAccountTag sets a tag of the storage account, or removes it when value is empty, keeping its other tags
+func (c *StorageManagementClient) setStorageAccountTag(ctx context.Context, storageAccount, key, value string) error {
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	tags := map[string]*string{}
+	for k, v := range account.Tags {
+		tags[k] = v
+	}
+	current, ok := tags[key]
+	if value == "" && !ok || value != "" && to.String(current) == value {
+		return nil
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = to.StringPtr(value)
+	}
+
+	if _, err := c.accounts.Update(ctx, c.resourceGroup, storageAccount, storage.AccountUpdateParameters{Tags: tags}); err != nil {
+		return fmt.Errorf("Error updating tag %s of storage account %s : %v", key, storageAccount, err)
+	}
+	return nil
+}
+
+// getStorageAccountPath returns the ARM path of the storage account
+func (c *StorageManagementClient) getStorageAccountPath(storageAccount string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", c.subscriptionID, c.resourceGroup, storageAccount)
+}
+
+// sendARMRequest sends a JSON request to ARM with the given api version and unmarshals the response into result
+// when it is not nil. It returns the response, so that callers can tell missing resources apart.
+func (c *StorageManagementClient) sendARMRequest(
+	ctx context.Context,
+	method string,
+	path string,
+	apiVersion string,
+	body interface{},
+	result interface{},
+	okStatusCodes ...int) (*http.Response, error) {
+	decorators := []autorest.PrepareDecorator{
+		autorest.AsContentType("application/json; charset=utf-8"),
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(c.baseURI),
+		autorest.WithPath(path),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": apiVersion}),
+	}
+	if body != nil {
+		decorators = append(decorators, autorest.WithJSON(body))
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := autorest.SendWithSender(c.arm, req, autorest.DoRetryForStatusCodes(c.arm.RetryAttempts, c.arm.RetryDuration, autorest.StatusCodesForRetry...))
+	if err != nil {
+		return resp, err
+	}
+
+	responders := []autorest.RespondDecorator{autorest.WithErrorUnlessStatusCode(okStatusCodes...)}
+	if result != nil {
+		responders = append(responders, autorest.ByUnmarshallingJSON(result))
+	}
+	responders = append(responders, autorest.ByClosing())
+
+	return resp, autorest.Respond(resp, responders...)
+}
+
+// storageAccountExists checks whether the storage account exists in the resource group of the driver
+func (c *StorageManagementClient) storageAccountExists(ctx context.Context, storageAccount string) (bool, error) {
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		if account.Response.Response != nil && account.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	return true, nil
+}
+
+// isBlobPublicAccessAllowed checks whether containers of the storage account may allow anonymous access,
+// accounts that never set allowBlobPublicAccess allow it
+func (c *StorageManagementClient) isBlobPublicAccessAllowed(ctx context.Context, storageAccount string) (bool, error) {
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return false, fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	if account.AccountProperties == nil || account.AccountProperties.AllowBlobPublicAccess == nil {
+		return true, nil
+	}
+	return to.Bool(account.AccountProperties.AllowBlobPublicAccess), nil
+}
+
+// useARMForContainers checks whether the containers of the storage account have to be managed through ARM rather than
+// the data plane: when the account does not accept requests signed with its account keys, or when its firewall denies
+// traffic by default, which may well include the driver's own. Accounts that never set these accept both.
+func (c *StorageManagementClient) useARMForContainers(ctx context.Context, storageAccount string) (bool, error) {
+	account, err := c.accounts.GetProperties(ctx, c.resourceGroup, storageAccount, "")
+	if err != nil {
+		return false, fmt.Errorf("Error getting properties of storage account %s : %v", storageAccount, err)
+	}
+
+	properties := account.AccountProperties
+	if properties == nil {
+		return false, nil
+	}
+	if properties.AllowSharedKeyAccess != nil && !to.Bool(properties.AllowSharedKeyAccess) {
+		return true, nil
+	}
+	return properties.NetworkRuleSet != nil && properties.NetworkRuleSet.DefaultAction == storage.DefaultActionDeny, nil
+}
+
+// createContainerWithARM creates the container through ARM, for the containers the data plane client can not
+// create: those with a default encryption scope, which writes can not override, and those of storage accounts
+// without shared key access or behind a firewall. An empty scope name leaves the encryption of the storage account.
+func (c *StorageManagementClient) createContainerWithARM(
+	ctx context.Context,
+	storageAccount string,
+	containerName string,
+	metadata map[string]string,
+	publicAccess azblob.PublicAccessType,
+	scopeName string) (string, error) {
+	access := storage.PublicAccessNone
+	switch publicAccess {
+	case azblob.PublicAccessBlob:
+		access = storage.PublicAccessBlob
+	case azblob.PublicAccessContainer:
+		access = storage.PublicAccessContainer
+	}
+
+	properties := &storage.ContainerProperties{
+		PublicAccess: access,
+		Metadata:     convertMapToMapPointer(metadata),
+	}
+	if scopeName != "" {
+		properties.DefaultEncryptionScope = to.StringPtr(scopeName)
+		properties.DenyEncryptionScopeOverride = to.BoolPtr(true)
+	}
+
+	containerUrl := fmt.Sprintf("https://%s.blob.core.windows.net/%s", storageAccount, containerName)
+	container, err := c.blobContainers.Create(ctx, c.resourceGroup, storageAccount, containerName, storage.BlobContainer{
+		ContainerProperties: properties,
+	})
+	if err != nil {
+		if container.Response.Response != nil && container.StatusCode == http.StatusConflict {
+			existing, err := c.getContainerEncryptionScope(ctx, storageAccount, containerName)
+			if err != nil {
+				return "", err
+			}
+			if existing != scopeName {
+				return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Container %s already exists in storage account %s with encryption scope '%s' instead of '%s'", containerName, storageAccount, existing, scopeName))
+			}
+			return containerUrl, nil
+		}
+		if code, _, ok := getServiceError(err); ok && code == serviceCodePublicAccessNotPermitted {
+			return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Public access is not permitted on storage account %s, containers can not be created with public access level %s", storageAccount, publicAccess))
+		}
+		return "", fmt.Errorf("Error creating container %s in storage account %s : %v", containerName, storageAccount, err)
+	}
+
+	return containerUrl, nil
+}
+
+// deleteContainerWithARM deletes the container through ARM, for storage accounts without shared key access or
+// behind a firewall.
+// Missing containers are ignored.
+func (c *StorageManagementClient) deleteContainerWithARM(ctx context.Context, storageAccount, containerName string) error {
+	resp, err := c.blobContainers.Delete(ctx, c.resourceGroup, storageAccount, containerName)
+	if err != nil {
+		if resp.Response != nil && resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if code, _, ok := getServiceError(err); ok && code == serviceCodeContainerProtectedFromDeletion {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Container %s in storage account %s is protected from deletion by an immutability policy or legal hold", containerName, storageAccount))
+		}
+		return fmt.Errorf("Error deleting container %s in storage account %s : %v", containerName, storageAccount, err)
+	}
+
+	return nil
+}
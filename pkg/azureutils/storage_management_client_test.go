@@ -0,0 +1,134 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	testSubscriptionID = "00000000-0000-0000-0000-00000000000a"
+	testResourceGroup  = "rg"
+)
+
+// armHandler answers a request to the fake ARM endpoint with a status code and a JSON body, nil for none.
+// The request is identified by its method and its path below the resource group, e.g.
+// "GET Microsoft.Storage/storageAccounts/account", followed by its $include query parameter if it has one,
+// e.g. "GET Microsoft.Storage/storageAccounts/account/blobServices/default/containers?$include=deleted".
+type armHandler func(call string, body []byte) (int, interface{})
+
+// fakeARM records the requests it serves, so that tests can check which calls were made and in which order
+type fakeARM struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (f *fakeARM) getCalls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+// newTestStorageManagementClient returns a client whose ARM requests are answered by the handler
+func newTestStorageManagementClient(t *testing.T, handler armHandler) (*StorageManagementClient, *fakeARM) {
+	t.Helper()
+
+	arm := &fakeARM{}
+	prefix := "/subscriptions/" + testSubscriptionID + "/resourceGroups/" + testResourceGroup + "/providers/"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		call := r.Method + " " + strings.TrimPrefix(r.URL.Path, prefix)
+		if include := r.URL.Query().Get("$include"); include != "" {
+			call += "?$include=" + include
+		}
+
+		arm.lock.Lock()
+		arm.calls = append(arm.calls, call)
+		arm.lock.Unlock()
+
+		code, result := handler(call, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if result != nil {
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				t.Errorf("Error encoding the response to %s : %v", call, err)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := newStorageManagementClient(server.URL, testSubscriptionID, testResourceGroup, autorest.NullAuthorizer{})
+	// errors of the fake are final, retrying them only slows the tests down
+	client.arm.RetryAttempts = 1
+	return client, arm
+}
+
+// armError is the error body ARM returns with failed requests
+func armError(code, message string) interface{} {
+	return map[string]interface{}{"error": map[string]string{"code": code, "message": message}}
+}
+
+func TestUseARMForContainers(t *testing.T) {
+	tests := []struct {
+		desc       string
+		properties map[string]interface{}
+		expected   bool
+	}{
+		{
+			desc:       "account with the Azure defaults",
+			properties: map[string]interface{}{},
+			expected:   false,
+		},
+		{
+			desc:       "shared key access disabled",
+			properties: map[string]interface{}{"allowSharedKeyAccess": false},
+			expected:   true,
+		},
+		{
+			desc:       "firewall allowing by default",
+			properties: map[string]interface{}{"networkAcls": map[string]interface{}{"defaultAction": "Allow"}},
+			expected:   false,
+		},
+		{
+			desc:       "firewall denying by default",
+			properties: map[string]interface{}{"allowSharedKeyAccess": true, "networkAcls": map[string]interface{}{"defaultAction": "Deny"}},
+			expected:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, _ := newTestStorageManagementClient(t, func(call string, body []byte) (int, interface{}) {
+				return http.StatusOK, map[string]interface{}{"name": "account", "properties": test.properties}
+			})
+
+			useARM, err := client.useARMForContainers(context.TODO(), "account")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if useARM != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, useARM)
+			}
+		})
+	}
+}
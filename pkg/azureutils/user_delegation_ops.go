@@ -0,0 +1,93 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/klog"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+type userDelegationKey struct {
+	credential azblob.UserDelegationCredential
+	expiry     time.Time
+}
+
+// UserDelegationKeyCache caches the user delegation keys of each storage account, so that
+// a new key is only requested from the blob service when the cached one is about to expire
+type UserDelegationKeyCache struct {
+	lock  sync.Mutex
+	token *adal.ServicePrincipalToken
+	keys  map[string]*userDelegationKey
+}
+
+func NewUserDelegationKeyCache() *UserDelegationKeyCache {
+	return &UserDelegationKeyCache{
+		keys: make(map[string]*userDelegationKey),
+	}
+}
+
+// GetCredential returns a user delegation credential for the storage account that stays valid
+// until at least validUntil, requesting a new delegation key with the driver's AAD identity if needed
+func (c *UserDelegationKeyCache) GetCredential(
+	ctx context.Context,
+	storageAccount string,
+	validUntil time.Time,
+	cloud *azure.Cloud) (azblob.UserDelegationCredential, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if key, ok := c.keys[storageAccount]; ok && key.expiry.After(validUntil.Add(UserDelegationKeyRefreshMargin)) {
+		return key.credential, nil
+	}
+
+	if c.token == nil {
+		token, err := auth.GetServicePrincipalToken(&cloud.AzureAuthConfig, &cloud.Environment, cloud.Environment.ResourceIdentifiers.Storage)
+		if err != nil {
+			return azblob.UserDelegationCredential{}, fmt.Errorf("Error getting AAD token for storage : %v", err)
+		}
+		c.token = token
+	}
+
+	if err := c.token.EnsureFresh(); err != nil {
+		return azblob.UserDelegationCredential{}, fmt.Errorf("Error refreshing AAD token for storage : %v", err)
+	}
+
+	serviceURL, err := createServiceUrl(storageAccount, azblob.NewTokenCredential(c.token.OAuthToken(), nil))
+	if err != nil {
+		return azblob.UserDelegationCredential{}, err
+	}
+
+	start := time.Now().UTC()
+	expiry := start.Add(UserDelegationKeyValidity)
+	credential, err := serviceURL.GetUserDelegationCredential(ctx, azblob.NewKeyInfo(start, expiry), nil, nil)
+	if err != nil {
+		return azblob.UserDelegationCredential{}, fmt.Errorf("Error getting user delegation key for storage account %s : %v", storageAccount, err)
+	}
+
+	klog.Infof("Refreshed user delegation key for storage account %s, expires at %v", storageAccount, expiry)
+	c.keys[storageAccount] = &userDelegationKey{
+		credential: credential,
+		expiry:     expiry,
+	}
+
+	return credential, nil
+}
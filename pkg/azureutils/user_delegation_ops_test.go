@@ -0,0 +1,82 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureutils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestUserDelegationKeyCache(t *testing.T) {
+	now := time.Now().UTC()
+	cached := azblob.NewUserDelegationCredential("account", azblob.UserDelegationKey{Value: "a2V5"})
+
+	newCache := func(expiry time.Time) *UserDelegationKeyCache {
+		cache := NewUserDelegationKeyCache()
+		cache.keys["account"] = &userDelegationKey{credential: cached, expiry: expiry}
+		return cache
+	}
+
+	// The cloud has no credentials, so a key that has to be requested fails to get the AAD token instead of
+	// reaching the blob service
+	tests := []struct {
+		desc         string
+		expiry       time.Time
+		account      string
+		validUntil   time.Time
+		expectCached bool
+	}{
+		{
+			desc:         "key outliving the SAS",
+			expiry:       now.Add(UserDelegationKeyValidity),
+			account:      "account",
+			validUntil:   now.Add(DefaultGrantValidity),
+			expectCached: true,
+		},
+		{
+			desc:       "key expiring within the refresh margin of the SAS",
+			expiry:     now.Add(DefaultGrantValidity + UserDelegationKeyRefreshMargin/2),
+			account:    "account",
+			validUntil: now.Add(DefaultGrantValidity),
+		},
+		{
+			desc:       "key of another storage account",
+			expiry:     now.Add(UserDelegationKeyValidity),
+			account:    "other",
+			validUntil: now.Add(DefaultGrantValidity),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			credential, err := newCache(test.expiry).GetCredential(context.TODO(), test.account, test.validUntil, newTestCloud())
+			if !test.expectCached {
+				if err == nil {
+					t.Errorf("expected a new key to be requested, got credential for %s", credential.AccountName())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(credential, cached) {
+				t.Errorf("expected the cached credential, got one for %s", credential.AccountName())
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grantstore persists the records of issued bucket access grants, so that grants can be
+// rotated and revoked after the driver restarts. The records of a bucket are kept in one secret,
+// keyed by account id, since they hold the credentials last handed out.
+package grantstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// StoreLabel marks the secrets holding grant records, its value is the driver name
+	StoreLabel = "objectstorage.k8s.io/grant-store"
+	// BucketIdAnnotation holds the bucket id of the grants in a secret
+	BucketIdAnnotation = "objectstorage.k8s.io/bucket-id"
+
+	secretNamePrefix = "cosi-grants-"
+)
+
+// Record is what the driver remembers about a grant it issued
+type Record struct {
+	BucketId       string            `json:"bucketId"`
+	AccountId      string            `json:"accountId"`
+	AccountName    string            `json:"accountName"`
+	AccessPolicy   string            `json:"accessPolicy,omitempty"`
+	Parameters     map[string]string `json:"parameters,omitempty"`
+	CredentialType string            `json:"credentialType"`
+	// AccountKeyName is the storage account key handed out by account key grants
+	AccountKeyName string `json:"accountKeyName,omitempty"`
+	// CredentialsHash is the hash of the credentials last handed out, the credentials are only kept in the
+	// BucketAccess secret
+	CredentialsHash string    `json:"credentialsHash"`
+	IssuedOn        time.Time `json:"issuedOn"`
+	// ExpiresOn is zero for grants that are valid until revoked
+	ExpiresOn time.Time `json:"expiresOn,omitempty"`
+	// SecretNamespace and SecretName locate the BucketAccess secret, once the grant was rotated
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+	SecretName      string `json:"secretName,omitempty"`
+}
+
+// Store keeps grant records in secrets of a namespace
+type Store struct {
+	kubeClient clientSet.Interface
+	namespace  string
+	driverName string
+}
+
+func NewStore(kubeClient clientSet.Interface, namespace, driverName string) *Store {
+	return &Store{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		driverName: driverName,
+	}
+}
+
+// Save adds or replaces the record of a grant
+func (s *Store) Save(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error serializing grant record of account id %s : %v", record.AccountId, err)
+	}
+
+	name := getSecretName(record.BucketId)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			secret = &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   s.namespace,
+					Labels:      map[string]string{StoreLabel: s.driverName},
+					Annotations: map[string]string{BucketIdAnnotation: record.BucketId},
+				},
+				Data: map[string][]byte{record.AccountId: data},
+			}
+			_, err = s.kubeClient.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Another grant of the bucket created the secret first, retry as an update
+				return apierrors.NewConflict(v1.Resource("secrets"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[record.AccountId] = data
+		_, err = s.kubeClient.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error saving grant record of account id %s for bucket %s : %v", record.AccountId, record.BucketId, err)
+	}
+
+	return nil
+}
+
+// Get returns the record of a grant, or nil when the grant is not recorded
+func (s *Store) Get(ctx context.Context, bucketId, accountId string) (*Record, error) {
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, getSecretName(bucketId), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error getting grant records for bucket %s : %v", bucketId, err)
+	}
+
+	data, ok := secret.Data[accountId]
+	if !ok {
+		return nil, nil
+	}
+
+	return decodeRecord(accountId, data)
+}
+
+// Delete removes the record of a grant, and the secret with the last record of the bucket.
+// Deleting a record that does not exist is not an error.
+func (s *Store) Delete(ctx context.Context, bucketId, accountId string) error {
+	name := getSecretName(bucketId)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, ok := secret.Data[accountId]; !ok {
+			return nil
+		}
+		delete(secret.Data, accountId)
+
+		if len(secret.Data) == 0 {
+			err = s.kubeClient.CoreV1().Secrets(s.namespace).Delete(ctx, name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &secret.ResourceVersion},
+			})
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		_, err = s.kubeClient.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting grant record of account id %s for bucket %s : %v", accountId, bucketId, err)
+	}
+
+	return nil
+}
+
+// ListBucket returns the records of the grants of a bucket
+func (s *Store) ListBucket(ctx context.Context, bucketId string) ([]*Record, error) {
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, getSecretName(bucketId), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return []*Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error getting grant records for bucket %s : %v", bucketId, err)
+	}
+
+	records := []*Record{}
+	for accountId, data := range secret.Data {
+		record, err := decodeRecord(accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// List returns the records of every grant issued by the driver
+func (s *Store) List(ctx context.Context) ([]*Record, error) {
+	secrets, err := s.kubeClient.CoreV1().Secrets(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", StoreLabel, s.driverName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing grant records : %v", err)
+	}
+
+	records := []*Record{}
+	for _, secret := range secrets.Items {
+		for accountId, data := range secret.Data {
+			record, err := decodeRecord(accountId, data)
+			if err != nil {
+				klog.Warningf("Skipping grant record in secret %s/%s : %v", secret.Namespace, secret.Name, err)
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func decodeRecord(accountId string, data []byte) (*Record, error) {
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("Error parsing grant record of account id %s : %v", accountId, err)
+	}
+	return record, nil
+}
+
+// getSecretName derives a valid secret name from the bucket id, which is a URL
+func getSecretName(bucketId string) string {
+	hash := sha256.Sum256([]byte(bucketId))
+	return secretNamePrefix + hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grantstore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace  = "cosi"
+	testDriverName = "blob.cosi.azure.com"
+	testBucketId   = "https://account.blob.core.windows.net/bucket"
+)
+
+func newTestRecord(bucketId, accountId string) *Record {
+	issuedOn := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return &Record{
+		BucketId:        bucketId,
+		AccountId:       accountId,
+		AccountName:     "app-" + accountId,
+		AccessPolicy:    "read",
+		Parameters:      map[string]string{"credentialType": "storedaccesspolicy"},
+		CredentialType:  "storedaccesspolicy",
+		CredentialsHash: "0a1b2c",
+		IssuedOn:        issuedOn,
+		ExpiresOn:       issuedOn.Add(24 * time.Hour),
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	ctx := context.TODO()
+	kubeClient := fake.NewSimpleClientset()
+	store := NewStore(kubeClient, testNamespace, testDriverName)
+
+	first := newTestRecord(testBucketId, "first")
+	second := newTestRecord(testBucketId, "second")
+	other := newTestRecord("https://account.blob.core.windows.net/other", "third")
+	for _, record := range []*Record{first, second, other} {
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("unexpected error saving record %s: %v", record.AccountId, err)
+		}
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(testNamespace).Get(ctx, getSecretName(testBucketId), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the records of the bucket in secret %s: %v", getSecretName(testBucketId), err)
+	}
+	if secret.Labels[StoreLabel] != testDriverName || secret.Annotations[BucketIdAnnotation] != testBucketId {
+		t.Errorf("expected secret labelled with the driver and annotated with the bucket id, got %v and %v", secret.Labels, secret.Annotations)
+	}
+
+	record, err := store.Get(ctx, testBucketId, "first")
+	if err != nil {
+		t.Fatalf("unexpected error getting record: %v", err)
+	}
+	if !reflect.DeepEqual(record, first) {
+		t.Errorf("expected record %+v, got %+v", first, record)
+	}
+
+	// saving again replaces the record
+	updated := newTestRecord(testBucketId, "first")
+	updated.CredentialsHash = "3d4e5f"
+	if err := store.Save(ctx, updated); err != nil {
+		t.Fatalf("unexpected error updating record: %v", err)
+	}
+	if record, _ := store.Get(ctx, testBucketId, "first"); !reflect.DeepEqual(record, updated) {
+		t.Errorf("expected updated record %+v, got %+v", updated, record)
+	}
+
+	records, err := store.ListBucket(ctx, testBucketId)
+	if err != nil {
+		t.Fatalf("unexpected error listing records of the bucket: %v", err)
+	}
+	if ids := getAccountIds(records); !reflect.DeepEqual(ids, []string{"first", "second"}) {
+		t.Errorf("expected records first and second of the bucket, got %v", ids)
+	}
+
+	records, err = store.List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing records: %v", err)
+	}
+	if ids := getAccountIds(records); !reflect.DeepEqual(ids, []string{"first", "second", "third"}) {
+		t.Errorf("expected every record, got %v", ids)
+	}
+
+	for _, accountId := range []string{"first", "first", "second"} {
+		if err := store.Delete(ctx, testBucketId, accountId); err != nil {
+			t.Fatalf("unexpected error deleting record %s: %v", accountId, err)
+		}
+	}
+	if record, err := store.Get(ctx, testBucketId, "second"); err != nil || record != nil {
+		t.Errorf("expected deleted record to be gone, got %+v and error %v", record, err)
+	}
+	_, err = kubeClient.CoreV1().Secrets(testNamespace).Get(ctx, getSecretName(testBucketId), metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the secret to be deleted with the last record of the bucket, got error %v", err)
+	}
+	if records, err := store.ListBucket(ctx, testBucketId); err != nil || len(records) != 0 {
+		t.Errorf("expected no records of the bucket, got %v and error %v", records, err)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	ctx := context.TODO()
+	record := newTestRecord(testBucketId, "first")
+	data := `{"bucketId":"` + testBucketId + `","accountId":"first","accountName":"app","credentialType":"storedaccesspolicy","credentials":"{}","issuedOn":"2021-09-01T12:00:00Z"}`
+
+	tests := []struct {
+		desc     string
+		secrets  []*v1.Secret
+		expected []string
+	}{
+		{
+			desc:     "no records",
+			expected: []string{},
+		},
+		{
+			desc: "secrets of other drivers are ignored",
+			secrets: []*v1.Secret{
+				newTestSecret("cosi-grants-a", "other.cosi.azure.com", map[string][]byte{"other": []byte(data)}),
+				newTestSecret("cosi-grants-b", testDriverName, map[string][]byte{record.AccountId: []byte(data)}),
+			},
+			expected: []string{"first"},
+		},
+		{
+			desc: "unreadable records are skipped",
+			secrets: []*v1.Secret{
+				newTestSecret("cosi-grants-b", testDriverName, map[string][]byte{record.AccountId: []byte(data), "broken": []byte("{")}),
+			},
+			expected: []string{"first"},
+		},
+	}
+
+	for _, test := range tests {
+		kubeClient := fake.NewSimpleClientset()
+		for _, secret := range test.secrets {
+			if _, err := kubeClient.CoreV1().Secrets(testNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("%s: unexpected error creating secret: %v", test.desc, err)
+			}
+		}
+
+		records, err := NewStore(kubeClient, testNamespace, testDriverName).List(ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+			continue
+		}
+		if ids := getAccountIds(records); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: expected records %v, got %v", test.desc, test.expected, ids)
+		}
+	}
+}
+
+func newTestSecret(name, driverName string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{StoreLabel: driverName},
+		},
+		Data: data,
+	}
+}
+
+func getAccountIds(records []*Record) []string {
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.AccountId)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,413 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rotation re-issues time limited bucket access credentials before they expire
+// and writes them into the secret the COSI sidecar created for the BucketAccess.
+package rotation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	clientSet "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	// checkInterval is how often the tracked grants are checked for expiry
+	checkInterval = time.Minute
+	// maxRetryInterval caps the backoff of grants whose rotation keeps failing
+	maxRetryInterval = time.Hour
+
+	EventReasonRotated        = "CredentialsRotated"
+	EventReasonRotationFailed = "CredentialRotationFailed"
+)
+
+// bucketAccessResource is the COSI BucketAccess, which names the secret the sidecar writes the credentials of a grant to
+var bucketAccessResource = schema.GroupVersionResource{Group: "objectstorage.k8s.io", Version: "v1alpha1", Resource: "bucketaccesses"}
+
+// Grant is an active time limited bucket access grant
+type Grant struct {
+	BucketId     string
+	AccountId    string
+	AccountName  string
+	AccessPolicy string
+	Parameters   map[string]string
+	// CredentialType is the kind of credentials the grant hands out, used to undo a grant revoked while rotating
+	CredentialType string
+	// CredentialsHash is the hash of the credentials last handed out for the grant, see HashCredentials
+	CredentialsHash string
+	IssuedOn        time.Time
+	ExpiresOn       time.Time
+	// SecretNamespace and SecretName locate the BucketAccess secret holding the credentials. They are looked up
+	// through the BucketAccess of the grant when it is first rotated, empty until then.
+	SecretNamespace string
+	SecretName      string
+
+	// failures counts the scheduled rotations that failed in a row, which are not retried before retryOn
+	failures int
+	retryOn  time.Time
+}
+
+// HashCredentials returns the SHA-256 hash grants keep of their credentials. It is enough to find the credentials in the
+// secret of the BucketAccess, so the credentials themselves are not kept outside of it.
+func HashCredentials(credentials string) string {
+	hash := sha256.Sum256([]byte(credentials))
+	return hex.EncodeToString(hash[:])
+}
+
+// GrantFunc re-issues the credentials of a grant, returning the new credentials and their expiry
+type GrantFunc func(ctx context.Context, grant *Grant) (string, time.Time, error)
+
+// RotatedFunc is called with a copy of the grant once its new credentials are in the secret
+type RotatedFunc func(ctx context.Context, grant Grant)
+
+// RevokeFunc revokes the credentials of a grant, used when a grant is revoked while its credentials are re-issued
+type RevokeFunc func(ctx context.Context, grant *Grant) error
+
+// Rotator tracks active grants and rotates their credentials ahead of expiry
+type Rotator struct {
+	lock   sync.Mutex
+	grants map[string]*Grant
+	// grantLocks serialize the rotation and the revocation of a grant, they are dropped once nobody holds them
+	grantLocks map[string]*grantLock
+
+	kubeClient    clientSet.Interface
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	grantFunc     GrantFunc
+	rotatedFunc   RotatedFunc
+	revokeFunc    RevokeFunc
+	leadTime      time.Duration
+	now           func() time.Time
+}
+
+type grantLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewRotator creates a Rotator that refreshes credentials leadTime before they expire. The secret of a grant
+// is the one named by the BucketAccess whose status holds the grant's account id, which dynamicClient reads.
+func NewRotator(
+	kubeClient clientSet.Interface,
+	dynamicClient dynamic.Interface,
+	component string,
+	leadTime time.Duration,
+	grantFunc GrantFunc,
+	rotatedFunc RotatedFunc,
+	revokeFunc RevokeFunc) *Rotator {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	return &Rotator{
+		grants:        make(map[string]*Grant),
+		grantLocks:    make(map[string]*grantLock),
+		kubeClient:    kubeClient,
+		dynamicClient: dynamicClient,
+		recorder:      broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component}),
+		grantFunc:     grantFunc,
+		rotatedFunc:   rotatedFunc,
+		revokeFunc:    revokeFunc,
+		leadTime:      leadTime,
+		now:           time.Now,
+	}
+}
+
+// Track starts tracking a grant. Grants without an expiry are never rotated on a schedule,
+// but can still be re-issued on demand.
+func (r *Rotator) Track(grant *Grant) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.grants[grantKey(grant.BucketId, grant.AccountId)] = grant
+}
+
+// Untrack stops tracking the grant, for example before it is revoked, and returns it so that it can be tracked
+// again when the revocation fails. It returns nil for grants that are not tracked.
+func (r *Rotator) Untrack(bucketId, accountId string) *Grant {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := grantKey(bucketId, accountId)
+	grant := r.grants[key]
+	delete(r.grants, key)
+	return grant
+}
+
+// LockGrant holds the grant until the returned function is called, so that its credentials are not re-issued
+// while it is revoked. Revocations untrack the grant while holding it, rotations then skip it.
+func (r *Rotator) LockGrant(bucketId, accountId string) func() {
+	key := grantKey(bucketId, accountId)
+
+	r.lock.Lock()
+	l, ok := r.grantLocks[key]
+	if !ok {
+		l = &grantLock{}
+		r.grantLocks[key] = l
+	}
+	l.refs++
+	r.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		r.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(r.grantLocks, key)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// isTracked checks whether the grant is still tracked, that is not revoked
+func (r *Rotator) isTracked(grant *Grant) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.grants[grantKey(grant.BucketId, grant.AccountId)]
+	return ok
+}
+
+// Run checks the tracked grants until stopCh is closed
+func (r *Rotator) Run(stopCh <-chan struct{}) {
+	klog.Infof("Starting credential rotation with a lead time of %v", r.leadTime)
+	wait.Until(r.rotateExpiring, checkInterval, stopCh)
+}
+
+// rotateExpiring rotates the grants that are due. Grants whose rotation failed stay tracked and are retried
+// with an exponential backoff, so that a grant that can not be rotated does not flood its secret with events.
+func (r *Rotator) rotateExpiring() {
+	now := r.now().UTC()
+
+	r.lock.Lock()
+	due := []*Grant{}
+	for _, grant := range r.grants {
+		if !grant.ExpiresOn.IsZero() && !now.Before(r.rotationTime(grant)) && !now.Before(grant.retryOn) {
+			due = append(due, grant)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, grant := range due {
+		if err := r.rotate(context.Background(), grant); err != nil {
+			retryOn := r.backOff(grant)
+			klog.Errorf("Error rotating credentials of account id %s for bucket %s, retrying at %v : %v", grant.AccountId, grant.BucketId, retryOn, err)
+		}
+	}
+}
+
+// backOff records a failed rotation of the grant and returns when it is retried
+func (r *Rotator) backOff(grant *Grant) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	interval := maxRetryInterval
+	if grant.failures < 6 {
+		interval = checkInterval << uint(grant.failures)
+	}
+	if interval > maxRetryInterval {
+		interval = maxRetryInterval
+	}
+	grant.failures++
+	grant.retryOn = r.now().UTC().Add(interval)
+	return grant.retryOn
+}
+
+// Reissue immediately re-issues the credentials of a tracked grant
+func (r *Rotator) Reissue(ctx context.Context, bucketId, accountId string) error {
+	r.lock.Lock()
+	grant, ok := r.grants[grantKey(bucketId, accountId)]
+	r.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Grant of account id %s for bucket %s is not tracked", accountId, bucketId)
+	}
+
+	return r.rotate(ctx, grant)
+}
+
+// ReissueAll immediately re-issues the credentials of every tracked grant that matches
+func (r *Rotator) ReissueAll(ctx context.Context, match func(bucketId, accountId string) bool) error {
+	r.lock.Lock()
+	matched := []*Grant{}
+	for _, grant := range r.grants {
+		if match(grant.BucketId, grant.AccountId) {
+			matched = append(matched, grant)
+		}
+	}
+	r.lock.Unlock()
+
+	var lastErr error
+	for _, grant := range matched {
+		if err := r.rotate(ctx, grant); err != nil {
+			klog.Errorf("Error re-issuing credentials of account id %s for bucket %s : %v", grant.AccountId, grant.BucketId, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// rotationTime is leadTime before expiry, but never before half the lifetime of the credentials
+// so that short lived grants are not rotated on every check
+func (r *Rotator) rotationTime(grant *Grant) time.Time {
+	rotateOn := grant.ExpiresOn.Add(-r.leadTime)
+	halfLife := grant.IssuedOn.Add(grant.ExpiresOn.Sub(grant.IssuedOn) / 2)
+	if rotateOn.Before(halfLife) {
+		return halfLife
+	}
+	return rotateOn
+}
+
+func (r *Rotator) rotate(ctx context.Context, grant *Grant) error {
+	unlock := r.LockGrant(grant.BucketId, grant.AccountId)
+	defer unlock()
+
+	// The grant may have been revoked since it was picked for rotation
+	if !r.isTracked(grant) {
+		klog.Infof("Grant of account id %s for bucket %s is no longer tracked, not rotating", grant.AccountId, grant.BucketId)
+		return nil
+	}
+
+	secret, err := r.getSecret(ctx, grant)
+	if err != nil {
+		return err
+	}
+
+	// The sidecar stores the credentials under its own key, so the key holding the previous credentials is replaced.
+	// A secret without them was changed by someone else, the grant is retried rather than overwriting it.
+	dataKeys, stringDataKeys := []string{}, []string{}
+	for key, value := range secret.Data {
+		if HashCredentials(string(value)) == grant.CredentialsHash {
+			dataKeys = append(dataKeys, key)
+		}
+	}
+	for key, value := range secret.StringData {
+		if HashCredentials(value) == grant.CredentialsHash {
+			stringDataKeys = append(stringDataKeys, key)
+		}
+	}
+	if len(dataKeys) == 0 && len(stringDataKeys) == 0 {
+		r.recorder.Eventf(secret, v1.EventTypeWarning, EventReasonRotationFailed, "Secret does not hold the credentials of account id %s, not rotating", grant.AccountId)
+		return fmt.Errorf("Secret %s/%s does not hold the credentials of account id %s", secret.Namespace, secret.Name, grant.AccountId)
+	}
+
+	credentials, expiresOn, err := r.grantFunc(ctx, grant)
+	if err != nil {
+		r.recorder.Eventf(secret, v1.EventTypeWarning, EventReasonRotationFailed, "Failed to rotate credentials of account id %s: %v", grant.AccountId, err)
+		return err
+	}
+
+	// Revocations hold the grant, but a grant untracked without it must not be brought back by the new credentials
+	if !r.isTracked(grant) {
+		if r.revokeFunc != nil {
+			if err := r.revokeFunc(ctx, grant); err != nil {
+				return fmt.Errorf("Error undoing credentials of revoked account id %s for bucket %s : %v", grant.AccountId, grant.BucketId, err)
+			}
+		}
+		return fmt.Errorf("Grant of account id %s for bucket %s was revoked while its credentials were re-issued", grant.AccountId, grant.BucketId)
+	}
+
+	for _, key := range dataKeys {
+		secret.Data[key] = []byte(credentials)
+	}
+	for _, key := range stringDataKeys {
+		secret.StringData[key] = credentials
+	}
+
+	if _, err := r.kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		r.recorder.Eventf(secret, v1.EventTypeWarning, EventReasonRotationFailed, "Failed to update rotated credentials of account id %s: %v", grant.AccountId, err)
+		return fmt.Errorf("Error updating secret %s/%s : %v", secret.Namespace, secret.Name, err)
+	}
+
+	r.lock.Lock()
+	grant.CredentialsHash = HashCredentials(credentials)
+	grant.IssuedOn = r.now().UTC()
+	grant.ExpiresOn = expiresOn
+	grant.failures = 0
+	grant.retryOn = time.Time{}
+	rotated := *grant
+	r.lock.Unlock()
+
+	if r.rotatedFunc != nil {
+		r.rotatedFunc(ctx, rotated)
+	}
+
+	klog.Infof("Rotated credentials of account id %s for bucket %s, expires on %v", grant.AccountId, grant.BucketId, expiresOn)
+	r.recorder.Eventf(secret, v1.EventTypeNormal, EventReasonRotated, "Rotated credentials of account id %s, new credentials expire on %v", grant.AccountId, expiresOn)
+	return nil
+}
+
+// getSecret returns the BucketAccess secret of the grant. Grants that do not know their secret yet find it
+// through the BucketAccess whose status holds their account id, which the sidecar sets once the grant is issued.
+func (r *Rotator) getSecret(ctx context.Context, grant *Grant) (*v1.Secret, error) {
+	r.lock.Lock()
+	namespace, name := grant.SecretNamespace, grant.SecretName
+	r.lock.Unlock()
+
+	if name == "" {
+		var err error
+		namespace, name, err = r.findSecret(ctx, grant.AccountId)
+		if err != nil {
+			return nil, err
+		}
+
+		r.lock.Lock()
+		grant.SecretNamespace, grant.SecretName = namespace, name
+		r.lock.Unlock()
+	}
+
+	secret, err := r.kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting secret %s/%s of account id %s : %v", namespace, name, grant.AccountId, err)
+	}
+	return secret, nil
+}
+
+// findSecret returns the namespace and name of the credentials secret of the BucketAccess with the account id
+func (r *Rotator) findSecret(ctx context.Context, accountId string) (string, string, error) {
+	bucketAccesses, err := r.dynamicClient.Resource(bucketAccessResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("Error listing BucketAccesses : %v", err)
+	}
+
+	for _, bucketAccess := range bucketAccesses.Items {
+		if id, _, _ := unstructured.NestedString(bucketAccess.Object, "status", "accountID"); id != accountId {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(bucketAccess.Object, "spec", "credentialsSecretName")
+		if name == "" {
+			return "", "", fmt.Errorf("BucketAccess %s/%s of account id %s names no credentials secret", bucketAccess.GetNamespace(), bucketAccess.GetName(), accountId)
+		}
+		return bucketAccess.GetNamespace(), name, nil
+	}
+
+	return "", "", fmt.Errorf("No BucketAccess has account id %s", accountId)
+}
+
+func grantKey(bucketId, accountId string) string {
+	return bucketId + "/" + accountId
+}
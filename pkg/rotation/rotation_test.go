@@ -0,0 +1,350 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotation
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace  = "app"
+	testSecretName = "bucketaccess-credentials"
+	testBucketId   = "https://account.blob.core.windows.net/bucket"
+)
+
+// newTestBucketAccess returns a BucketAccess as the sidecar leaves it once the grant of the account id was issued
+func newTestBucketAccess(namespace, name, accountId, secretName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "objectstorage.k8s.io/v1alpha1",
+		"kind":       "BucketAccess",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec":       map[string]interface{}{"credentialsSecretName": secretName},
+		"status":     map[string]interface{}{"accountID": accountId},
+	}}
+}
+
+func newTestDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{bucketAccessResource: "BucketAccessList"}, objects...)
+}
+
+func TestRotationTime(t *testing.T) {
+	issuedOn := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc     string
+		lifetime time.Duration
+		leadTime time.Duration
+		expected time.Duration
+	}{
+		{
+			desc:     "lead time before expiry",
+			lifetime: 24 * time.Hour,
+			leadTime: time.Hour,
+			expected: 23 * time.Hour,
+		},
+		{
+			desc:     "half the lifetime of short lived credentials",
+			lifetime: time.Hour,
+			leadTime: 2 * time.Hour,
+			expected: 30 * time.Minute,
+		},
+		{
+			desc:     "lead time of exactly half the lifetime",
+			lifetime: 2 * time.Hour,
+			leadTime: time.Hour,
+			expected: time.Hour,
+		},
+	}
+
+	for _, test := range tests {
+		rotator := &Rotator{leadTime: test.leadTime}
+		grant := &Grant{IssuedOn: issuedOn, ExpiresOn: issuedOn.Add(test.lifetime)}
+		if rotateOn := rotator.rotationTime(grant); !rotateOn.Equal(issuedOn.Add(test.expected)) {
+			t.Errorf("%s: expected rotation at %v, got %v", test.desc, issuedOn.Add(test.expected), rotateOn)
+		}
+	}
+}
+
+func TestReissue(t *testing.T) {
+	expiresOn := time.Date(2021, 9, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc string
+		// secretData holds the credentials of the BucketAccess secret
+		secretData map[string][]byte
+		// revoke untracks the grant while its credentials are re-issued
+		revoke bool
+		// untracked grants are not re-issued at all
+		untracked           bool
+		expectErr           bool
+		expectedCredentials string
+		expectRotated       bool
+		expectRevoked       bool
+		expectTracked       bool
+	}{
+		{
+			desc:                "rotated",
+			secretData:          map[string][]byte{"BucketInfo": []byte("old")},
+			expectedCredentials: "new",
+			expectRotated:       true,
+			expectTracked:       true,
+		},
+		{
+			desc:                "secret without the previous credentials",
+			secretData:          map[string][]byte{"BucketInfo": []byte("other")},
+			expectErr:           true,
+			expectedCredentials: "other",
+			// the grant is retried later rather than forgotten
+			expectTracked: true,
+		},
+		{
+			desc:                "revoked while re-issuing",
+			secretData:          map[string][]byte{"BucketInfo": []byte("old")},
+			revoke:              true,
+			expectErr:           true,
+			expectedCredentials: "old",
+			expectRevoked:       true,
+		},
+		{
+			desc:                "untracked",
+			secretData:          map[string][]byte{"BucketInfo": []byte("old")},
+			untracked:           true,
+			expectErr:           true,
+			expectedCredentials: "old",
+		},
+	}
+
+	for _, test := range tests {
+		ctx := context.TODO()
+		kubeClient := fake.NewSimpleClientset(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: testSecretName, Namespace: testNamespace},
+			Data:       test.secretData,
+		})
+
+		var rotator *Rotator
+		rotated, revoked := false, false
+		grantFunc := func(ctx context.Context, grant *Grant) (string, time.Time, error) {
+			if test.revoke {
+				rotator.Untrack(grant.BucketId, grant.AccountId)
+			}
+			return "new", expiresOn, nil
+		}
+		rotatedFunc := func(ctx context.Context, grant Grant) {
+			rotated = grant.CredentialsHash == HashCredentials("new") && grant.ExpiresOn.Equal(expiresOn) &&
+				grant.SecretNamespace == testNamespace && grant.SecretName == testSecretName
+		}
+		revokeFunc := func(ctx context.Context, grant *Grant) error {
+			revoked = true
+			return nil
+		}
+		dynamicClient := newTestDynamicClient(
+			newTestBucketAccess("other", "bucketaccess", "other", "other-credentials"),
+			newTestBucketAccess(testNamespace, "bucketaccess", "account", testSecretName))
+		rotator = NewRotator(kubeClient, dynamicClient, "test", time.Hour, grantFunc, rotatedFunc, revokeFunc)
+
+		if !test.untracked {
+			rotator.Track(&Grant{
+				BucketId:        testBucketId,
+				AccountId:       "account",
+				AccountName:     "bucketaccess",
+				CredentialsHash: HashCredentials("old"),
+				ExpiresOn:       expiresOn.Add(-24 * time.Hour),
+			})
+		}
+
+		err := rotator.Reissue(ctx, testBucketId, "account")
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.desc, test.expectErr, err)
+		}
+
+		secret, err := kubeClient.CoreV1().Secrets(testNamespace).Get(ctx, testSecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error getting secret: %v", test.desc, err)
+		}
+		if credentials := string(secret.Data["BucketInfo"]); credentials != test.expectedCredentials {
+			t.Errorf("%s: expected credentials '%s' in the secret, got '%s'", test.desc, test.expectedCredentials, credentials)
+		}
+		if rotated != test.expectRotated {
+			t.Errorf("%s: expected rotated callback %v, got %v", test.desc, test.expectRotated, rotated)
+		}
+		if revoked != test.expectRevoked {
+			t.Errorf("%s: expected the new credentials to be revoked %v, got %v", test.desc, test.expectRevoked, revoked)
+		}
+		if tracked := rotator.Untrack(testBucketId, "account") != nil; tracked != test.expectTracked {
+			t.Errorf("%s: expected the grant to be tracked %v, got %v", test.desc, test.expectTracked, tracked)
+		}
+	}
+}
+
+func TestGetSecret(t *testing.T) {
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: testSecretName, Namespace: testNamespace}}
+
+	t.Run("recorded secret", func(t *testing.T) {
+		// without any BucketAccess the secret can only be found through the grant
+		rotator := NewRotator(fake.NewSimpleClientset(secret), newTestDynamicClient(), "test", time.Hour, nil, nil, nil)
+		grant := &Grant{AccountId: "account", SecretNamespace: testNamespace, SecretName: testSecretName}
+		if _, err := rotator.getSecret(context.TODO(), grant); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("secret of the BucketAccess", func(t *testing.T) {
+		dynamicClient := newTestDynamicClient(newTestBucketAccess(testNamespace, "bucketaccess", "account", testSecretName))
+		rotator := NewRotator(fake.NewSimpleClientset(secret), dynamicClient, "test", time.Hour, nil, nil, nil)
+		grant := &Grant{AccountId: "account", AccountName: "ba-account"}
+		if _, err := rotator.getSecret(context.TODO(), grant); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if grant.SecretNamespace != testNamespace || grant.SecretName != testSecretName {
+			t.Errorf("expected the grant to remember secret %s/%s, got %s/%s", testNamespace, testSecretName, grant.SecretNamespace, grant.SecretName)
+		}
+	})
+
+	t.Run("no BucketAccess", func(t *testing.T) {
+		dynamicClient := newTestDynamicClient(newTestBucketAccess(testNamespace, "bucketaccess", "other", testSecretName))
+		rotator := NewRotator(fake.NewSimpleClientset(secret), dynamicClient, "test", time.Hour, nil, nil, nil)
+		if _, err := rotator.getSecret(context.TODO(), &Grant{AccountId: "account"}); err == nil {
+			t.Errorf("expected an error for a grant without BucketAccess")
+		}
+	})
+
+	t.Run("BucketAccess without secret", func(t *testing.T) {
+		dynamicClient := newTestDynamicClient(newTestBucketAccess(testNamespace, "bucketaccess", "account", ""))
+		rotator := NewRotator(fake.NewSimpleClientset(secret), dynamicClient, "test", time.Hour, nil, nil, nil)
+		if _, err := rotator.getSecret(context.TODO(), &Grant{AccountId: "account"}); err == nil {
+			t.Errorf("expected an error for a BucketAccess that names no secret")
+		}
+	})
+}
+
+func TestRotateExpiring(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	newGrant := func(accountId string, issuedOn time.Time, lifetime time.Duration) *Grant {
+		grant := &Grant{
+			BucketId:        testBucketId,
+			AccountId:       accountId,
+			CredentialsHash: HashCredentials("old-" + accountId),
+			IssuedOn:        issuedOn,
+			SecretNamespace: testNamespace,
+			SecretName:      accountId,
+		}
+		if lifetime != 0 {
+			grant.ExpiresOn = issuedOn.Add(lifetime)
+		}
+		return grant
+	}
+	grants := []*Grant{
+		// due half an hour ago, an hour ahead of expiry
+		newGrant("due", now.Add(-23*time.Hour-30*time.Minute), 24*time.Hour),
+		newGrant("later", now.Add(-time.Hour), 24*time.Hour),
+		newGrant("unlimited", now.Add(-48*time.Hour), 0),
+		// due, but its secret no longer holds its credentials
+		newGrant("changed", now.Add(-23*time.Hour-30*time.Minute), 24*time.Hour),
+	}
+
+	kubeClient := fake.NewSimpleClientset()
+	for _, grant := range grants {
+		data := map[string][]byte{"BucketInfo": []byte("old-" + grant.AccountId)}
+		if grant.AccountId == "changed" {
+			data["BucketInfo"] = []byte("edited")
+		}
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: grant.AccountId, Namespace: testNamespace}, Data: data}
+		if _, err := kubeClient.CoreV1().Secrets(testNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error creating secret: %v", err)
+		}
+	}
+
+	reissued := map[string]int{}
+	grantFunc := func(ctx context.Context, grant *Grant) (string, time.Time, error) {
+		reissued[grant.AccountId]++
+		return "new-" + grant.AccountId, now.Add(24 * time.Hour), nil
+	}
+	rotator := NewRotator(kubeClient, newTestDynamicClient(), "test", time.Hour, grantFunc, nil, nil)
+	rotator.now = func() time.Time { return now }
+	for _, grant := range grants {
+		rotator.Track(grant)
+	}
+
+	steps := []struct {
+		desc     string
+		advance  time.Duration
+		expected map[string]int
+	}{
+		{
+			desc:     "only the due grant is re-issued",
+			expected: map[string]int{"due": 1},
+		},
+		{
+			desc:     "rotated grant is not due again and the changed secret backs off",
+			advance:  30 * time.Second,
+			expected: map[string]int{"due": 1},
+		},
+		{
+			desc:     "later grant becomes due",
+			advance:  22 * time.Hour,
+			expected: map[string]int{"due": 1, "later": 1},
+		},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		rotator.rotateExpiring()
+		if !reflect.DeepEqual(reissued, step.expected) {
+			t.Errorf("%s: expected re-issued grants %v, got %v", step.desc, step.expected, reissued)
+		}
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(testNamespace).Get(ctx, "due", metav1.GetOptions{})
+	if err != nil || string(secret.Data["BucketInfo"]) != "new-due" {
+		t.Errorf("expected the rotated credentials in the secret, got %v and error %v", secret, err)
+	}
+
+	// the changed secret keeps being retried, at most every maxRetryInterval
+	changed := rotator.Untrack(testBucketId, "changed")
+	if changed == nil {
+		t.Fatalf("expected the grant with the changed secret to stay tracked")
+	}
+	if changed.failures < 2 || changed.retryOn.Sub(now) > maxRetryInterval || !changed.retryOn.After(now) {
+		t.Errorf("expected the grant to back off, got %d failures and a retry at %v", changed.failures, changed.retryOn)
+	}
+}
+
+func TestHashCredentials(t *testing.T) {
+	credentials := `{"version":"v1","sasToken":"sv=2020-08-04&sig=secret"}`
+	hash := HashCredentials(credentials)
+	if hash != HashCredentials(credentials) {
+		t.Errorf("expected the hash of the same credentials to be stable")
+	}
+	if len(hash) != 64 || strings.Contains(hash, "secret") {
+		t.Errorf("expected a hex encoded SHA-256 hash, got %s", hash)
+	}
+	if hash == HashCredentials(credentials+" ") {
+		t.Errorf("expected other credentials to hash differently")
+	}
+}
@@ -17,11 +17,15 @@ import (
 	"context"
 	"fmt"
 	"project/azure-cosi-driver/pkg/azureutils"
+	"project/azure-cosi-driver/pkg/grantstore"
+	"project/azure-cosi-driver/pkg/rotation"
 	"reflect"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 	spec "sigs.k8s.io/container-object-storage-interface-spec"
@@ -39,6 +43,10 @@ type provisioner struct {
 	nameToBucketMap   map[string]*bucketDetails
 	bucketIdToNameMap map[string]string
 	cloud             *azure.Cloud
+	bucketClients     *azureutils.BucketClients
+	accessClients     *azureutils.AccessClients
+	rotator           *rotation.Rotator
+	grantStore        *grantstore.Store
 }
 
 var _ spec.ProvisionerServer = &provisioner{}
@@ -46,24 +54,81 @@ var _ spec.ProvisionerServer = &provisioner{}
 func NewProvisionerServer(
 	kubeconfig,
 	cloudConfigSecretName,
-	cloudConfigSecretNamespace string) (spec.ProvisionerServer, error) {
+	cloudConfigSecretNamespace,
+	driverName,
+	driverVersion,
+	credentialSecretNamespace string,
+	credentialRefreshLeadTime,
+	maxCredentialLifetime time.Duration,
+	allowedPublicAccessLevels []string,
+	deleteEmptyStorageAccounts bool) (spec.ProvisionerServer, error) {
 	kubeClient, err := azureutils.GetKubeClient(kubeconfig)
 	if err != nil {
 		return nil, err
 	}
 	klog.Infof("Kubeclient : %+v", kubeClient)
 
+	dynamicClient, err := azureutils.GetDynamicClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
 	azCloud, err := azureutils.GetAzureCloudProvider(kubeClient, cloudConfigSecretName, cloudConfigSecretNamespace)
 	if err != nil {
 		return nil, err
 	}
 
-	return &provisioner{
+	// Only role assignment and ACL grants need the authorization client, the driver serves every other
+	// grant without it, for example in clouds without a known Microsoft Graph endpoint
+	authorizationClient, err := azureutils.NewAuthorizationClient(azCloud)
+	if err != nil {
+		klog.Warningf("Role assignment and ACL grants are unavailable : %v", err)
+	}
+
+	storageManagementClient, err := azureutils.NewStorageManagementClient(azCloud)
+	if err != nil {
+		return nil, err
+	}
+
+	dataLakeClient, err := azureutils.NewDataLakeClient(azCloud)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &provisioner{
 		nameToBucketMap:   make(map[string]*bucketDetails),
 		bucketsLock:       sync.RWMutex{},
 		bucketIdToNameMap: make(map[string]string),
 		cloud:             azCloud,
-	}, nil
+		bucketClients: &azureutils.BucketClients{
+			Cloud:                      azCloud,
+			StorageManagement:          storageManagementClient,
+			AllowedPublicAccessLevels:  allowedPublicAccessLevels,
+			DriverVersion:              driverVersion,
+			DeleteEmptyStorageAccounts: deleteEmptyStorageAccounts,
+		},
+		accessClients: &azureutils.AccessClients{
+			Cloud:             azCloud,
+			KeyCache:          azureutils.NewUserDelegationKeyCache(),
+			Authorization:     authorizationClient,
+			StorageManagement: storageManagementClient,
+			AccountKeys:       azureutils.NewAccountKeyRegistry(),
+			DataLake:          dataLakeClient,
+			MaxGrantLifetime:  maxCredentialLifetime,
+		},
+		grantStore: grantstore.NewStore(kubeClient, credentialSecretNamespace, driverName),
+	}
+
+	pr.rotator = rotation.NewRotator(kubeClient, dynamicClient, driverName, credentialRefreshLeadTime, pr.reissueGrant, pr.grantRotated, pr.undoGrant)
+	pr.accessClients.Reissuer = pr.rotator
+
+	if err := pr.restoreGrants(context.Background()); err != nil {
+		return nil, err
+	}
+	go pr.rotator.Run(wait.NeverStop)
+	go wait.Until(pr.sweepRetainedStorageAccounts, azureutils.RetainedAccountSweepInterval, wait.NeverStop)
+
+	return pr, nil
 }
 
 func (pr *provisioner) ProvisionerCreateBucket(
@@ -106,7 +171,7 @@ func (pr *provisioner) ProvisionerCreateBucket(
 
 	storageAccountName := azureBlob.StorageAccount
 
-	bucketId, err := azureutils.CreateBucket(ctx, storageAccountName, bucketName, parameters, pr.cloud)
+	bucketId, err := azureutils.CreateBucket(ctx, storageAccountName, bucketName, parameters, pr.bucketClients)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +197,17 @@ func (pr *provisioner) ProvisionerDeleteBucket(
 	req *spec.ProvisionerDeleteBucketRequest) (*spec.ProvisionerDeleteBucketResponse, error) {
 	bucketId := req.GetBucketId()
 	klog.Infof("ProvisionerDeleteBucket :: Bucket id :: %s", bucketId)
-	err := azureutils.DeleteBucket(ctx, bucketId, pr.cloud)
+
+	if err := azureutils.EnsureBucketDeletable(ctx, bucketId, pr.bucketClients); err != nil {
+		return nil, err
+	}
+
+	// Role assignments and local users outlive the container, so the grants are torn down first
+	if err := pr.revokeBucketGrants(ctx, bucketId); err != nil {
+		return nil, err
+	}
+
+	err := azureutils.DeleteBucket(ctx, bucketId, pr.bucketClients)
 
 	if err != nil {
 		return nil, err
@@ -152,11 +227,198 @@ func (pr *provisioner) ProvisionerDeleteBucket(
 func (pr *provisioner) ProvisionerGrantBucketAccess(
 	ctx context.Context,
 	req *spec.ProvisionerGrantBucketAccessRequest) (*spec.ProvisionerGrantBucketAccessResponse, error) {
-	return &spec.ProvisionerGrantBucketAccessResponse{}, nil
+	bucketId := req.GetBucketId()
+	if bucketId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Bucket id is empty")
+	}
+
+	accountName := req.GetAccountName()
+	if accountName == "" {
+		return nil, status.Error(codes.InvalidArgument, "Account name is empty")
+	}
+
+	klog.Infof("ProvisionerGrantBucketAccess :: Bucket id :: %s, Account name :: %s", bucketId, accountName)
+	grant, err := azureutils.GrantBucketAccess(ctx, bucketId, accountName, req.GetAccessPolicy(), req.GetParameters(), pr.accessClients)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &grantstore.Record{
+		BucketId:        bucketId,
+		AccountId:       grant.AccountId,
+		AccountName:     accountName,
+		AccessPolicy:    req.GetAccessPolicy(),
+		Parameters:      req.GetParameters(),
+		CredentialType:  grant.CredentialType,
+		AccountKeyName:  grant.AccountKeyName,
+		CredentialsHash: rotation.HashCredentials(grant.Credentials),
+		IssuedOn:        time.Now().UTC(),
+		ExpiresOn:       grant.ExpiresOn,
+	}
+	if err := pr.grantStore.Save(ctx, record); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	pr.rotator.Track(toRotationGrant(record))
+
+	return &spec.ProvisionerGrantBucketAccessResponse{
+		AccountId:   grant.AccountId,
+		Credentials: grant.Credentials,
+	}, nil
 }
 
 func (pr *provisioner) ProvisionerRevokeBucketAccess(
 	ctx context.Context,
 	req *spec.ProvisionerRevokeBucketAccessRequest) (*spec.ProvisionerRevokeBucketAccessResponse, error) {
+	bucketId := req.GetBucketId()
+	if bucketId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Bucket id is empty")
+	}
+
+	accountId := req.GetAccountId()
+	if accountId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Account id is empty")
+	}
+
+	klog.Infof("ProvisionerRevokeBucketAccess :: Bucket id :: %s, Account id :: %s", bucketId, accountId)
+	record, err := pr.grantStore.Get(ctx, bucketId, accountId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := pr.revokeGrant(ctx, bucketId, accountId, record); err != nil {
+		return nil, err
+	}
+
 	return &spec.ProvisionerRevokeBucketAccessResponse{}, nil
 }
+
+// revokeGrant revokes the grant, stops rotating it and forgets its record, which is nil for unrecorded grants.
+// The grant is held and untracked before it is revoked, so that a rotation can not re-issue it underneath.
+func (pr *provisioner) revokeGrant(ctx context.Context, bucketId, accountId string, record *grantstore.Record) error {
+	unlock := pr.rotator.LockGrant(bucketId, accountId)
+	defer unlock()
+	tracked := pr.rotator.Untrack(bucketId, accountId)
+
+	var issued *azureutils.IssuedGrant
+	if record != nil {
+		issued = &azureutils.IssuedGrant{
+			CredentialType: record.CredentialType,
+			AccountName:    record.AccountName,
+			AccessPolicy:   record.AccessPolicy,
+		}
+	}
+
+	if err := azureutils.RevokeBucketAccess(ctx, bucketId, accountId, issued, pr.accessClients); err != nil {
+		// The grant is still in place, so it keeps being rotated until the revocation is retried
+		if tracked != nil {
+			pr.rotator.Track(tracked)
+		}
+		return err
+	}
+
+	if err := pr.grantStore.Delete(ctx, bucketId, accountId); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// revokeBucketGrants revokes every recorded grant of the bucket. A grant that fails to be revoked keeps
+// its record, so that deleting the bucket again retries it.
+func (pr *provisioner) revokeBucketGrants(ctx context.Context, bucketId string) error {
+	records, err := pr.grantStore.ListBucket(ctx, bucketId)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for _, record := range records {
+		klog.Infof("Revoking grant of account id %s for deleted bucket %s", record.AccountId, bucketId)
+		if err := pr.revokeGrant(ctx, bucketId, record.AccountId, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reissueGrant mints fresh credentials for a tracked grant on behalf of the rotator
+func (pr *provisioner) reissueGrant(ctx context.Context, grant *rotation.Grant) (string, time.Time, error) {
+	reissued, err := azureutils.GrantBucketAccess(ctx, grant.BucketId, grant.AccountName, grant.AccessPolicy, grant.Parameters, pr.accessClients)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return reissued.Credentials, reissued.ExpiresOn, nil
+}
+
+// undoGrant revokes the credentials a rotation re-issued for a grant that was revoked in the meantime
+func (pr *provisioner) undoGrant(ctx context.Context, grant *rotation.Grant) error {
+	return azureutils.RevokeBucketAccess(ctx, grant.BucketId, grant.AccountId, &azureutils.IssuedGrant{
+		CredentialType: grant.CredentialType,
+		AccountName:    grant.AccountName,
+		AccessPolicy:   grant.AccessPolicy,
+	}, pr.accessClients)
+}
+
+// grantRotated persists the hash of the credentials the rotator handed out, along with the account key the grant now holds
+func (pr *provisioner) grantRotated(ctx context.Context, grant rotation.Grant) {
+	record, err := pr.grantStore.Get(ctx, grant.BucketId, grant.AccountId)
+	if err != nil || record == nil {
+		klog.Warningf("Unable to find the grant record of account id %s for bucket %s : %v", grant.AccountId, grant.BucketId, err)
+		return
+	}
+
+	record.CredentialsHash = grant.CredentialsHash
+	record.IssuedOn = grant.IssuedOn
+	record.ExpiresOn = grant.ExpiresOn
+	record.SecretNamespace = grant.SecretNamespace
+	record.SecretName = grant.SecretName
+	record.AccountKeyName = pr.accessClients.AccountKeys.KeyName(grant.BucketId, grant.AccountId)
+	if err := pr.grantStore.Save(ctx, record); err != nil {
+		klog.Warningf("Unable to persist rotated credentials of account id %s : %v", grant.AccountId, err)
+	}
+}
+
+// sweepRetainedStorageAccounts deletes the storage accounts kept after their last bucket was deleted, once they no
+// longer retain soft deleted containers
+func (pr *provisioner) sweepRetainedStorageAccounts() {
+	if err := pr.bucketClients.StorageManagement.SweepRetainedStorageAccounts(context.Background()); err != nil {
+		klog.Errorf("Error sweeping retained storage accounts : %v", err)
+	}
+}
+
+// restoreGrants reloads the grants recorded before the driver restarted, so that they are rotated and
+// revoked as if the driver had never stopped
+func (pr *provisioner) restoreGrants(ctx context.Context) error {
+	records, err := pr.grantStore.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.AccountKeyName != "" {
+			pr.accessClients.AccountKeys.Restore(record.BucketId, record.AccountId, record.AccountKeyName)
+		}
+		pr.rotator.Track(toRotationGrant(record))
+	}
+	pr.accessClients.AccountKeys.RebuildActiveKeys()
+	klog.Infof("Restored %d grant records", len(records))
+
+	return nil
+}
+
+func toRotationGrant(record *grantstore.Record) *rotation.Grant {
+	return &rotation.Grant{
+		BucketId:        record.BucketId,
+		AccountId:       record.AccountId,
+		AccountName:     record.AccountName,
+		AccessPolicy:    record.AccessPolicy,
+		Parameters:      record.Parameters,
+		CredentialType:  record.CredentialType,
+		CredentialsHash: record.CredentialsHash,
+		IssuedOn:        record.IssuedOn,
+		ExpiresOn:       record.ExpiresOn,
+		SecretNamespace: record.SecretNamespace,
+		SecretName:      record.SecretName,
+	}
+}
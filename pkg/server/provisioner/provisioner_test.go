@@ -0,0 +1,90 @@
+// Copyright 2021 The Kubernetes Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// You may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisionerserver
+
+import (
+	"context"
+	"project/azure-cosi-driver/pkg/azureutils"
+	"project/azure-cosi-driver/pkg/grantstore"
+	"project/azure-cosi-driver/pkg/rotation"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	spec "sigs.k8s.io/container-object-storage-interface-spec"
+)
+
+const testBucketId = "https://account.blob.core.windows.net/bucket"
+
+// newTestProvisioner returns a provisioner without Azure clients, so that every grant needing Azure fails to be revoked
+func newTestProvisioner() *provisioner {
+	kubeClient := fake.NewSimpleClientset()
+	pr := &provisioner{
+		nameToBucketMap:   make(map[string]*bucketDetails),
+		bucketIdToNameMap: make(map[string]string),
+		bucketClients:     &azureutils.BucketClients{Cloud: &azure.Cloud{}},
+		accessClients: &azureutils.AccessClients{
+			Cloud:       &azure.Cloud{},
+			AccountKeys: azureutils.NewAccountKeyRegistry(),
+		},
+		grantStore: grantstore.NewStore(kubeClient, "cosi-driver", "blob.cosi.azure.com"),
+	}
+	pr.rotator = rotation.NewRotator(kubeClient, nil, "test", time.Hour, pr.reissueGrant, pr.grantRotated, pr.undoGrant)
+	return pr
+}
+
+func TestRevokeBucketGrants(t *testing.T) {
+	ctx := context.TODO()
+	pr := newTestProvisioner()
+
+	issuedOn := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	record := &grantstore.Record{
+		BucketId:       testBucketId,
+		AccountId:      "role",
+		AccountName:    "11111111-2222-3333-4444-555555555555",
+		AccessPolicy:   "read",
+		CredentialType: azureutils.CredentialTypeRoleAssignment,
+		IssuedOn:       issuedOn,
+	}
+	if err := pr.grantStore.Save(ctx, record); err != nil {
+		t.Fatalf("unexpected error saving record: %v", err)
+	}
+	pr.rotator.Track(toRotationGrant(record))
+
+	// without the authorization client the role assignment can not be removed, so the bucket must not be deleted
+	err := pr.revokeBucketGrants(ctx, testBucketId)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the revocation to fail with %v, got %v", codes.FailedPrecondition, err)
+	}
+
+	// the grant is kept as it was, so that deleting the bucket again retries it
+	if kept, err := pr.grantStore.Get(ctx, testBucketId, "role"); err != nil || kept == nil {
+		t.Errorf("expected the record of the grant to be kept, got %v and error %v", kept, err)
+	}
+	if tracked := pr.rotator.Untrack(testBucketId, "role"); tracked == nil {
+		t.Errorf("expected the grant to be tracked again")
+	}
+}
+
+func TestDeleteInvalidBucket(t *testing.T) {
+	pr := newTestProvisioner()
+
+	_, err := pr.ProvisionerDeleteBucket(context.TODO(), &spec.ProvisionerDeleteBucketRequest{BucketId: "bucket"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %v, got %v", codes.InvalidArgument, err)
+	}
+}